@@ -2,25 +2,37 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/limiter"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/swagger"
+	redisv9 "github.com/redis/go-redis/v9"
 
 	docs "github.com/rznas/zeus/docs"
+
 	"github.com/rznas/zeus/internal/config"
 	"github.com/rznas/zeus/internal/db"
+	"github.com/rznas/zeus/internal/email"
+	"github.com/rznas/zeus/internal/logging"
+	"github.com/rznas/zeus/internal/metrics"
 	"github.com/rznas/zeus/internal/middleware"
 	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/phone"
+	"github.com/rznas/zeus/internal/ratelimit"
+	"github.com/rznas/zeus/internal/rbac"
 	"github.com/rznas/zeus/internal/repositories"
 	"github.com/rznas/zeus/internal/routes"
 	"github.com/rznas/zeus/internal/services"
+	"github.com/rznas/zeus/internal/tracing"
 )
 
 // @title Zeus API
@@ -34,79 +46,439 @@ import (
 func main() {
 	cfg := config.Load()
 
+	logger, err := logging.New(os.Stdout, cfg.App.LogFormat, cfg.App.LogLevel, cfg.App.OTPLength)
+	if err != nil {
+		log.Fatalf("failed to configure logging: %v", err)
+	}
+	// route the standard library logger, used by dependencies, through the same redacting handler
+	slog.SetDefault(logger)
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(cfg, logger, os.Args[2:]))
+	}
+
 	// Set swagger info
 	docs.SwaggerInfo.Host = "localhost:" + cfg.App.Port
 	docs.SwaggerInfo.BasePath = "/"
 	docs.SwaggerInfo.Title = "Zeus API"
 	docs.SwaggerInfo.Description = "Fiber + GORM + Redis user service with OTP and JWT."
 
-	// Setup Postgres
-	gormDB, err := db.NewPostgres(db.PostgresOptions{
-		Host:     cfg.Postgres.Host,
-		Port:     cfg.Postgres.Port,
-		DB:       cfg.Postgres.DB,
-		User:     cfg.Postgres.User,
-		Password: cfg.Postgres.Password,
+	// Tracing, a no-op unless TRACING_OTLP_ENDPOINT is set
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Options{
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		ServiceName: cfg.Tracing.ServiceName,
+		SampleRatio: cfg.Tracing.SampleRatio,
 	})
 	if err != nil {
-		log.Fatalf("failed to connect postgres: %v", err)
+		fatal(logger, "failed to configure tracing", err)
+	}
+
+	// Setup Postgres
+	gormDB, err := connectPostgres(cfg.Postgres, logger)
+	if err != nil {
+		fatal(logger, "failed to connect postgres", err)
 	}
-	// Migrate
-	if err := gormDB.AutoMigrate(&models.User{}); err != nil {
-		log.Fatalf("failed to migrate: %v", err)
+	// Schema
+	if err := prepareSchema(context.Background(), gormDB, cfg, logger); err != nil {
+		fatal(logger, "failed to prepare schema", err)
+	}
+	if err := tracing.InstrumentGORM(gormDB); err != nil {
+		fatal(logger, "failed to instrument gorm", err)
 	}
 
 	// Setup Redis
 	redisClient := db.NewRedisClient(db.RedisOptions{Addr: cfg.Redis.Addr, Password: cfg.Redis.Password, DB: cfg.Redis.DB})
 	if err := db.RedisPing(context.Background(), redisClient); err != nil {
-		log.Fatalf("failed to connect redis: %v", err)
+		fatal(logger, "failed to connect redis", err)
+	}
+	if err := tracing.InstrumentRedis(redisClient); err != nil {
+		fatal(logger, "failed to instrument redis", err)
 	}
 
 	// Services
-	otpSvc := services.NewOTPService(redisClient, cfg.App.OTPTTLSeconds, cfg.App.OTPRatePerMin, cfg.App.OTPRateLimitSeconds)
-	jwtSvc := services.NewJWTService(cfg.App.JWTSecret, cfg.App.JWTExpiresMinutes)
+	phones := phone.NewParser(cfg.App.PhoneDefaultRegion)
+	sender, err := newSMSSender(cfg.App, logger)
+	if err != nil {
+		fatal(logger, "failed to configure sms provider", err)
+	}
+	otpOpts, err := otpOptions(cfg.App, logger)
+	if err != nil {
+		fatal(logger, "failed to configure otp", err)
+	}
+	otpSvc := services.NewOTPService(redisClient, sender, phones, otpOpts)
+	mailer, err := newMailer(cfg.App, logger)
+	if err != nil {
+		fatal(logger, "failed to configure email provider", err)
+	}
+	magicLinks := services.NewMagicLinks(cfg.App.MagicLinkURL, otpOpts.Secret, time.Duration(cfg.App.OTPTTLSeconds)*time.Second)
+	// email codes share the limits of SMS codes but are counted separately
+	emailOpts := otpOpts
+	emailOpts.KeyPrefix = "otp:email:"
+	emailOpts.Format = magicLinks.Message
+	emailOTPSvc := services.NewOTPService(redisClient, mailer, email.Addresses{}, emailOpts)
+	jwtSvc, err := newJWTService(cfg.App)
+	if err != nil {
+		fatal(logger, "failed to configure jwt", err)
+	}
+	refreshSvc := services.NewRefreshTokenService(redisClient, cfg.App.RefreshExpiresHours)
+	revocationSvc := services.NewRevocationService(redisClient, cfg.App.JWTExpiresMinutes)
 
 	// repository
-	userRepo := repositories.NewUserRepository(gormDB)
+	userRepo := repositories.NewUserRepository(gormDB, phones)
+	if err := seedAdmins(context.Background(), logger, userRepo, phones, cfg.App.AdminPhones); err != nil {
+		fatal(logger, "failed to seed admins", err)
+	}
+	mfaSvc, err := newMFAService(cfg.App, repositories.NewMFARepository(gormDB), redisClient, logger)
+	if err != nil {
+		fatal(logger, "failed to configure mfa", err)
+	}
+	webAuthnSvc, err := newWebAuthnService(cfg.App, repositories.NewWebAuthnRepository(gormDB), redisClient, logger)
+	if err != nil {
+		fatal(logger, "failed to configure webauthn", err)
+	}
+	oauthRepo := repositories.NewOAuthRepository(gormDB)
+	oidcSvc, err := newOIDCService(cfg.App, oauthRepo, userRepo, redisClient, jwtSvc, logger)
+	if err != nil {
+		fatal(logger, "failed to configure oidc", err)
+	}
+
+	sqlDB, err := gormDB.DB()
+	if err != nil {
+		fatal(logger, "failed to get sql db", err)
+	}
 
-	app := fiber.New()
+	app := fiber.New(fiber.Config{ErrorHandler: middleware.ErrorHandler})
 	app.Use(recover.New())
-	app.Use(logger.New())
+	app.Use(middleware.RequestID())
+
+	// Probes and metrics are registered ahead of the logger and global limiter so they are neither logged nor throttled
+	health := &routes.HealthHandlers{
+		DB:      sqlDB,
+		Redis:   redisClient,
+		Timeout: time.Duration(cfg.App.ReadinessTimeout) * time.Second,
+		Logger:  logger,
+	}
+	health.RegisterRoutes(app)
+	metrics.RegisterPools(sqlDB, redisClient)
+	app.Get("/metrics", metrics.Handler())
+	app.Use(metrics.Middleware())
+	app.Use(tracing.Middleware())
+
+	app.Use(middleware.RequestLogger(logger))
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "*",
 		AllowMethods:     "GET,POST,PUT,PATCH,DELETE,OPTIONS",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
-		ExposeHeaders:    "Content-Length",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, X-Request-ID",
+		ExposeHeaders:    "Content-Length, X-Request-ID, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset",
 		AllowCredentials: false,
 		MaxAge:           int((12 * time.Hour).Seconds()),
 	}))
-	app.Use(limiter.New(limiter.Config{Max: cfg.App.RateLimitPerMin}))
+	limiter := ratelimit.New(redisClient)
+	app.Use(middleware.RateLimit(limiter, middleware.RateLimitConfig{
+		Name:   "global",
+		Limit:  ratelimit.PerMinute(cfg.App.RateLimitPerMin),
+		Key:    middleware.KeyByIP,
+		Logger: logger,
+	}))
 
 	// Swagger UI
 	app.Get("/swagger/*", swagger.HandlerDefault)
 
-	// Health
-	// @Summary Health check
-	// @Tags Health
-	// @Success 200 {object} map[string]string
-	// @Router /health [get]
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"status": "ok"})
-	})
-
 	// Routes
-	auth := &routes.AuthHandlers{DB: gormDB, OTP: otpSvc, JWT: jwtSvc, Env: cfg.App.Env}
-	users := &routes.UsersHandlers{UserRepo: userRepo}
+	wellKnown := &routes.WellKnownHandlers{JWT: jwtSvc, OIDC: oidcSvc}
+	wellKnown.RegisterRoutes(app.Group("/.well-known"))
+	oauth := &routes.OAuthHandlers{
+		OIDC:          oidcSvc,
+		Clients:       oauthRepo,
+		JWT:           jwtSvc,
+		Revocations:   revocationSvc,
+		Limiter:       limiter,
+		TokenPerIPMin: cfg.App.OAuthTokenPerIPMin,
+		Logger:        logger,
+	}
+	// the protocol endpoints sit outside /api, whose protected group would claim them
+	oauth.RegisterRoutes(app.Group("/oauth"))
+
+	auth := &routes.AuthHandlers{
+		Users:             userRepo,
+		OTP:               otpSvc,
+		Phones:            phones,
+		JWT:               jwtSvc,
+		Refresh:           refreshSvc,
+		Revocations:       revocationSvc,
+		EmailOTP:          emailOTPSvc,
+		MagicLinks:        magicLinks,
+		MFA:               mfaSvc,
+		WebAuthn:          webAuthnSvc,
+		Env:               cfg.App.Env,
+		Limiter:           limiter,
+		VerifyPerIPMin:    cfg.App.OTPVerifyPerIPMin,
+		LoginPerPhoneHour: cfg.App.OTPPerPhoneHour,
+		Logger:            logger,
+	}
+	users := &routes.UsersHandlers{UserRepo: userRepo, Phones: phones, Refresh: refreshSvc, Revocations: revocationSvc, MFA: mfaSvc}
+	me := &routes.MeHandlers{UserRepo: userRepo, Refresh: refreshSvc, Revocations: revocationSvc, EmailOTP: emailOTPSvc, OTP: otpSvc, Phones: phones, Logger: logger}
+	mfa := &routes.MFAHandlers{UserRepo: userRepo, MFA: mfaSvc}
 
 	api := app.Group("/api")
-	auth.RegisterRoutes(api.Group("/auth"))
+	// unauthenticated endpoints are the ones worth hammering, they get a stricter limit
+	auth.RegisterRoutes(api.Group("/auth", middleware.RateLimit(limiter, middleware.RateLimitConfig{
+		Name:   "auth",
+		Limit:  ratelimit.PerMinute(cfg.App.AuthRateLimitPerMin),
+		Key:    middleware.KeyByIP,
+		Logger: logger,
+	})))
 	// Protected group
-	protected := api.Group("", middleware.AuthMiddleware(jwtSvc))
+	protected := api.Group("",
+		middleware.AuthMiddleware(jwtSvc, revocationSvc),
+		middleware.RateLimit(limiter, middleware.RateLimitConfig{
+			Name:   "user",
+			Limit:  ratelimit.PerMinute(cfg.App.UserRateLimitPerMin),
+			Key:    middleware.KeyByUser,
+			Logger: logger,
+		}),
+	)
+	auth.RegisterProtectedRoutes(protected.Group("/auth"))
+	me.RegisterRoutes(protected)
+	mfa.RegisterRoutes(protected)
 	users.RegisterRoutes(protected)
+	oauth.RegisterProtectedRoutes(protected.Group("/oauth"))
 
 	addr := fmt.Sprintf(":%s", cfg.App.Port)
-	log.Printf("starting server on %s", addr)
-	if err := app.Listen(addr); err != nil {
-		log.Fatalf("server stopped: %v", err)
+	listenErr := make(chan error, 1)
+	go func() {
+		logger.Info("starting server", "addr", addr)
+		listenErr <- app.Listen(addr)
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-listenErr:
+		fatal(logger, "server stopped", err)
+	case <-ctx.Done():
+		stop()
+	}
+
+	// Stop accepting connections and let in-flight requests finish before closing the pools they use
+	timeout := time.Duration(cfg.App.ShutdownTimeout) * time.Second
+	logger.Info("shutting down, waiting for in-flight requests", "timeout", timeout)
+	if err := app.ShutdownWithTimeout(timeout); err != nil {
+		logger.Error("shutdown", "error", err)
+	}
+	if err := sqlDB.Close(); err != nil {
+		logger.Error("close postgres", "error", err)
+	}
+	if err := redisClient.Close(); err != nil {
+		logger.Error("close redis", "error", err)
+	}
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		logger.Error("flush traces", "error", err)
+	}
+	logger.Info("server stopped")
+}
+
+// fatal logs the error and exits, the structured counterpart of log.Fatalf
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// newSMSSender builds the OTP delivery provider selected by SMS_PROVIDER. The
+// console provider only logs the codes, so it is refused outside development.
+func newSMSSender(cfg config.AppConfig, logger *slog.Logger) (services.Sender, error) {
+	switch cfg.SMSProvider {
+	case "", "console":
+		if cfg.Env != "development" {
+			return nil, fmt.Errorf("SMS_PROVIDER=console never reaches the phones, configure a real provider outside APP_ENV=development")
+		}
+		return services.NewConsoleSender(logger), nil
+	case "webhook":
+		if cfg.SMSWebhookURL == "" {
+			return nil, fmt.Errorf("SMS_WEBHOOK_URL is required for the webhook provider")
+		}
+		return services.NewWebhookSender(cfg.SMSWebhookURL, cfg.SMSWebhookToken, cfg.SMSWebhookTimeout), nil
+	case "file":
+		return services.NewFileSender(cfg.SMSSpoolPath), nil
+	default:
+		return nil, fmt.Errorf("unknown sms provider %q", cfg.SMSProvider)
+	}
+}
+
+// otpOptions checks the code format and secret shared by SMS and email codes
+func otpOptions(cfg config.AppConfig, logger *slog.Logger) (services.OTPOptions, error) {
+	// the verify endpoint accepts up to 16 alphanumeric characters
+	if cfg.OTPLength < 4 || cfg.OTPLength > 16 {
+		return services.OTPOptions{}, fmt.Errorf("OTP_LENGTH must be between 4 and 16, got %d", cfg.OTPLength)
+	}
+	seen := make(map[rune]bool, len(cfg.OTPAlphabet))
+	for _, r := range cfg.OTPAlphabet {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') || seen[r] {
+			return services.OTPOptions{}, fmt.Errorf("OTP_ALPHABET must consist of distinct ASCII letters and digits")
+		}
+		seen[r] = true
+	}
+	if len(seen) < 2 {
+		return services.OTPOptions{}, fmt.Errorf("OTP_ALPHABET needs at least two characters")
+	}
+	// Redis keeps a lock without expiry forever
+	if cfg.OTPMaxAttempts > 0 && cfg.OTPLockoutSeconds <= 0 {
+		return services.OTPOptions{}, fmt.Errorf("OTP_LOCKOUT_SECONDS must be positive while OTP_MAX_ATTEMPTS is set, got %d", cfg.OTPLockoutSeconds)
+	}
+	if cfg.OTPSecret == "" {
+		if cfg.Env != "development" {
+			return services.OTPOptions{}, fmt.Errorf("OTP_SECRET is required outside APP_ENV=development")
+		}
+		logger.Warn("OTP_SECRET is not set, codes won't survive a restart")
+	}
+	return services.OTPOptions{
+		Length:                  cfg.OTPLength,
+		Alphabet:                cfg.OTPAlphabet,
+		Secret:                  []byte(cfg.OTPSecret),
+		TTLSeconds:              cfg.OTPTTLSeconds,
+		RateLimitPerMin:         cfg.OTPRatePerMin,
+		RateLimitTimeoutSeconds: cfg.OTPRateLimitSeconds,
+		ResendCooldownSeconds:   cfg.OTPResendCooldown,
+		MaxAttempts:             cfg.OTPMaxAttempts,
+		LockoutSeconds:          cfg.OTPLockoutSeconds,
+		LockoutMaxSeconds:       cfg.OTPLockoutMaxSecs,
+		Logger:                  logger,
+	}, nil
+}
+
+// newMFAService requires a stable MFA_SECRET, enrolled apps stop working when it changes
+func newMFAService(cfg config.AppConfig, repo repositories.MFARepository, client *redisv9.Client, logger *slog.Logger) (*services.MFAService, error) {
+	secret := cfg.MFASecret
+	if secret == "" {
+		if cfg.Env != "development" {
+			return nil, fmt.Errorf("MFA_SECRET is required outside APP_ENV=development")
+		}
+		logger.Warn("MFA_SECRET is not set, falling back to JWT_SECRET")
+		secret = cfg.JWTSecret
+	}
+	return services.NewMFAService(repo, client, services.MFAOptions{
+		Secret:           []byte(secret),
+		Issuer:           cfg.MFAIssuer,
+		ChallengeSeconds: cfg.MFAChallengeSeconds,
+		MaxAttempts:      cfg.MFAMaxAttempts,
+		LockoutSeconds:   cfg.MFALockoutSeconds,
+	})
+}
+
+// newWebAuthnService requires the origins of the login pages outside development
+func newWebAuthnService(cfg config.AppConfig, repo repositories.WebAuthnRepository, client *redisv9.Client, logger *slog.Logger) (*services.WebAuthnService, error) {
+	origins := cfg.WebAuthnRPOrigins
+	if len(origins) == 0 {
+		if cfg.Env != "development" {
+			return nil, fmt.Errorf("WEBAUTHN_RP_ORIGINS is required outside APP_ENV=development")
+		}
+		logger.Warn("WEBAUTHN_RP_ORIGINS is not set, accepting passkeys from http://localhost:3000")
+		origins = []string{"http://localhost:3000"}
+	}
+	return services.NewWebAuthnService(repo, client, services.WebAuthnOptions{
+		RPID:           cfg.WebAuthnRPID,
+		RPName:         cfg.WebAuthnRPName,
+		RPOrigins:      origins,
+		TimeoutSeconds: cfg.WebAuthnTimeout,
+	})
+}
+
+// newOIDCService requires the issuer, the login page and JWT_SIGNING_KEYS
+// outside development: ID tokens signed with JWT_SECRET can't be verified by
+// the clients.
+func newOIDCService(cfg config.AppConfig, repo repositories.OAuthRepository, users repositories.UserRepository, client *redisv9.Client, jwtSvc *services.JWTService, logger *slog.Logger) (*services.OIDCService, error) {
+	issuer, loginURL := cfg.OIDCIssuer, cfg.OIDCLoginURL
+	if issuer == "" || loginURL == "" {
+		if cfg.Env != "development" {
+			return nil, fmt.Errorf("OIDC_ISSUER and OIDC_LOGIN_URL are required outside APP_ENV=development")
+		}
+		if issuer == "" {
+			issuer = "http://localhost:" + cfg.Port
+			logger.Warn("OIDC_ISSUER is not set, using the local address", "issuer", issuer)
+		}
+		if loginURL == "" {
+			loginURL = "http://localhost:3000/oauth/login"
+			logger.Warn("OIDC_LOGIN_URL is not set, using the local frontend", "login_url", loginURL)
+		}
+	}
+	if len(cfg.JWTSigningKeys) == 0 {
+		if cfg.Env != "development" {
+			return nil, fmt.Errorf("JWT_SIGNING_KEYS is required outside APP_ENV=development, OpenID Connect clients can't verify ID tokens signed with JWT_SECRET")
+		}
+		logger.Warn("ID tokens are signed with JWT_SECRET, which OpenID Connect clients can't verify; set JWT_SIGNING_KEYS")
+	}
+	return services.NewOIDCService(repo, users, client, jwtSvc, services.OIDCOptions{
+		Issuer:         issuer,
+		LoginURL:       loginURL,
+		RequestSeconds: cfg.OIDCRequestSeconds,
+		CodeSeconds:    cfg.OIDCCodeSeconds,
+	})
+}
+
+// newMailer builds the email delivery provider selected by EMAIL_PROVIDER,
+// refusing the console provider outside development like newSMSSender
+func newMailer(cfg config.AppConfig, logger *slog.Logger) (services.Sender, error) {
+	switch cfg.EmailProvider {
+	case "", "console":
+		if cfg.Env != "development" {
+			return nil, fmt.Errorf("EMAIL_PROVIDER=console never reaches the inboxes, configure smtp outside APP_ENV=development")
+		}
+		return services.NewConsoleMailer(logger), nil
+	case "smtp":
+		return services.NewSMTPSender(services.SMTPOptions{
+			Addr:     cfg.SMTPAddr,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.SMTPFrom,
+			Subject:  "Your Zeus verification code",
+			StartTLS: cfg.SMTPStartTLS,
+			Timeout:  time.Duration(cfg.SMTPTimeout) * time.Second,
+		}), nil
+	case "file":
+		return services.NewFileSender(cfg.EmailSpoolPath), nil
+	default:
+		return nil, fmt.Errorf("unknown email provider %q", cfg.EmailProvider)
+	}
+}
+
+// newJWTService signs with the configured PEM keys, or with JWT_SECRET when none are set
+func newJWTService(cfg config.AppConfig) (*services.JWTService, error) {
+	if len(cfg.JWTSigningKeys) == 0 {
+		return services.NewJWTService(cfg.JWTSecret, cfg.JWTExpiresMinutes), nil
+	}
+	keys := make([]*services.SigningKey, 0, len(cfg.JWTSigningKeys))
+	for _, k := range cfg.JWTSigningKeys {
+		key, err := services.LoadSigningKey(k.ID, k.Path, k.ActivatesAt)
+		if err != nil {
+			return nil, fmt.Errorf("load signing key %s: %w", k.ID, err)
+		}
+		keys = append(keys, key)
+	}
+	return services.NewKeyedJWTService(keys, cfg.JWTKeyOverlapMins, cfg.JWTExpiresMinutes)
+}
+
+// seedAdmins makes sure every phone in ADMIN_PHONES has a user with the admin role
+func seedAdmins(ctx context.Context, logger *slog.Logger, userRepo repositories.UserRepository, phones *phone.Parser, adminPhones []string) error {
+	for _, raw := range adminPhones {
+		p, err := phones.Normalize(raw)
+		if err != nil {
+			return fmt.Errorf("admin phone %q: %w", raw, err)
+		}
+		u, err := userRepo.GetByPhone(ctx, p)
+		if errors.Is(err, repositories.ErrUserNotFound) {
+			u = &models.User{Phone: p}
+			err = userRepo.Create(ctx, u)
+		}
+		if err != nil {
+			return err
+		}
+		if err := userRepo.AddRole(ctx, u.ID.String(), rbac.RoleAdmin); err != nil {
+			return err
+		}
+		logger.Info("granted role", "role", rbac.RoleAdmin, "user_id", u.ID)
 	}
+	return nil
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"gorm.io/gorm"
+
+	"github.com/rznas/zeus/internal/config"
+	"github.com/rznas/zeus/internal/db"
+	"github.com/rznas/zeus/internal/migrations"
+	"github.com/rznas/zeus/internal/models"
+)
+
+const migrateUsage = `usage: zeus migrate <command>
+
+commands:
+  up             apply all pending migrations
+  down [steps]   revert the last applied migration, or the last steps ones
+  status         list migrations and whether they are applied
+  create <name>  add an empty migration to ` + migrations.SourceDir
+
+// runMigrate implements the "zeus migrate" subcommand and returns the process exit code
+func runMigrate(cfg *config.Config, logger *slog.Logger, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	if args[0] == "create" {
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, migrateUsage)
+			return 2
+		}
+		up, down, err := migrations.Create(migrations.SourceDir, args[1])
+		if err != nil {
+			logger.Error("create migration", "error", err)
+			return 1
+		}
+		fmt.Printf("created %s\ncreated %s\n", up, down)
+		return 0
+	}
+
+	gormDB, err := connectPostgres(cfg.Postgres, logger)
+	if err != nil {
+		logger.Error("failed to connect postgres", "error", err)
+		return 1
+	}
+	sqlDB, err := gormDB.DB()
+	if err != nil {
+		logger.Error("failed to get sql db", "error", err)
+		return 1
+	}
+	defer sqlDB.Close()
+
+	migrator, err := migrations.New(sqlDB)
+	if err != nil {
+		logger.Error("failed to load migrations", "error", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			logger.Error("migrate up", "error", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				fmt.Fprintln(os.Stderr, migrateUsage)
+				return 2
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			logger.Error("migrate down", "error", err)
+			return 1
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			logger.Error("migrate status", "error", err)
+			return 1
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.UTC().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
+
+// prepareSchema makes sure the schema matches the code before serving. Outside
+// development it only checks for pending migrations, which are applied with
+// "zeus migrate up" as a separate deploy step.
+func prepareSchema(ctx context.Context, gormDB *gorm.DB, cfg *config.Config, logger *slog.Logger) error {
+	if cfg.Postgres.AutoMigrate {
+		if cfg.App.Env != "development" {
+			return fmt.Errorf("DB_AUTO_MIGRATE is only allowed with APP_ENV=development")
+		}
+		logger.Warn("DB_AUTO_MIGRATE is set, syncing schema from models")
+		return gormDB.AutoMigrate(&models.User{}, &models.UserRole{}, &models.UserTOTP{}, &models.RecoveryCode{}, &models.WebAuthnCredential{}, &models.OAuthClient{}, &models.OAuthConsent{})
+	}
+
+	sqlDB, err := gormDB.DB()
+	if err != nil {
+		return err
+	}
+	migrator, err := migrations.New(sqlDB)
+	if err != nil {
+		return err
+	}
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d pending migrations, run \"zeus migrate up\" first", len(pending))
+	}
+	return nil
+}
+
+func connectPostgres(cfg config.PostgresConfig, logger *slog.Logger) (*gorm.DB, error) {
+	return db.NewPostgres(db.PostgresOptions{
+		Host:     cfg.Host,
+		Port:     cfg.Port,
+		DB:       cfg.DB,
+		User:     cfg.User,
+		Password: cfg.Password,
+		Logger:   logger,
+	})
+}
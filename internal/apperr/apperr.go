@@ -0,0 +1,184 @@
+// Package apperr defines the typed errors returned by services, repositories
+// and handlers. Every error has a kind, which decides the HTTP status, and a
+// stable machine-readable code clients can switch on; the message is meant for
+// humans and may change. Causes wrapped into an error are logged but never
+// shown to clients.
+package apperr
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Kind classifies an error
+type Kind int
+
+const (
+	KindInternal Kind = iota
+	KindValidation
+	KindUnauthorized
+	KindForbidden
+	KindNotFound
+	KindConflict
+	KindLocked
+	KindRateLimited
+	KindUpstream
+)
+
+// Status returns the HTTP status errors of the kind are reported with
+func (k Kind) Status() int {
+	switch k {
+	case KindValidation:
+		return http.StatusBadRequest
+	case KindUnauthorized:
+		return http.StatusUnauthorized
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindConflict:
+		return http.StatusConflict
+	case KindLocked:
+		return http.StatusLocked
+	case KindRateLimited:
+		return http.StatusTooManyRequests
+	case KindUpstream:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// CodeInternal is the code of every error that is not an *Error
+const CodeInternal = "internal_error"
+
+// Error is an error that can be shown to clients
+type Error struct {
+	Kind    Kind
+	Code    string
+	Message string
+	// Fields maps request fields to what is wrong with them
+	Fields map[string]string
+	// RetryAfter tells clients when to try again, zero if unknown
+	RetryAfter time.Duration
+	// Extensions are extra members of the problem details, e.g. attempts left
+	Extensions map[string]any
+	// Err is the underlying cause
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches errors with the same code, so copies made by the With methods
+// still match the sentinel they were made from
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Wrap returns a copy of e caused by err
+func (e *Error) Wrap(err error) *Error {
+	c := *e
+	c.Err = err
+	return &c
+}
+
+// WithFields returns a copy of e with per-field messages
+func (e *Error) WithFields(fields map[string]string) *Error {
+	c := *e
+	c.Fields = fields
+	return &c
+}
+
+// WithRetryAfter returns a copy of e telling clients to retry after d
+func (e *Error) WithRetryAfter(d time.Duration) *Error {
+	c := *e
+	c.RetryAfter = d
+	return &c
+}
+
+// WithExtensions returns a copy of e with extra problem details members
+func (e *Error) WithExtensions(ext map[string]any) *Error {
+	c := *e
+	c.Extensions = ext
+	return &c
+}
+
+// New returns an error of the given kind
+func New(kind Kind, code, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+// Invalid reports a malformed request
+func Invalid(code, message string) *Error {
+	return New(KindValidation, code, message)
+}
+
+// Validation reports invalid request fields, fields maps each field to what is wrong with it
+func Validation(fields map[string]string) *Error {
+	return &Error{Kind: KindValidation, Code: "validation_failed", Message: "validation failed", Fields: fields}
+}
+
+func Unauthorized(code, message string) *Error {
+	return New(KindUnauthorized, code, message)
+}
+
+func Forbidden(code, message string) *Error {
+	return New(KindForbidden, code, message)
+}
+
+func NotFound(code, message string) *Error {
+	return New(KindNotFound, code, message)
+}
+
+func Conflict(code, message string) *Error {
+	return New(KindConflict, code, message)
+}
+
+func Locked(code, message string) *Error {
+	return New(KindLocked, code, message)
+}
+
+func RateLimited(code, message string) *Error {
+	return New(KindRateLimited, code, message)
+}
+
+// Upstream reports a failure of a service we depend on, such as an SMS provider
+func Upstream(code, message string) *Error {
+	return New(KindUpstream, code, message)
+}
+
+// KindOf returns the kind of the first *Error in err's chain, KindInternal if there is none
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindInternal
+}
+
+// Status returns the HTTP status err is reported with. It also understands the
+// *fiber.Error values returned by Fiber itself, e.g. for unmatched routes.
+func Status(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind.Status()
+	}
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		return fe.Code
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,80 @@
+package apperr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestErrorIsMatchesCopies(t *testing.T) {
+	sentinel := Locked("otp_locked", "locked")
+	err := fmt.Errorf("verify: %w", sentinel.WithRetryAfter(time.Minute))
+	if !errors.Is(err, sentinel) {
+		t.Fatalf("expected copy to match its sentinel")
+	}
+	if errors.Is(err, Locked("other", "locked")) {
+		t.Fatalf("expected errors with different codes not to match")
+	}
+
+	cause := errors.New("connection refused")
+	wrapped := Upstream("delivery_failed", "failed").Wrap(cause)
+	if !errors.Is(wrapped, cause) {
+		t.Fatalf("expected the cause to stay reachable")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{NotFound("user_not_found", "user not found"), http.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", Conflict("phone_in_use", "taken")), http.StatusConflict},
+		{Validation(map[string]string{"phone": "required"}), http.StatusBadRequest},
+		{fiber.ErrMethodNotAllowed, http.StatusMethodNotAllowed},
+		{errors.New("db down"), http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		if got := Status(tc.err); got != tc.want {
+			t.Errorf("%v: expected %d, got %d", tc.err, tc.want, got)
+		}
+	}
+}
+
+func TestProblemFor(t *testing.T) {
+	p := ProblemFor(RateLimited("rate_limited", "slow down").WithRetryAfter(1500 * time.Millisecond))
+	if p.Status != http.StatusTooManyRequests || p.Code != "rate_limited" || p.Detail != "slow down" || p.RetryAfter != 2 {
+		t.Fatalf("unexpected problem %+v", p)
+	}
+	if p.Type != "about:blank" || p.Title != "Too Many Requests" {
+		t.Fatalf("unexpected type or title %+v", p)
+	}
+
+	p = ProblemFor(Unauthorized("otp_invalid", "invalid code").WithExtensions(map[string]any{"attempts_remaining": 2, "code": "overridden"}))
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(b, &body); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if body["attempts_remaining"] != float64(2) || body["code"] != "otp_invalid" || body["status"] != float64(401) {
+		t.Fatalf("expected extensions beside the standard members, got %s", b)
+	}
+
+	p = ProblemFor(fiber.ErrMethodNotAllowed)
+	if p.Code != "method_not_allowed" {
+		t.Fatalf("expected code derived from status, got %q", p.Code)
+	}
+
+	p = ProblemFor(fmt.Errorf("select users: %w", errors.New("password authentication failed")))
+	if p.Status != http.StatusInternalServerError || p.Code != CodeInternal || p.Detail != "internal server error" {
+		t.Fatalf("expected internal details to be hidden, got %+v", p)
+	}
+}
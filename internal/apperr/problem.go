@@ -0,0 +1,95 @@
+package apperr
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ContentType is the media type of problem responses
+const ContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details body. Code, Fields, RetryAfter and
+// RequestID are extension members, Extensions adds more at the top level.
+type Problem struct {
+	Type       string            `json:"type"`
+	Title      string            `json:"title"`
+	Status     int               `json:"status"`
+	Detail     string            `json:"detail,omitempty"`
+	Instance   string            `json:"instance,omitempty"`
+	Code       string            `json:"code"`
+	Fields     map[string]string `json:"fields,omitempty"`
+	RetryAfter int               `json:"retry_after,omitempty"` // seconds
+	RequestID  string            `json:"request_id,omitempty"`
+	Extensions map[string]any    `json:"-"`
+}
+
+// MarshalJSON writes Extensions next to the other members. They can't
+// replace a standard member, those win on conflicts.
+func (p Problem) MarshalJSON() ([]byte, error) {
+	type problem Problem
+	b, err := json.Marshal(problem(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return b, err
+	}
+	members := make(map[string]json.RawMessage, len(p.Extensions))
+	for k, v := range p.Extensions {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		members[k] = raw
+	}
+	var fixed map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fixed); err != nil {
+		return nil, err
+	}
+	maps.Copy(members, fixed)
+	return json.Marshal(members)
+}
+
+// ProblemFor describes err to a client. Errors that are neither *Error nor
+// *fiber.Error are reported as a bare internal error, their text may leak
+// implementation details.
+func ProblemFor(err error) Problem {
+	var e *Error
+	if errors.As(err, &e) {
+		p := newProblem(e.Kind.Status(), e.Code, e.Message)
+		p.Fields = e.Fields
+		p.Extensions = e.Extensions
+		if e.RetryAfter > 0 {
+			p.RetryAfter = int(math.Ceil(e.RetryAfter.Seconds()))
+		}
+		return p
+	}
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		return newProblem(fe.Code, statusCode(fe.Code), fe.Message)
+	}
+	return newProblem(http.StatusInternalServerError, CodeInternal, "internal server error")
+}
+
+func newProblem(status int, code, detail string) Problem {
+	return Problem{
+		// the code identifies the problem, so no type URI is needed
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// statusCode derives a code from the status text, e.g. method_not_allowed
+func statusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return CodeInternal
+	}
+	return strings.ReplaceAll(strings.ToLower(strings.ReplaceAll(text, "-", " ")), " ", "_")
+}
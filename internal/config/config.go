@@ -4,6 +4,8 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,19 +16,75 @@ type AppConfig struct {
 	Env                 string
 	JWTSecret           string
 	JWTExpiresMinutes   int
-	RateLimitPerMin     int
+	JWTSigningKeys      []JWTKeyConfig // empty means HS256 with JWTSecret
+	JWTKeyOverlapMins   int            // how long a retired key keeps verifying tokens
+	RefreshExpiresHours int
+	RateLimitPerMin     int // requests per IP per minute across the API
+	AuthRateLimitPerMin int // requests per IP per minute to /api/auth/*
+	UserRateLimitPerMin int // requests per user per minute to authenticated routes
 	OTPRatePerMin       int
+	OTPLength           int    // characters per code
+	OTPAlphabet         string // characters codes are drawn from
+	OTPSecret           string // HMAC key for stored codes, required outside development
 	OTPTTLSeconds       int
-	OTPRateLimitSeconds int // New field for rate limiting timeout
+	OTPRateLimitSeconds int      // New field for rate limiting timeout
+	OTPResendCooldown   int      // seconds between two codes for the same phone
+	OTPMaxAttempts      int      // wrong codes before the phone is locked
+	OTPLockoutSeconds   int      // first lockout, doubles on every consecutive lockout
+	OTPLockoutMaxSecs   int      // upper bound for the escalating lockout
+	OTPVerifyPerIPMin   int      // verification attempts per IP per minute
+	OTPPerPhoneHour     int      // code requests per phone per hour
+	PhoneDefaultRegion  string   // ISO 3166-1 region for numbers without a country code
+	AdminPhones         []string // users granted the admin role at startup
+	SMSProvider         string   // console, webhook or file
+	SMSWebhookURL       string
+	SMSWebhookToken     string
+	SMSWebhookTimeout   int // seconds
+	SMSSpoolPath        string
+	EmailProvider       string // console, smtp or file
+	EmailSpoolPath      string
+	SMTPAddr            string // host:port
+	SMTPUsername        string
+	SMTPPassword        string
+	SMTPFrom            string
+	SMTPStartTLS        bool
+	SMTPTimeout         int    // seconds
+	MagicLinkURL        string // page that posts magic link tokens to /api/auth/email/verify
+	MFASecret           string // encrypts TOTP secrets, required outside development
+	MFAIssuer           string // account issuer shown in authenticator apps
+	MFAChallengeSeconds int    // time to enter the second factor after the first
+	MFAMaxAttempts      int    // wrong second factor codes before it is locked
+	MFALockoutSeconds   int
+	WebAuthnRPID        string   // domain passkeys are bound to, changing it invalidates them
+	WebAuthnRPName      string   // site name shown while creating a passkey
+	WebAuthnRPOrigins   []string // origins of the pages running the passkey ceremonies
+	WebAuthnTimeout     int      // seconds to finish a passkey ceremony
+	OIDCIssuer          string   // public base URL of Zeus, the iss of ID tokens
+	OIDCLoginURL        string   // page signing users in for OpenID Connect clients
+	OIDCRequestSeconds  int      // time the login page has to answer an authorization request
+	OIDCCodeSeconds     int      // time to exchange an authorization code
+	OAuthTokenPerIPMin  int      // token endpoint requests per IP per minute
+	LogLevel            string   // debug, info, warn or error
+	LogFormat           string   // json or text
+	ShutdownTimeout     int      // seconds to wait for in-flight requests on SIGTERM
+	ReadinessTimeout    int      // seconds each /readyz dependency ping may take
+}
+
+// JWTKeyConfig points at a PEM encoded private key used to sign tokens
+type JWTKeyConfig struct {
+	ID          string
+	Path        string
+	ActivatesAt time.Time
 }
 
 // PostgresConfig holds Postgres settings
 type PostgresConfig struct {
-	Host     string
-	Port     string
-	DB       string
-	User     string
-	Password string
+	Host        string
+	Port        string
+	DB          string
+	User        string
+	Password    string
+	AutoMigrate bool // development only: sync the schema from the models instead of running migrations
 }
 
 // RedisConfig holds Redis settings
@@ -36,11 +94,20 @@ type RedisConfig struct {
 	DB       int
 }
 
+// TracingConfig holds OpenTelemetry settings
+type TracingConfig struct {
+	Endpoint    string  // OTLP/HTTP collector host:port, empty disables export
+	Insecure    bool    // plain HTTP to the collector
+	ServiceName string  // service.name reported with every span
+	SampleRatio float64 // fraction of new traces sampled
+}
+
 // Config is the root configuration object
 type Config struct {
 	App      AppConfig
 	Postgres PostgresConfig
 	Redis    RedisConfig
+	Tracing  TracingConfig
 }
 
 func getenv(key, def string) string {
@@ -63,6 +130,55 @@ func getenvInt(key string, def int) int {
 	return i
 }
 
+func getenvFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+func getenvList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// parseJWTKeys parses a comma separated list of kid=path[@activates_at] entries,
+// where activates_at is an RFC 3339 timestamp. Keys without one are active immediately.
+func parseJWTKeys(v string) []JWTKeyConfig {
+	var keys []JWTKeyConfig
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, rest, ok := strings.Cut(entry, "=")
+		if !ok || id == "" || rest == "" {
+			log.Fatalf("invalid JWT_SIGNING_KEYS entry %q, expected kid=path[@activates_at]", entry)
+		}
+		key := JWTKeyConfig{ID: id, Path: rest}
+		if path, at, ok := strings.Cut(rest, "@"); ok {
+			t, err := time.Parse(time.RFC3339, at)
+			if err != nil {
+				log.Fatalf("invalid activation time in JWT_SIGNING_KEYS entry %q: %v", entry, err)
+			}
+			key.Path = path
+			key.ActivatesAt = t
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 // Load loads configuration from environment variables and optional .env file
 func Load() *Config {
 	// Try .env first, then sample.env as fallback
@@ -82,25 +198,80 @@ func Load() *Config {
 			Env:                 getenv("APP_ENV", "development"),
 			JWTSecret:           getenv("JWT_SECRET", "supersecretjwt"),
 			JWTExpiresMinutes:   getenvInt("JWT_EXPIRES_MINUTES", 60),
+			JWTSigningKeys:      parseJWTKeys(getenv("JWT_SIGNING_KEYS", "")),
+			JWTKeyOverlapMins:   getenvInt("JWT_KEY_OVERLAP_MINUTES", 1440),
+			RefreshExpiresHours: getenvInt("REFRESH_TOKEN_EXPIRES_HOURS", 720),
 			RateLimitPerMin:     getenvInt("RATE_LIMIT_PER_MINUTE", 60),
+			AuthRateLimitPerMin: getenvInt("AUTH_RATE_LIMIT_PER_MINUTE", 30),
+			UserRateLimitPerMin: getenvInt("USER_RATE_LIMIT_PER_MINUTE", 120),
 			OTPRatePerMin:       getenvInt("OTP_RATE_LIMIT_PER_MINUTE", 3),
+			OTPLength:           getenvInt("OTP_LENGTH", 6),
+			OTPAlphabet:         getenv("OTP_ALPHABET", "0123456789"),
+			OTPSecret:           getenv("OTP_SECRET", ""),
 			OTPTTLSeconds:       getenvInt("OTP_TTL_SECONDS", 300),
 			OTPRateLimitSeconds: getenvInt("OTP_RATE_LIMIT_TIMEOUT_SECONDS", 60), // New config
+			OTPResendCooldown:   getenvInt("OTP_RESEND_COOLDOWN_SECONDS", 30),
+			OTPMaxAttempts:      getenvInt("OTP_MAX_ATTEMPTS", 5),
+			OTPLockoutSeconds:   getenvInt("OTP_LOCKOUT_SECONDS", 300),
+			OTPLockoutMaxSecs:   getenvInt("OTP_LOCKOUT_MAX_SECONDS", 86400),
+			OTPVerifyPerIPMin:   getenvInt("OTP_VERIFY_RATE_LIMIT_PER_MINUTE", 20),
+			OTPPerPhoneHour:     getenvInt("OTP_RATE_LIMIT_PER_HOUR", 10),
+			PhoneDefaultRegion:  getenv("PHONE_DEFAULT_REGION", "US"),
+			AdminPhones:         getenvList("ADMIN_PHONES"),
+			SMSProvider:         getenv("SMS_PROVIDER", "console"),
+			SMSWebhookURL:       getenv("SMS_WEBHOOK_URL", ""),
+			SMSWebhookToken:     getenv("SMS_WEBHOOK_TOKEN", ""),
+			SMSWebhookTimeout:   getenvInt("SMS_WEBHOOK_TIMEOUT_SECONDS", 5),
+			SMSSpoolPath:        getenv("SMS_SPOOL_PATH", "tmp/sms.jsonl"),
+			EmailProvider:       getenv("EMAIL_PROVIDER", "console"),
+			EmailSpoolPath:      getenv("EMAIL_SPOOL_PATH", "tmp/email.jsonl"),
+			SMTPAddr:            getenv("SMTP_ADDR", "localhost:1025"),
+			SMTPUsername:        getenv("SMTP_USERNAME", ""),
+			SMTPPassword:        getenv("SMTP_PASSWORD", ""),
+			SMTPFrom:            getenv("SMTP_FROM", "Zeus <no-reply@localhost>"),
+			SMTPStartTLS:        getenv("SMTP_STARTTLS", "false") == "true",
+			SMTPTimeout:         getenvInt("SMTP_TIMEOUT_SECONDS", 10),
+			MagicLinkURL:        getenv("MAGIC_LINK_URL", "http://localhost:3000/login/email"),
+			MFASecret:           getenv("MFA_SECRET", ""),
+			MFAIssuer:           getenv("MFA_ISSUER", "Zeus"),
+			MFAChallengeSeconds: getenvInt("MFA_CHALLENGE_SECONDS", 300),
+			MFAMaxAttempts:      getenvInt("MFA_MAX_ATTEMPTS", 5),
+			MFALockoutSeconds:   getenvInt("MFA_LOCKOUT_SECONDS", 300),
+			WebAuthnRPID:        getenv("WEBAUTHN_RP_ID", "localhost"),
+			WebAuthnRPName:      getenv("WEBAUTHN_RP_NAME", "Zeus"),
+			WebAuthnRPOrigins:   getenvList("WEBAUTHN_RP_ORIGINS"),
+			WebAuthnTimeout:     getenvInt("WEBAUTHN_TIMEOUT_SECONDS", 300),
+			OIDCIssuer:          getenv("OIDC_ISSUER", ""),
+			OIDCLoginURL:        getenv("OIDC_LOGIN_URL", ""),
+			OIDCRequestSeconds:  getenvInt("OIDC_REQUEST_SECONDS", 600),
+			OIDCCodeSeconds:     getenvInt("OIDC_CODE_SECONDS", 60),
+			OAuthTokenPerIPMin:  getenvInt("OAUTH_TOKEN_RATE_LIMIT_PER_MINUTE", 30),
+			LogLevel:            getenv("LOG_LEVEL", "info"),
+			LogFormat:           getenv("LOG_FORMAT", "json"),
+			ShutdownTimeout:     getenvInt("SHUTDOWN_TIMEOUT_SECONDS", 15),
+			ReadinessTimeout:    getenvInt("READINESS_TIMEOUT_SECONDS", 2),
 		},
 		Postgres: PostgresConfig{
-			Host:     getenv("POSTGRES_HOST", "localhost"),
-			Port:     getenv("POSTGRES_PORT", "5432"),
-			DB:       getenv("POSTGRES_DB", "zeus"),
-			User:     getenv("POSTGRES_USER", "zeus"),
-			Password: getenv("POSTGRES_PASSWORD", "zeus"),
+			Host:        getenv("POSTGRES_HOST", "localhost"),
+			Port:        getenv("POSTGRES_PORT", "5432"),
+			DB:          getenv("POSTGRES_DB", "zeus"),
+			User:        getenv("POSTGRES_USER", "zeus"),
+			Password:    getenv("POSTGRES_PASSWORD", "zeus"),
+			AutoMigrate: getenv("DB_AUTO_MIGRATE", "false") == "true",
 		},
 		Redis: RedisConfig{
 			Addr:     getenv("REDIS_ADDR", "localhost:6379"),
 			Password: getenv("REDIS_PASSWORD", ""),
 			DB:       getenvInt("REDIS_DB", 0),
 		},
+		Tracing: TracingConfig{
+			Endpoint:    getenv("TRACING_OTLP_ENDPOINT", ""),
+			Insecure:    getenv("TRACING_OTLP_INSECURE", "false") == "true",
+			ServiceName: getenv("TRACING_SERVICE_NAME", "zeus"),
+			SampleRatio: getenvFloat("TRACING_SAMPLE_RATIO", 1),
+		},
 	}
 
-	log.Printf("config loaded: env=%s port=%s psql=%s:%s/%s redis=%s", cfg.App.Env, cfg.App.Port, cfg.Postgres.Host, cfg.Postgres.Port, cfg.Postgres.DB, cfg.Redis.Addr)
+	log.Printf("config loaded: env=%s port=%s psql=%s:%s/%s redis=%s sms=%s email=%s", cfg.App.Env, cfg.App.Port, cfg.Postgres.Host, cfg.Postgres.Port, cfg.Postgres.DB, cfg.Redis.Addr, cfg.App.SMSProvider, cfg.App.EmailProvider)
 	return cfg
 }
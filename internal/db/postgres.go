@@ -2,9 +2,12 @@ package db
 
 import (
 	"fmt"
+	"log/slog"
+	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
 )
 
 type PostgresOptions struct {
@@ -13,9 +16,29 @@ type PostgresOptions struct {
 	DB       string
 	User     string
 	Password string
+	Logger   *slog.Logger // slow queries and errors, nil keeps the GORM default
 }
 
 func NewPostgres(opts PostgresOptions) (*gorm.DB, error) {
 	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=UTC", opts.Host, opts.User, opts.Password, opts.DB, opts.Port)
-	return gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	cfg := &gorm.Config{}
+	if opts.Logger != nil {
+		cfg.Logger = gormlogger.New(slogWriter{opts.Logger}, gormlogger.Config{
+			SlowThreshold:             200 * time.Millisecond,
+			IgnoreRecordNotFoundError: true,
+			// keep bind values, which include phone numbers, out of the logs
+			ParameterizedQueries: true,
+			LogLevel:             gormlogger.Warn,
+		})
+	}
+	return gorm.Open(postgres.Open(dsn), cfg)
+}
+
+// slogWriter adapts slog to the Printf writer expected by the GORM logger
+type slogWriter struct {
+	logger *slog.Logger
+}
+
+func (w slogWriter) Printf(format string, args ...any) {
+	w.logger.Warn(fmt.Sprintf(format, args...), "component", "gorm")
 }
@@ -0,0 +1,20 @@
+// Package email canonicalizes email addresses used as login identifiers.
+package email
+
+import "strings"
+
+// Canonical trims and lower-cases raw so every spelling of an address maps to
+// the same user and Redis keys. It doesn't validate, the "email" validation
+// tag does. Local parts are case-sensitive in theory only; no mail provider
+// worth supporting treats them that way.
+func Canonical(raw string) string {
+	return strings.ToLower(strings.TrimSpace(raw))
+}
+
+// Addresses canonicalizes addresses where a phone.Parser canonicalizes
+// numbers, e.g. for an OTPService sending codes by email
+type Addresses struct{}
+
+func (Addresses) Canonical(raw string) string {
+	return Canonical(raw)
+}
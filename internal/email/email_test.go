@@ -0,0 +1,16 @@
+package email
+
+import "testing"
+
+func TestCanonical(t *testing.T) {
+	cases := map[string]string{
+		"Ada@Example.com":    "ada@example.com",
+		"  ada@example.com ": "ada@example.com",
+		"ada@example.com":    "ada@example.com",
+	}
+	for in, want := range cases {
+		if got := (Addresses{}).Canonical(in); got != want {
+			t.Errorf("Canonical(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Package logging builds the structured slog logger used across the service.
+// Every record goes through a redacting handler that masks phone numbers,
+// OTP codes and tokens, so call sites don't have to remember to.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDKey is the fiber Locals key holding the request id
+const RequestIDKey = "request_id"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the request id, which the
+// logger adds to every record logged with it
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// New returns a logger writing to w. format is json or text, level is one of
+// debug, info, warn or error. codeLength is the length of the OTP codes to
+// mask, zero means 6.
+func New(w io.Writer, format, level string, codeLength int) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	return slog.New(&handler{next: h, redact: newRedactor(codeLength)}), nil
+}
+
+// handler redacts records and adds the request and trace ids before passing them on
+type handler struct {
+	next   slog.Handler
+	redact *redactor
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, h.redact.scrub(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.redact.attr(a))
+		return true
+	})
+	if ctx != nil {
+		if id, ok := ctx.Value(requestIDKey{}).(string); ok && id != "" {
+			out.AddAttrs(slog.String(RequestIDKey, id))
+		}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			out.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+		}
+	}
+	return h.next.Handle(ctx, out)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redact.attr(a)
+	}
+	return &handler{next: h.next.WithAttrs(redacted), redact: h.redact}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{next: h.next.WithGroup(name), redact: h.redact}
+}
@@ -0,0 +1,110 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	cases := map[string]string{
+		"SMS to +14155552671":                       "SMS to +14*******71",
+		"Your Zeus verification code is 123456":     "Your Zeus verification code is ******",
+		"otp=004211 rejected":                       "otp=****** rejected",
+		"Authorization: Bearer abc.def":             "Authorization: Bearer [REDACTED]",
+		"token eyJhbGciOi.eyJ1aWQiOi.sig_-":         "token [REDACTED]",
+		"user 0b5c3f7e-4f3a-4c8e-9d1f-2a6b7c8d9e0f": "user 0b5c3f7e-4f3a-4c8e-9d1f-2a6b7c8d9e0f",
+		"listening on :8080":                        "listening on :8080",
+		"Your Zeus code is K7QX2M":                  "Your Zeus code is ******",
+		"Your Zeus code is ABCDEF":                  "Your Zeus code is ******",
+		"code: qwerty":                              "code: ******",
+		"code expired, request a new one":           "code expired, request a new one",
+		"mail to ada.lovelace@example.com failed":   "mail to a***********@example.com failed",
+	}
+	for in, want := range cases {
+		if got := Scrub(in); got != want {
+			t.Errorf("Scrub(%q) = %q, want %q", in, got, want)
+		}
+	}
+	refresh := "tEsT0kEn_-" + strings.Repeat("x", 33)
+	if got := Scrub("refresh " + refresh); strings.Contains(got, refresh) {
+		t.Errorf("expected refresh token to be masked, got %q", got)
+	}
+}
+
+func TestLoggerRedactsAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "debug", 0)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+
+	logger.With("phone", "+14155552671").Info("otp sent",
+		"to", "ada@example.com",
+		"code", "123456",
+		"refresh_token", "secret-value",
+		"error", errors.New("verify for +14155552671 failed"),
+		"user_id", "42",
+	)
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("decode %q: %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"phone":         "+14*******71",
+		"to":            "a**@example.com",
+		"code":          "[REDACTED]",
+		"refresh_token": "[REDACTED]",
+		"error":         "verify for +14*******71 failed",
+		"user_id":       "42",
+	}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Errorf("%s = %v, want %v", k, rec[k], v)
+		}
+	}
+	if strings.Contains(buf.String(), "5552671") || strings.Contains(buf.String(), "123456") {
+		t.Fatalf("log line leaks data: %s", buf.String())
+	}
+}
+
+func TestLoggerMasksCodesOfConfiguredLength(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "text", "info", 8)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+
+	logger.Info("sending", "message", "Your Zeus code is QWERTYUI")
+	logger.Info("code expired")
+	if strings.Contains(buf.String(), "QWERTYUI") || !strings.Contains(buf.String(), "code is ******") {
+		t.Fatalf("expected the letters-only code to be masked, got %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), "code expired") {
+		t.Fatalf("expected words of another length to stay, got %q", buf.String())
+	}
+}
+
+func TestLoggerAddsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "text", "info", 0)
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	logger.InfoContext(ctx, "hello")
+	if !strings.Contains(buf.String(), "request_id=req-1") {
+		t.Fatalf("expected request id, got %q", buf.String())
+	}
+}
+
+func TestNewRejectsInvalidSettings(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", "info", 0); err == nil {
+		t.Error("expected invalid format to fail")
+	}
+	if _, err := New(&bytes.Buffer{}, "json", "loud", 0); err == nil {
+		t.Error("expected invalid level to fail")
+	}
+}
@@ -0,0 +1,141 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// secretKeys are attributes whose values are dropped entirely
+var secretKeys = map[string]bool{
+	"code":          true,
+	"otp":           true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"mfa_token":     true,
+	"authorization": true,
+	"password":      true,
+	"secret":        true,
+	"jwt":           true,
+}
+
+// contactKeys are attributes holding a phone number or email address, which
+// are masked but stay recognisable
+var contactKeys = map[string]bool{
+	"phone": true,
+	"to":    true,
+	"email": true,
+}
+
+var (
+	jwtRe    = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	bearerRe = regexp.MustCompile(`(?i)\bbearer\s+\S+`)
+	// refresh tokens are 43 base64url characters; uuids (36) are left alone
+	longTokenRe = regexp.MustCompile(`[A-Za-z0-9_-]{40,}`)
+	phoneRe     = regexp.MustCompile(`\+\d[\d ().-]{6,18}\d`)
+	emailRe     = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+)
+
+// defaultCodeLength is the OTP length Scrub assumes
+const defaultCodeLength = 6
+
+// redactor masks the OTP codes of one length along with everything else
+type redactor struct {
+	codeRe *regexp.Regexp
+}
+
+var defaultRedactor = newRedactor(defaultCodeLength)
+
+// newRedactor masks codes following "code" or "otp" that contain a digit or
+// are codeLength long, as codes drawn from letters only have no digit to
+// tell them from words like "expired"
+func newRedactor(codeLength int) *redactor {
+	if codeLength <= 0 {
+		codeLength = defaultCodeLength
+	}
+	return &redactor{codeRe: regexp.MustCompile(fmt.Sprintf(`(?i)\b(code|otp)(\s*(?:is|:|=)?\s*)(?:[a-z0-9]*\d[a-z0-9]*|[a-z]{%d})\b`, codeLength))}
+}
+
+// Scrub masks phone numbers, email addresses, OTP codes of the default length
+// and tokens found in free text
+func Scrub(s string) string {
+	return defaultRedactor.scrub(s)
+}
+
+func (r *redactor) scrub(s string) string {
+	s = jwtRe.ReplaceAllString(s, redacted)
+	s = bearerRe.ReplaceAllString(s, "Bearer "+redacted)
+	s = longTokenRe.ReplaceAllString(s, redacted)
+	s = r.codeRe.ReplaceAllString(s, "${1}${2}******")
+	s = emailRe.ReplaceAllStringFunc(s, MaskEmail)
+	return phoneRe.ReplaceAllStringFunc(s, MaskPhone)
+}
+
+// MaskEmail keeps the first character of the local part and the domain
+func MaskEmail(e string) string {
+	local, domain, ok := strings.Cut(e, "@")
+	if !ok || local == "" {
+		return strings.Repeat("*", len(e))
+	}
+	return local[:1] + strings.Repeat("*", len(local)-1) + "@" + domain
+}
+
+// MaskPhone keeps the first three and last two characters of a phone number
+func MaskPhone(p string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r == '+' || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, p)
+	if len(digits) <= 5 {
+		return strings.Repeat("*", len(digits))
+	}
+	return digits[:3] + strings.Repeat("*", len(digits)-5) + digits[len(digits)-2:]
+}
+
+func (r *redactor) attr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	key := strings.ToLower(a.Key)
+
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		out := make([]any, len(group))
+		for i, g := range group {
+			out[i] = r.attr(g)
+		}
+		return slog.Group(a.Key, out...)
+	}
+	if secretKeys[key] {
+		return slog.String(a.Key, redacted)
+	}
+
+	var s string
+	switch a.Value.Kind() {
+	case slog.KindString:
+		s = a.Value.String()
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			s = v.Error()
+		case fmt.Stringer:
+			s = v.String()
+		default:
+			return a
+		}
+	default:
+		return a
+	}
+
+	if contactKeys[key] {
+		if strings.Contains(s, "@") {
+			return slog.String(a.Key, MaskEmail(s))
+		}
+		return slog.String(a.Key, MaskPhone(s))
+	}
+	return slog.String(a.Key, r.scrub(s))
+}
@@ -0,0 +1,196 @@
+// Package metrics defines the Prometheus collectors exported on /metrics.
+// They are registered on a dedicated Registry instead of the global default
+// one, so /metrics exposes exactly what is declared here.
+package metrics
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/apperr"
+)
+
+const namespace = "zeus"
+
+// Registry holds every collector served on /metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// OTPGenerated counts Generate calls by result: sent, rate_limited, locked, delivery_failed or error
+	OTPGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "otp_generate_total",
+		Help:      "OTP generation attempts by result.",
+	}, []string{"result"})
+
+	// OTPVerified counts Verify calls by result: success, invalid, expired, locked or error
+	OTPVerified = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "otp_verify_total",
+		Help:      "OTP verification attempts by result.",
+	}, []string{"result"})
+
+	// OTPLockouts counts phones locked after too many wrong codes
+	OTPLockouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "otp_lockouts_total",
+		Help:      "Phones locked after reaching the maximum number of wrong codes.",
+	})
+
+	// MFAVerified counts second factor checks by result: totp, recovery_code, invalid or locked
+	MFAVerified = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mfa_verify_total",
+		Help:      "Second factor verification attempts by result.",
+	}, []string{"result"})
+
+	// PasskeyLogins counts passkey sign-ins by result: success, invalid or cloned
+	PasskeyLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "passkey_login_total",
+		Help:      "Passkey login attempts by result.",
+	}, []string{"result"})
+
+	// JWTIssued counts access token signing by result: ok or error
+	JWTIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jwt_generate_total",
+		Help:      "Access tokens signed by result.",
+	}, []string{"result"})
+
+	// JWTParsed counts access token verification by result: ok, expired or invalid
+	JWTParsed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jwt_parse_total",
+		Help:      "Access tokens parsed by result.",
+	}, []string{"result"})
+
+	// AuthFailures counts requests rejected by the auth middleware by reason:
+	// missing, invalid, expired, bad_uid, revoked, revocation_error,
+	// client_token (an OpenID Connect client token on the API) or wrong_scope
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_middleware_failures_total",
+		Help:      "Requests rejected by the authentication middleware by reason.",
+	}, []string{"reason"})
+
+	// RateLimited counts requests rejected by the rate limiter, by limiter name
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Requests rejected by a rate limiter.",
+	}, []string{"limiter"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequestDuration,
+		OTPGenerated,
+		OTPVerified,
+		OTPLockouts,
+		MFAVerified,
+		PasskeyLogins,
+		JWTIssued,
+		JWTParsed,
+		AuthFailures,
+		RateLimited,
+	)
+}
+
+// RegisterPools exports connection pool statistics for Postgres and Redis
+func RegisterPools(db *sql.DB, rdb *redisv9.Client) {
+	Registry.MustRegister(
+		collectors.NewDBStatsCollector(db, "postgres"),
+		newRedisPoolCollector(rdb),
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func Handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+}
+
+// Middleware records the latency of every request under its route template,
+// so /api/users/:id is one series no matter how many ids are requested
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status, route := c.Response().StatusCode(), c.Route().Path
+		if err != nil {
+			// the app error handler has not written the response yet
+			status = apperr.Status(err)
+			if fe, ok := err.(*fiber.Error); ok && fe.Code == fiber.StatusNotFound {
+				// no route matched, Route() is whatever middleware ran last
+				route = "unmatched"
+			}
+		}
+		HTTPRequestDuration.
+			WithLabelValues(c.Method(), route, strconv.Itoa(status)).
+			Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// redisPoolCollector reports go-redis pool statistics at scrape time
+type redisPoolCollector struct {
+	rdb        *redisv9.Client
+	hits       *prometheus.Desc
+	misses     *prometheus.Desc
+	timeouts   *prometheus.Desc
+	totalConns *prometheus.Desc
+	idleConns  *prometheus.Desc
+	staleConns *prometheus.Desc
+}
+
+func newRedisPoolCollector(rdb *redisv9.Client) *redisPoolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "redis_pool", name), help, nil, nil)
+	}
+	return &redisPoolCollector{
+		rdb:        rdb,
+		hits:       desc("hits_total", "Times a free connection was found in the pool."),
+		misses:     desc("misses_total", "Times a free connection was not found in the pool."),
+		timeouts:   desc("timeouts_total", "Times a wait for a connection timed out."),
+		totalConns: desc("total_connections", "Connections in the pool."),
+		idleConns:  desc("idle_connections", "Idle connections in the pool."),
+		staleConns: desc("stale_connections_total", "Stale connections removed from the pool."),
+	}
+}
+
+func (c *redisPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.timeouts
+	ch <- c.totalConns
+	ch <- c.idleConns
+	ch <- c.staleConns
+}
+
+func (c *redisPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.rdb.PoolStats()
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(s.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(s.Misses))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(s.Timeouts))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(s.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(s.IdleConns))
+	ch <- prometheus.MustNewConstMetric(c.staleConns, prometheus.CounterValue, float64(s.StaleConns))
+}
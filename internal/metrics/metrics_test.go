@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestMiddlewareUsesRouteTemplate(t *testing.T) {
+	app := fiber.New()
+	app.Get("/metrics", Handler())
+	app.Use(Middleware())
+	app.Get("/users/:id", func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	for _, path := range []string{"/users/1", "/users/2", "/nope/3"} {
+		if _, err := app.Test(httptest.NewRequest("GET", path, nil)); err != nil {
+			t.Fatalf("request: %v", err)
+		}
+	}
+
+	res, err := app.Test(httptest.NewRequest("GET", "/metrics", nil))
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	out := string(body)
+
+	for _, want := range []string{
+		`zeus_http_request_duration_seconds_count{method="GET",route="/users/:id",status="200"} 2`,
+		`zeus_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if strings.Contains(out, "/users/1") {
+		t.Error("raw paths must not become label values")
+	}
+}
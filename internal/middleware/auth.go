@@ -1,10 +1,16 @@
 package middleware
 
 import (
+	"errors"
+	"slices"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/metrics"
+	"github.com/rznas/zeus/internal/rbac"
 	"github.com/rznas/zeus/internal/services"
 )
 
@@ -12,35 +18,102 @@ type contextKey string
 
 const (
 	ContextUserID contextKey = "user_id"
+	ContextClaims contextKey = "claims"
 )
 
-func AuthMiddleware(jwtSvc *services.JWTService) fiber.Handler {
+var (
+	errMissingToken = apperr.Unauthorized("missing_token", "missing token")
+	errInvalidToken = apperr.Unauthorized("invalid_token", "invalid token")
+	errTokenExpired = apperr.Unauthorized("token_expired", "token expired")
+	errTokenRevoked = apperr.Unauthorized("token_revoked", "token revoked")
+	errUnauthorized = apperr.Unauthorized("unauthorized", "unauthorized")
+	errForbidden    = apperr.Forbidden("forbidden", "missing permission")
+
+	errInsufficientScope = apperr.Forbidden("insufficient_scope", "token lacks the required scope")
+)
+
+func AuthMiddleware(jwtSvc *services.JWTService, revocations *services.RevocationService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		authHeader := c.Get("Authorization")
-		if authHeader == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "missing token"})
-		}
-		token := authHeader
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			token = strings.TrimPrefix(authHeader, "Bearer ")
+		claims, uid, err := authenticate(c, jwtSvc, revocations)
+		if err != nil {
+			return err
 		}
-		token = strings.TrimSpace(token)
-		if token == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "missing token"})
+		// tokens of OpenID Connect clients only open the userinfo endpoint
+		if claims.ClientID != "" {
+			return reject("client_token", errInvalidToken)
 		}
-		claims, err := jwtSvc.Parse(token)
-		if err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid token"})
+		c.Locals(string(ContextUserID), uid)
+		c.Locals(string(ContextClaims), claims)
+		return c.Next()
+	}
+}
+
+// ClientTokenMiddleware accepts the access tokens issued to OpenID Connect
+// clients that were granted scope. Errors carry a WWW-Authenticate header as
+// RFC 6750 asks.
+func ClientTokenMiddleware(jwtSvc *services.JWTService, revocations *services.RevocationService, scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, uid, err := authenticate(c, jwtSvc, revocations)
+		if err == nil && (claims.ClientID == "" || !slices.Contains(strings.Fields(claims.Scope), scope)) {
+			err = reject("wrong_scope", errInsufficientScope)
 		}
-		uid, err := uuid.Parse(claims.UserID)
 		if err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid uid"})
+			challenge := `Bearer`
+			if errors.Is(err, errInsufficientScope) {
+				challenge += ` error="insufficient_scope", scope="` + scope + `"`
+			} else if !errors.Is(err, errMissingToken) {
+				challenge += ` error="invalid_token"`
+			}
+			c.Set(fiber.HeaderWWWAuthenticate, challenge)
+			return err
 		}
 		c.Locals(string(ContextUserID), uid)
+		c.Locals(string(ContextClaims), claims)
 		return c.Next()
 	}
 }
 
+// authenticate checks the bearer token of the request
+func authenticate(c *fiber.Ctx, jwtSvc *services.JWTService, revocations *services.RevocationService) (*services.Claims, uuid.UUID, error) {
+	authHeader := c.Get("Authorization")
+	if authHeader == "" {
+		return nil, uuid.Nil, reject("missing", errMissingToken)
+	}
+	token := authHeader
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		token = strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return nil, uuid.Nil, reject("missing", errMissingToken)
+	}
+	claims, err := jwtSvc.Parse(token)
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, uuid.Nil, reject("expired", errTokenExpired)
+		}
+		return nil, uuid.Nil, reject("invalid", errInvalidToken)
+	}
+	uid, err := uuid.Parse(claims.UserID)
+	if err != nil {
+		return nil, uuid.Nil, reject("bad_uid", errInvalidToken)
+	}
+	revoked, err := revocations.IsRevoked(c.UserContext(), claims)
+	if err != nil {
+		return nil, uuid.Nil, reject("revocation_error", err)
+	}
+	if revoked {
+		return nil, uuid.Nil, reject("revoked", errTokenRevoked)
+	}
+	return claims, uid, nil
+}
+
+// reject counts the failure reason and returns err
+func reject(reason string, err error) error {
+	metrics.AuthFailures.WithLabelValues(reason).Inc()
+	return err
+}
+
 func GetUserID(c *fiber.Ctx) (uuid.UUID, bool) {
 	v := c.Locals(string(ContextUserID))
 	if v == nil {
@@ -49,3 +122,23 @@ func GetUserID(c *fiber.Ctx) (uuid.UUID, bool) {
 	uid, ok := v.(uuid.UUID)
 	return uid, ok
 }
+
+func GetClaims(c *fiber.Ctx) (*services.Claims, bool) {
+	claims, ok := c.Locals(string(ContextClaims)).(*services.Claims)
+	return claims, ok
+}
+
+// RequirePermission rejects requests whose token roles do not grant the permission.
+// It must run after AuthMiddleware.
+func RequirePermission(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, ok := GetClaims(c)
+		if !ok {
+			return errUnauthorized
+		}
+		if !rbac.HasPermission(claims.Roles, permission) {
+			return errForbidden
+		}
+		return c.Next()
+	}
+}
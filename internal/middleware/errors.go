@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/rznas/zeus/internal/apperr"
+)
+
+// ErrorHandler renders every error returned by a handler or middleware as
+// RFC 7807 problem details. Logging is left to RequestLogger, which sees the
+// same error.
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	p := apperr.ProblemFor(err)
+	p.Instance = c.Path()
+	p.RequestID = GetRequestID(c)
+	if p.RetryAfter > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(p.RetryAfter))
+	}
+	return c.Status(p.Status).JSON(p, apperr.ContentType)
+}
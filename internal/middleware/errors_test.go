@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/rznas/zeus/internal/apperr"
+)
+
+func TestErrorHandler(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Use(RequestID())
+	app.Get("/validation", func(c *fiber.Ctx) error {
+		return apperr.Validation(map[string]string{"phone": "required"})
+	})
+	app.Get("/locked", func(c *fiber.Ctx) error {
+		return apperr.Locked("otp_locked", "locked").WithRetryAfter(90 * time.Second)
+	})
+	app.Get("/internal", func(c *fiber.Ctx) error {
+		return errors.New("dial tcp 10.0.0.5:5432: connection refused")
+	})
+
+	cases := []struct {
+		path       string
+		status     int
+		code       string
+		retryAfter string
+	}{
+		{"/validation", fiber.StatusBadRequest, "validation_failed", ""},
+		{"/locked", fiber.StatusLocked, "otp_locked", "90"},
+		{"/internal", fiber.StatusInternalServerError, apperr.CodeInternal, ""},
+		{"/missing", fiber.StatusNotFound, "not_found", ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set(HeaderRequestID, "req-1")
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.path, tc.status, res.StatusCode)
+		}
+		if ct := res.Header.Get(fiber.HeaderContentType); ct != apperr.ContentType {
+			t.Errorf("%s: unexpected content type %q", tc.path, ct)
+		}
+		if got := res.Header.Get(fiber.HeaderRetryAfter); got != tc.retryAfter {
+			t.Errorf("%s: expected Retry-After %q, got %q", tc.path, tc.retryAfter, got)
+		}
+		var p apperr.Problem
+		if err := json.NewDecoder(res.Body).Decode(&p); err != nil {
+			t.Fatalf("%s: decode: %v", tc.path, err)
+		}
+		if p.Status != tc.status || p.Code != tc.code || p.Instance != tc.path || p.RequestID != "req-1" {
+			t.Errorf("%s: unexpected problem %+v", tc.path, p)
+		}
+		if tc.code == "validation_failed" && p.Fields["phone"] != "required" {
+			t.Errorf("%s: expected field errors, got %v", tc.path, p.Fields)
+		}
+	}
+}
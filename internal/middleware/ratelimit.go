@@ -1,15 +1,132 @@
 package middleware
 
 import (
-	"time"
+	"log/slog"
+	"strconv"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/limiter"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/email"
+	"github.com/rznas/zeus/internal/metrics"
+	"github.com/rznas/zeus/internal/phone"
+	"github.com/rznas/zeus/internal/ratelimit"
+)
+
+// Headers describing the most restrictive limit applied to a request, see
+// draft-ietf-httpapi-ratelimit-headers
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+)
+
+var (
+	ErrRateLimited     = apperr.RateLimited("rate_limited", "too many requests, please try again later")
+	ErrTooManyAttempts = apperr.RateLimited("too_many_attempts", "too many verification attempts, please try again later")
 )
 
-func GlobalRateLimiter(maxPerMinute int) fiber.Handler {
-	return limiter.New(limiter.Config{
-		Max:        maxPerMinute,
-		Expiration: time.Minute,
-	})
+// RateLimitConfig configures a RateLimit middleware
+type RateLimitConfig struct {
+	// Name keeps the counters of different limits on the same client apart, e.g. "global" or "auth"
+	Name  string
+	Limit ratelimit.Limit
+	// Key identifies the client, requests it returns "" for are not limited
+	Key func(c *fiber.Ctx) string
+	// Err is returned once the limit is reached, nil means ErrRateLimited
+	Err    *apperr.Error
+	Logger *slog.Logger
+}
+
+// RateLimit limits requests per client using the limiter shared by all
+// replicas. A zero Limit.Rate disables it. If Redis can't be reached requests
+// are let through rather than failing the whole API; /readyz reports the outage.
+func RateLimit(limiter *ratelimit.Limiter, cfg RateLimitConfig) fiber.Handler {
+	if cfg.Limit.Rate <= 0 {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+	if cfg.Err == nil {
+		cfg.Err = ErrRateLimited
+	}
+	return func(c *fiber.Ctx) error {
+		key := cfg.Key(c)
+		if key == "" {
+			return c.Next()
+		}
+		res, err := limiter.Allow(c.UserContext(), cfg.Name+":"+key, cfg.Limit)
+		if err != nil {
+			cfg.Logger.WarnContext(c.UserContext(), "rate limiter unavailable, request let through", "limiter", cfg.Name, "error", err)
+			return c.Next()
+		}
+		setRateLimitHeaders(c, res)
+		if !res.Allowed {
+			metrics.RateLimited.WithLabelValues(cfg.Name).Inc()
+			return cfg.Err.WithRetryAfter(res.RetryAfter)
+		}
+		return c.Next()
+	}
+}
+
+// setRateLimitHeaders reports res unless an earlier limiter left less room
+func setRateLimitHeaders(c *fiber.Ctx, res ratelimit.Result) {
+	if prev, err := strconv.Atoi(c.GetRespHeader(HeaderRateLimitRemaining)); err == nil && prev <= res.Remaining {
+		return
+	}
+	c.Set(HeaderRateLimitLimit, strconv.Itoa(res.Limit))
+	c.Set(HeaderRateLimitRemaining, strconv.Itoa(res.Remaining))
+	c.Set(HeaderRateLimitReset, ratelimit.Seconds(res.ResetAfter))
+}
+
+// KeyByIP identifies clients by IP address
+func KeyByIP(c *fiber.Ctx) string {
+	return "ip:" + c.IP()
+}
+
+// KeyByUser identifies clients by the authenticated user, falling back to the
+// IP address when there is none
+func KeyByUser(c *fiber.Ctx) string {
+	if uid, ok := GetUserID(c); ok {
+		return "user:" + uid.String()
+	}
+	return KeyByIP(c)
+}
+
+// KeyByPhone identifies clients by the E.164 form of the "phone" field of the
+// body. Requests without a valid phone are not limited by it; they are
+// rejected by validation anyway.
+func KeyByPhone(phones *phone.Parser) func(c *fiber.Ctx) string {
+	return func(c *fiber.Ctx) string {
+		var body struct {
+			Phone string `json:"phone"`
+		}
+		if !parseKeyBody(c, &body) || body.Phone == "" {
+			return ""
+		}
+		p, err := phones.Normalize(body.Phone)
+		if err != nil {
+			return ""
+		}
+		return "phone:" + p
+	}
+}
+
+// KeyByEmail identifies clients by the canonical form of the "email" field of
+// the body. Requests without an email are not limited by it.
+func KeyByEmail(c *fiber.Ctx) string {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if !parseKeyBody(c, &body) {
+		return ""
+	}
+	if addr := email.Canonical(body.Email); addr != "" {
+		return "email:" + addr
+	}
+	return ""
+}
+
+// parseKeyBody decodes the body with the parser the handlers use, so a key is
+// found in every encoding a handler accepts, not only in JSON
+func parseKeyBody(c *fiber.Ctx, dst any) bool {
+	return len(c.Body()) > 0 && c.BodyParser(dst) == nil
 }
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/phone"
+	"github.com/rznas/zeus/internal/ratelimit"
+)
+
+func TestRateLimit(t *testing.T) {
+	mr := miniredis.RunT(t)
+	limiter := ratelimit.New(redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()}))
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Use(RateLimit(limiter, RateLimitConfig{Name: "global", Limit: ratelimit.PerMinute(10), Key: KeyByIP, Logger: logger}))
+	app.Post("/login", RateLimit(limiter, RateLimitConfig{
+		Name:   "login",
+		Limit:  ratelimit.PerHour(2),
+		Key:    KeyByPhone(phone.NewParser("US")),
+		Logger: logger,
+	}), func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusNoContent) })
+
+	login := func(body string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		return res
+	}
+
+	// the same phone in two spellings shares a counter, the tighter limit is reported
+	res := login(`{"phone": "+1 202 555 0100"}`)
+	if res.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("expected 204, got %d", res.StatusCode)
+	}
+	if got := res.Header.Get(HeaderRateLimitLimit); got != "2" {
+		t.Errorf("expected RateLimit-Limit 2, got %q", got)
+	}
+	if got := res.Header.Get(HeaderRateLimitRemaining); got != "1" {
+		t.Errorf("expected RateLimit-Remaining 1, got %q", got)
+	}
+	login(`{"phone": "2025550100"}`)
+	res = login(`{"phone": "+12025550100"}`)
+	if res.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", res.StatusCode)
+	}
+	if got := res.Header.Get(fiber.HeaderRetryAfter); got != "1800" {
+		t.Errorf("expected Retry-After 1800, got %q", got)
+	}
+
+	// other phones and bodies without one are only held to the global limit
+	if res := login(`{"phone": "+12025550101"}`); res.StatusCode != fiber.StatusNoContent {
+		t.Errorf("expected another phone to pass, got %d", res.StatusCode)
+	}
+	res = login(`{}`)
+	if res.StatusCode != fiber.StatusNoContent {
+		t.Errorf("expected request without phone to pass, got %d", res.StatusCode)
+	}
+	if got := res.Header.Get(HeaderRateLimitRemaining); got != "5" {
+		t.Errorf("expected global RateLimit-Remaining 5, got %q", got)
+	}
+
+	// form encoded bodies reach the handlers too, so they are counted as well
+	form := httptest.NewRequest("POST", "/login", strings.NewReader("phone=%2B12025550100"))
+	form.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	res, err := app.Test(form)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if res.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("expected a form encoded phone to be limited, got %d", res.StatusCode)
+	}
+
+	// an unreachable Redis lets requests through
+	mr.Close()
+	if res := login(`{"phone": "+12025550100"}`); res.StatusCode != fiber.StatusNoContent {
+		t.Errorf("expected fail open, got %d", res.StatusCode)
+	}
+}
+
+func TestKeyByEmail_Encodings(t *testing.T) {
+	app := fiber.New()
+	app.Post("/", func(c *fiber.Ctx) error { return c.SendString(KeyByEmail(c)) })
+
+	cases := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{fiber.MIMEApplicationJSON, `{"email": " Ada@Example.com "}`, "email:ada@example.com"},
+		{fiber.MIMEApplicationForm, "email=Ada%40Example.com", "email:ada@example.com"},
+		{fiber.MIMEApplicationJSON, `not json`, ""},
+		{"", "", ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set(fiber.HeaderContentType, tc.contentType)
+		}
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		got, _ := io.ReadAll(res.Body)
+		if string(got) != tc.want {
+			t.Errorf("%s %q: expected key %q, got %q", tc.contentType, tc.body, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/logging"
+)
+
+// HeaderRequestID carries the request id in requests and responses
+const HeaderRequestID = "X-Request-ID"
+
+// ids supplied by clients or proxies are kept only if they look harmless in logs
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID assigns every request an id, reusing a well-formed X-Request-ID
+// from upstream, and echoes it in the response
+func RequestID() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Get(HeaderRequestID)
+		if !requestIDRe.MatchString(id) {
+			id = uuid.NewString()
+		}
+		c.Locals(logging.RequestIDKey, id)
+		c.SetUserContext(logging.WithRequestID(c.UserContext(), id))
+		c.Set(HeaderRequestID, id)
+		return c.Next()
+	}
+}
+
+// GetRequestID returns the id assigned by RequestID
+func GetRequestID(c *fiber.Ctx) string {
+	id, _ := c.Locals(logging.RequestIDKey).(string)
+	return id
+}
+
+// RequestLogger writes one access log record per request. It logs the path
+// without the query string, which may contain phone numbers.
+func RequestLogger(logger *slog.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			// ErrorHandler has not written the response yet
+			status = apperr.Status(err)
+		}
+		level := slog.LevelInfo
+		if status >= fiber.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Method()),
+			slog.String("path", c.Path()),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("ip", c.IP()),
+		}
+		if uid, ok := GetUserID(c); ok {
+			attrs = append(attrs, slog.String("user_id", uid.String()))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		logger.LogAttrs(c.UserContext(), level, "request", attrs...)
+		return err
+	}
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRequestID(t *testing.T) {
+	app := fiber.New()
+	app.Use(RequestID())
+	app.Get("/", func(c *fiber.Ctx) error { return c.SendString(GetRequestID(c)) })
+
+	cases := []struct {
+		incoming string
+		keep     bool
+	}{
+		{"", false},
+		{"edge-7f3a.1", true},
+		{"bad id\nwith newline", false},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.incoming != "" {
+			req.Header.Set(HeaderRequestID, tc.incoming)
+		}
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		id := res.Header.Get(HeaderRequestID)
+		if id == "" {
+			t.Fatalf("%q: missing response id", tc.incoming)
+		}
+		if (id == tc.incoming) != tc.keep {
+			t.Errorf("%q: got id %q, keep=%v", tc.incoming, id, tc.keep)
+		}
+	}
+}
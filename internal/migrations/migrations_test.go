@@ -0,0 +1,79 @@
+package migrations
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadOrdersByVersion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0010_add_index.up.sql":   {Data: []byte("CREATE INDEX a ON t (c);")},
+		"0010_add_index.down.sql": {Data: []byte("DROP INDEX a;")},
+		"0002_create_t.up.sql":    {Data: []byte("CREATE TABLE t (c int);")},
+		"0002_create_t.down.sql":  {Data: []byte("DROP TABLE t;")},
+	}
+	migs, err := Load(fsys)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(migs) != 2 || migs[0].Version != 2 || migs[1].Version != 10 {
+		t.Fatalf("unexpected order: %+v", migs)
+	}
+	if migs[0].Name != "create_t" || migs[0].Down != "DROP TABLE t;" {
+		t.Fatalf("unexpected migration: %+v", migs[0])
+	}
+}
+
+func TestLoadRejectsIncompleteMigrations(t *testing.T) {
+	cases := map[string]fstest.MapFS{
+		"missing down": {"0001_a.up.sql": {Data: []byte("SELECT 1;")}},
+		"bad name":     {"init.sql": {Data: []byte("SELECT 1;")}},
+		"name clash": {
+			"0001_a.up.sql":   {Data: []byte("SELECT 1;")},
+			"0001_b.down.sql": {Data: []byte("SELECT 1;")},
+		},
+	}
+	for name, fsys := range cases {
+		if _, err := Load(fsys); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	m, err := New(nil)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if len(m.migrations) == 0 || m.migrations[0].Version != 1 {
+		t.Fatalf("expected the initial migration first, got %+v", m.migrations)
+	}
+}
+
+func TestCreateNextVersion(t *testing.T) {
+	dir := t.TempDir()
+	up, down, err := Create(dir, "Create users")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if filepath.Base(up) != "0001_create_users.up.sql" || filepath.Base(down) != "0001_create_users.down.sql" {
+		t.Fatalf("unexpected paths %s %s", up, down)
+	}
+
+	up, _, err = Create(dir, "add-email")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if filepath.Base(up) != "0002_add_email.up.sql" {
+		t.Fatalf("unexpected path %s", up)
+	}
+	if _, err := os.Stat(up); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+
+	if _, _, err := Create(dir, "bad;name"); err == nil {
+		t.Fatal("expected invalid name to be rejected")
+	}
+}
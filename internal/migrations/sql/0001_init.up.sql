@@ -0,0 +1,29 @@
+-- Baseline schema. Written to also adopt databases previously managed by
+-- AutoMigrate, hence the IF NOT EXISTS guards.
+CREATE TABLE IF NOT EXISTS users (
+    id uuid PRIMARY KEY,
+    phone varchar(20) NOT NULL,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name varchar(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email varchar(254);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale varchar(35);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_url varchar(2048);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS blocked_at timestamptz;
+
+-- phone used to be unique across deleted users too
+DROP INDEX IF EXISTS idx_users_phone;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_phone_active ON users (phone) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_users_created_at_id ON users (created_at, id);
+CREATE INDEX IF NOT EXISTS idx_users_updated_at_id ON users (updated_at, id);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role varchar(32) NOT NULL,
+    created_at timestamptz,
+    PRIMARY KEY (user_id, role)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_users_email_active;
+ALTER TABLE users DROP COLUMN IF EXISTS email_verified_at;
@@ -0,0 +1,15 @@
+-- Email becomes a login identifier: unique among active users and only used
+-- for login once verified. Addresses were free-form profile data until now.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at timestamptz;
+
+UPDATE users SET email = lower(trim(email)) WHERE email IS NOT NULL;
+UPDATE users SET email = '' WHERE email IS NULL;
+
+-- keep the address on the oldest account, later duplicates were never verified
+UPDATE users u SET email = ''
+WHERE u.email <> '' AND u.deleted_at IS NULL AND EXISTS (
+    SELECT 1 FROM users o
+    WHERE o.email = u.email AND o.deleted_at IS NULL AND (o.created_at, o.id) < (u.created_at, u.id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_active ON users (email) WHERE deleted_at IS NULL AND email <> '';
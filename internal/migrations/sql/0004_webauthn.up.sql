@@ -0,0 +1,19 @@
+-- Passkeys and security keys (WebAuthn credentials).
+CREATE TABLE webauthn_credentials (
+    id uuid PRIMARY KEY,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    credential_id bytea NOT NULL,
+    public_key bytea NOT NULL,
+    attestation_type varchar(32),
+    aaguid bytea,
+    sign_count bigint NOT NULL DEFAULT 0,
+    backup_eligible boolean NOT NULL DEFAULT false,
+    backup_state boolean NOT NULL DEFAULT false,
+    transports varchar(128),
+    name varchar(64),
+    created_at timestamptz,
+    last_used_at timestamptz
+);
+
+CREATE UNIQUE INDEX idx_webauthn_credentials_credential_id ON webauthn_credentials (credential_id);
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials (user_id);
@@ -0,0 +1,20 @@
+-- OpenID Connect clients and the consents users gave them.
+CREATE TABLE oauth_clients (
+    id varchar(64) PRIMARY KEY,
+    name varchar(64) NOT NULL,
+    secret_hash varchar(64),
+    redirect_uris text NOT NULL,
+    public boolean NOT NULL DEFAULT false,
+    trusted boolean NOT NULL DEFAULT false,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+
+CREATE TABLE oauth_consents (
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    client_id varchar(64) NOT NULL REFERENCES oauth_clients (id) ON DELETE CASCADE,
+    scope varchar(256) NOT NULL,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (user_id, client_id)
+);
@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS idx_users_email_active;
+
+-- keep the address on the verified account, or on the oldest one if nobody verified it
+UPDATE users u SET email = ''
+WHERE u.email <> '' AND u.deleted_at IS NULL AND EXISTS (
+    SELECT 1 FROM users o
+    WHERE o.email = u.email AND o.deleted_at IS NULL AND o.id <> u.id
+      AND (o.email_verified_at IS NOT NULL, u.created_at, u.id) > (u.email_verified_at IS NOT NULL, o.created_at, o.id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_active ON users (email) WHERE deleted_at IS NULL AND email <> '';
@@ -0,0 +1,6 @@
+-- Only a verified address is claimed: an unverified one no longer locks out the
+-- person who really owns it. Several accounts may have entered the same address,
+-- whoever verifies it first keeps it.
+DROP INDEX IF EXISTS idx_users_email_active;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_active ON users (email) WHERE deleted_at IS NULL AND email_verified_at IS NOT NULL;
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserTOTP is the authenticator app of a user. The secret is stored encrypted.
+// ConfirmedAt stays nil until the user proved the app works with a first code;
+// only then is the second factor enforced at login.
+type UserTOTP struct {
+	UserID      uuid.UUID  `gorm:"type:uuid;primaryKey" json:"user_id"`
+	Secret      []byte     `gorm:"not null" json:"-"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// RecoveryCode is a one-time code that stands in for the authenticator app.
+// Only its HMAC is stored.
+type RecoveryCode struct {
+	UserID    uuid.UUID  `gorm:"type:uuid;primaryKey" json:"user_id"`
+	CodeHash  string     `gorm:"primaryKey;size:64" json:"-"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
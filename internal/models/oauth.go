@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OAuthClient is an application that signs users in with Zeus over OpenID
+// Connect. Confidential clients authenticate at the token endpoint with a
+// secret, of which only the SHA-256 is stored; public clients (browser and
+// mobile apps) have none and rely on PKCE alone. Users are not asked to
+// consent to trusted clients, which are meant for our own products.
+type OAuthClient struct {
+	ID           string    `gorm:"primaryKey;size:64" json:"client_id"`
+	Name         string    `gorm:"size:64;not null" json:"name"`
+	SecretHash   string    `gorm:"size:64" json:"-"`
+	RedirectURIs []string  `gorm:"serializer:json;type:text;not null" json:"redirect_uris"`
+	Public       bool      `gorm:"not null;default:false" json:"public"`
+	Trusted      bool      `gorm:"not null;default:false" json:"trusted"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// OAuthConsent remembers the scopes a user granted to a client, so they are
+// only asked again for new ones
+type OAuthConsent struct {
+	UserID    uuid.UUID `gorm:"type:uuid;primaryKey" json:"-"`
+	ClientID  string    `gorm:"primaryKey;size:64" json:"client_id"`
+	Scope     string    `gorm:"size:256;not null" json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -7,12 +7,23 @@ import (
 	"gorm.io/gorm"
 )
 
+// User is an account identified by its phone. The phone is unique among active
+// users only, so the number of a deleted account can register again. The
+// email is optional and only unique among active users once verified. The
+// (created_at, id) and (updated_at, id) indexes back keyset pagination.
 type User struct {
-	ID        uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
-	Phone     string         `gorm:"uniqueIndex;size:20;not null" json:"phone"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID          uuid.UUID `gorm:"type:uuid;primaryKey;index:idx_users_created_at_id,priority:2;index:idx_users_updated_at_id,priority:2" json:"id"`
+	Phone       string    `gorm:"uniqueIndex:idx_users_phone_active,where:deleted_at IS NULL;size:20;not null" json:"phone"`
+	DisplayName string    `gorm:"size:64" json:"display_name"`
+	Email       string    `gorm:"uniqueIndex:idx_users_email_active,where:deleted_at IS NULL AND email_verified_at IS NOT NULL;size:254" json:"email"`
+	// EmailVerifiedAt is set once the user proved they receive mail at Email
+	EmailVerifiedAt *time.Time     `json:"email_verified_at,omitempty"`
+	Locale          string         `gorm:"size:35" json:"locale"`
+	AvatarURL       string         `gorm:"size:2048" json:"avatar_url"`
+	BlockedAt       *time.Time     `json:"blocked_at,omitempty"`
+	CreatedAt       time.Time      `gorm:"index:idx_users_created_at_id,priority:1" json:"created_at"`
+	UpdatedAt       time.Time      `gorm:"index:idx_users_updated_at_id,priority:1" json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"deleted_at" swaggertype:"string" format:"date-time"`
 }
 
 func (u *User) BeforeCreate(tx *gorm.DB) (err error) {
@@ -21,3 +32,10 @@ func (u *User) BeforeCreate(tx *gorm.DB) (err error) {
 	}
 	return nil
 }
+
+// UserRole grants a role from the rbac package to a user
+type UserRole struct {
+	UserID    uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	Role      string    `gorm:"primaryKey;size:32" json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
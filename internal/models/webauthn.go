@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// WebAuthnCredential is a passkey or security key of a user. CredentialID is
+// chosen by the authenticator and looked up when it signs in; SignCount and
+// the backup flags are updated on every use.
+type WebAuthnCredential struct {
+	ID              uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID          uuid.UUID `gorm:"type:uuid;not null;index" json:"-"`
+	CredentialID    []byte    `gorm:"not null;uniqueIndex" json:"-"`
+	PublicKey       []byte    `gorm:"not null" json:"-"`
+	AttestationType string    `gorm:"size:32" json:"-"`
+	AAGUID          []byte    `json:"-"`
+	SignCount       uint32    `gorm:"not null;default:0" json:"-"`
+	// BackupEligible never changes, BackupState tells whether the passkey is
+	// currently synced to other devices
+	BackupEligible bool `gorm:"not null;default:false" json:"backup_eligible"`
+	BackupState    bool `gorm:"not null;default:false" json:"backup_state"`
+	// Transports is the comma separated list of transports the authenticator reported
+	Transports string     `gorm:"size:128" json:"-"`
+	Name       string     `gorm:"size:64" json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func (c *WebAuthnCredential) BeforeCreate(tx *gorm.DB) (err error) {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Package phone parses user supplied phone numbers and canonicalizes them to E.164.
+package phone
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+var (
+	// ErrInvalid is returned for input that is not a valid phone number
+	ErrInvalid = errors.New("invalid phone number")
+	// ErrNotAllowed is returned for valid numbers of a type we do not send codes to
+	ErrNotAllowed = errors.New("phone number type not allowed")
+)
+
+// blockedTypes are number types that cannot receive SMS or cost the sender extra
+var blockedTypes = map[phonenumbers.PhoneNumberType]bool{
+	phonenumbers.PREMIUM_RATE: true,
+	phonenumbers.SHARED_COST:  true,
+	phonenumbers.TOLL_FREE:    true,
+	phonenumbers.UAN:          true,
+	phonenumbers.VOICEMAIL:    true,
+	phonenumbers.PAGER:        true,
+}
+
+// Parser interprets numbers without a leading + as belonging to its default region
+type Parser struct {
+	defaultRegion string
+}
+
+// NewParser creates a parser for the given ISO 3166-1 alpha-2 default region, e.g. "US"
+func NewParser(defaultRegion string) *Parser {
+	return &Parser{defaultRegion: strings.ToUpper(strings.TrimSpace(defaultRegion))}
+}
+
+// Normalize validates raw and returns it in E.164 form, e.g. "+15551234567".
+// Use it on untrusted input before anything is stored or sent.
+func (p *Parser) Normalize(raw string) (string, error) {
+	num, err := phonenumbers.Parse(strings.TrimSpace(raw), p.defaultRegion)
+	if err != nil || !phonenumbers.IsValidNumber(num) {
+		return "", ErrInvalid
+	}
+	if blockedTypes[phonenumbers.GetNumberType(num)] {
+		return "", ErrNotAllowed
+	}
+	return phonenumbers.Format(num, phonenumbers.E164), nil
+}
+
+// Canonical returns the E.164 form of raw without validating it, falling back
+// to the trimmed input when it cannot be parsed at all. Use it to derive
+// storage keys from numbers that were already validated with Normalize.
+func (p *Parser) Canonical(raw string) string {
+	raw = strings.TrimSpace(raw)
+	num, err := phonenumbers.Parse(raw, p.defaultRegion)
+	if err != nil {
+		return raw
+	}
+	return phonenumbers.Format(num, phonenumbers.E164)
+}
@@ -0,0 +1,49 @@
+package phone
+
+import "testing"
+
+func TestParser_Normalize(t *testing.T) {
+	p := NewParser("US")
+	for _, raw := range []string{"+1 415 555 2671", "14155552671", "+14155552671", "(415) 555-2671", " 415.555.2671 "} {
+		got, err := p.Normalize(raw)
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", raw, err)
+		}
+		if got != "+14155552671" {
+			t.Fatalf("%q: expected +14155552671, got %q", raw, got)
+		}
+	}
+
+	// numbers with a country code ignore the default region
+	got, err := NewParser("IR").Normalize("+44 7400 123456")
+	if err != nil || got != "+447400123456" {
+		t.Fatalf("expected +447400123456, got %q err=%v", got, err)
+	}
+}
+
+func TestParser_NormalizeRejects(t *testing.T) {
+	p := NewParser("US")
+	cases := map[string]error{
+		"":                ErrInvalid,
+		"hello":           ErrInvalid,
+		"12345":           ErrInvalid,
+		"+1 555 0100":     ErrInvalid,
+		"+1 900 555 0100": ErrNotAllowed, // premium rate
+		"+1 800 555 0100": ErrNotAllowed, // toll free
+	}
+	for raw, want := range cases {
+		if _, err := p.Normalize(raw); err != want {
+			t.Fatalf("%q: expected %v, got %v", raw, want, err)
+		}
+	}
+}
+
+func TestParser_Canonical(t *testing.T) {
+	p := NewParser("US")
+	if got := p.Canonical("+1 555 123 4567"); got != "+15551234567" {
+		t.Fatalf("expected +15551234567, got %q", got)
+	}
+	if got := p.Canonical(" not a number "); got != "not a number" {
+		t.Fatalf("expected trimmed fallback, got %q", got)
+	}
+}
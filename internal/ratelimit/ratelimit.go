@@ -0,0 +1,106 @@
+// Package ratelimit implements a rate limiter shared by every replica through
+// Redis. It uses the generic cell rate algorithm (GCRA): each key stores the
+// theoretical arrival time of the next request, which gives a smooth limit
+// without fixed-window bursts at window edges and needs a single key per
+// client. The check and update run in one Lua script on Redis' clock, so
+// concurrent requests and clock skew between replicas can't exceed the limit.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	redisv9 "github.com/redis/go-redis/v9"
+)
+
+// Limit allows Rate requests per Period, of which up to Burst may arrive at once
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+// PerMinute allows n requests per minute, all of which may be used at once
+func PerMinute(n int) Limit {
+	return Limit{Rate: n, Period: time.Minute, Burst: n}
+}
+
+// PerHour allows n requests per hour, all of which may be used at once
+func PerHour(n int) Limit {
+	return Limit{Rate: n, Period: time.Hour, Burst: n}
+}
+
+// Result is the outcome of a single Allow call
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// ResetAfter is when the full burst is available again
+	ResetAfter time.Duration
+	// RetryAfter is when the next request will be allowed, zero if this one was
+	RetryAfter time.Duration
+}
+
+// KEYS[1] limiter key
+// ARGV[1] burst, ARGV[2] emission interval in microseconds
+// returns {allowed, remaining, retry_after_us, reset_after_us}
+var gcraScript = redisv9.NewScript(`
+local burst = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+  tat = now
+end
+
+local new_tat = tat + interval
+local allow_at = new_tat - burst * interval
+if now < allow_at then
+  return {0, 0, allow_at - now, tat - now}
+end
+
+redis.call("SET", KEYS[1], new_tat, "PX", math.ceil((new_tat - now) / 1000))
+return {1, math.floor((now - allow_at) / interval), 0, new_tat - now}
+`)
+
+// Limiter checks limits against Redis
+type Limiter struct {
+	redis  *redisv9.Client
+	prefix string
+}
+
+// New returns a limiter storing its state under the "ratelimit:" prefix
+func New(client *redisv9.Client) *Limiter {
+	return &Limiter{redis: client, prefix: "ratelimit:"}
+}
+
+// Allow counts a request for key against limit. key must include everything
+// that tells limits apart, e.g. "auth:ip:203.0.113.7".
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	burst := max(limit.Burst, 1)
+	interval := limit.Period.Microseconds() / int64(max(limit.Rate, 1))
+	if interval <= 0 {
+		// no meaningful limit
+		return Result{Allowed: true, Limit: burst, Remaining: burst}, nil
+	}
+	res, err := gcraScript.Run(ctx, l.redis, []string{l.prefix + key}, burst, interval).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Allowed:    res[0] == 1,
+		Limit:      burst,
+		Remaining:  int(res[1]),
+		RetryAfter: time.Duration(res[2]) * time.Microsecond,
+		ResetAfter: time.Duration(res[3]) * time.Microsecond,
+	}, nil
+}
+
+// Seconds rounds d up to whole seconds, as used in the RateLimit-* and Retry-After headers
+func Seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	redisv9 "github.com/redis/go-redis/v9"
+)
+
+var start = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newLimiter(t *testing.T) (*Limiter, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	mr.SetTime(start)
+	return New(redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})), mr
+}
+
+func TestAllow(t *testing.T) {
+	l, mr := newLimiter(t)
+	ctx := context.Background()
+	limit := PerMinute(3)
+
+	for i := 0; i < 3; i++ {
+		res, err := l.Allow(ctx, "ip:1", limit)
+		if err != nil {
+			t.Fatalf("allow: %v", err)
+		}
+		if !res.Allowed || res.Remaining != 2-i {
+			t.Fatalf("request %d: unexpected result %+v", i, res)
+		}
+	}
+	res, err := l.Allow(ctx, "ip:1", limit)
+	if err != nil {
+		t.Fatalf("allow: %v", err)
+	}
+	if res.Allowed || res.RetryAfter != 20*time.Second || res.ResetAfter != time.Minute {
+		t.Fatalf("expected rejection with retry in 20s, got %+v", res)
+	}
+
+	// other keys have their own budget
+	if res, _ := l.Allow(ctx, "ip:2", limit); !res.Allowed {
+		t.Fatalf("expected another key to be allowed")
+	}
+
+	// one request is earned back per emission interval
+	// miniredis expires keys on FastForward and reports SetTime to TIME
+	mr.SetTime(start.Add(20 * time.Second))
+	mr.FastForward(20 * time.Second)
+	if res, _ := l.Allow(ctx, "ip:1", limit); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("expected one request after 20s, got %+v", res)
+	}
+	mr.SetTime(start.Add(80 * time.Second))
+	mr.FastForward(time.Minute)
+	if res, _ := l.Allow(ctx, "ip:1", limit); !res.Allowed || res.Remaining != 2 {
+		t.Fatalf("expected full burst after a minute, got %+v", res)
+	}
+}
+
+func TestAllowConcurrent(t *testing.T) {
+	l, _ := newLimiter(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := l.Allow(ctx, "user:1", PerMinute(10))
+			if err != nil {
+				t.Errorf("allow: %v", err)
+				return
+			}
+			if res.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 10 {
+		t.Fatalf("expected exactly 10 allowed requests, got %d", allowed)
+	}
+}
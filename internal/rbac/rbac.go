@@ -0,0 +1,49 @@
+// Package rbac defines the roles users can hold and the permissions they grant.
+package rbac
+
+// Roles
+const (
+	RoleAdmin = "admin"
+)
+
+// Permissions
+const (
+	PermUsersList   = "users:list"
+	PermUsersRead   = "users:read"
+	PermUsersWrite  = "users:write"
+	PermUsersDelete = "users:delete"
+	PermUsersBlock  = "users:block"
+	// PermClientsManage registers the applications that sign users in with Zeus
+	PermClientsManage = "clients:manage"
+)
+
+// rolePermissions maps every role to the permissions it grants. Users without
+// a role can only act on their own account.
+var rolePermissions = map[string][]string{
+	RoleAdmin: {
+		PermUsersList,
+		PermUsersRead,
+		PermUsersWrite,
+		PermUsersDelete,
+		PermUsersBlock,
+		PermClientsManage,
+	},
+}
+
+// IsRole reports whether name is a known role
+func IsRole(name string) bool {
+	_, ok := rolePermissions[name]
+	return ok
+}
+
+// HasPermission reports whether any of the roles grants the permission
+func HasPermission(roles []string, permission string) bool {
+	for _, role := range roles {
+		for _, p := range rolePermissions[role] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
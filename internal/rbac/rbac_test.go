@@ -0,0 +1,15 @@
+package rbac
+
+import "testing"
+
+func TestHasPermission(t *testing.T) {
+	if !HasPermission([]string{RoleAdmin}, PermUsersList) {
+		t.Fatalf("expected admin to list users")
+	}
+	if HasPermission(nil, PermUsersList) {
+		t.Fatalf("expected user without roles to be denied")
+	}
+	if HasPermission([]string{"unknown"}, PermUsersList) {
+		t.Fatalf("expected unknown role to be denied")
+	}
+}
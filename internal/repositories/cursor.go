@@ -0,0 +1,41 @@
+package repositories
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/rznas/zeus/internal/apperr"
+)
+
+// ErrInvalidCursor is returned for cursors that are malformed or were issued for a different sort order
+var ErrInvalidCursor = apperr.Invalid("invalid_cursor", "invalid cursor").
+	WithFields(map[string]string{"cursor": "invalid or issued for a different sort"})
+
+// cursor is the position after the last row of a page. It is opaque to
+// clients and bound to the sort it was issued for.
+type cursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s, sort string, desc bool) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != sort || c.Desc != desc || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
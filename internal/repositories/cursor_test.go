@@ -0,0 +1,27 @@
+package repositories
+
+import "testing"
+
+func TestCursorRoundTrip(t *testing.T) {
+	in := cursor{Sort: "created_at", Desc: true, Value: "2026-01-02T03:04:05.123456Z", ID: "8d0f5c9e-9f7e-4b53-9d4e-1f0b2a7c6d11"}
+	out, err := decodeCursor(encodeCursor(in), "created_at", true)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if *out != in {
+		t.Fatalf("expected %+v, got %+v", in, *out)
+	}
+}
+
+func TestCursorRejectsOtherSort(t *testing.T) {
+	c := encodeCursor(cursor{Sort: "created_at", Desc: true, Value: "x", ID: "id"})
+	if _, err := decodeCursor(c, "phone", true); err != ErrInvalidCursor {
+		t.Fatalf("expected ErrInvalidCursor for different field, got %v", err)
+	}
+	if _, err := decodeCursor(c, "created_at", false); err != ErrInvalidCursor {
+		t.Fatalf("expected ErrInvalidCursor for different direction, got %v", err)
+	}
+	if _, err := decodeCursor("not base64!", "created_at", true); err != ErrInvalidCursor {
+		t.Fatalf("expected ErrInvalidCursor for garbage, got %v", err)
+	}
+}
@@ -2,15 +2,116 @@ package repositories
 
 import (
 	"context"
+	"time"
 
+	"github.com/rznas/zeus/internal/apperr"
 	"github.com/rznas/zeus/internal/models"
 )
 
+var (
+	// ErrUserNotFound is returned when no user matches a lookup
+	ErrUserNotFound = apperr.NotFound("user_not_found", "user not found")
+	// ErrPhoneInUse is returned when an operation would give two active users the same phone
+	ErrPhoneInUse = apperr.Conflict("phone_in_use", "phone already registered")
+	// ErrEmailInUse is returned when an operation would give two active users the same verified email
+	ErrEmailInUse = apperr.Conflict("email_in_use", "email already registered")
+	// ErrTOTPNotFound is returned when the user has no authenticator app, confirmed or not
+	ErrTOTPNotFound = apperr.NotFound("totp_not_found", "no authenticator app enrolled")
+	// ErrWebAuthnCredentialNotFound is returned when no passkey matches a lookup
+	ErrWebAuthnCredentialNotFound = apperr.NotFound("passkey_not_found", "passkey not found")
+	// ErrOAuthClientNotFound is returned when no OpenID Connect client matches a lookup
+	ErrOAuthClientNotFound = apperr.NotFound("client_not_found", "client not found")
+	// ErrConsentNotFound is returned when the user never consented to the client
+	ErrConsentNotFound = apperr.NotFound("consent_not_found", "consent not found")
+)
+
+// User statuses accepted by UserFilter.Status
+const (
+	UserStatusActive  = "active"
+	UserStatusBlocked = "blocked"
+	UserStatusDeleted = "deleted"
+)
+
+// UserSortFields are the columns users can be sorted by
+var UserSortFields = []string{"created_at", "updated_at", "phone"}
+
+// UserFilter narrows down a user listing. Zero values do not filter.
+type UserFilter struct {
+	PhonePrefix    string
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+	Status         string
+	IncludeDeleted bool
+}
+
+// ListUsersOptions selects one page of users. Pages are addressed by the
+// opaque cursor returned with the previous page rather than by offset.
+type ListUsersOptions struct {
+	Filter    UserFilter
+	SortBy    string // one of UserSortFields, defaults to created_at
+	Desc      bool
+	Cursor    string
+	Limit     int
+	WithTotal bool // include the planner's estimate of the matching rows
+}
+
+// UserPage is a page of users. NextCursor is empty on the last page.
+type UserPage struct {
+	Users          []models.User
+	NextCursor     string
+	EstimatedTotal *int64
+}
+
 type UserRepository interface {
 	Create(ctx context.Context, user *models.User) error
 	GetByID(ctx context.Context, id string) (*models.User, error)
 	GetByPhone(ctx context.Context, phone string) (*models.User, error)
-	List(ctx context.Context, page, pageSize int) ([]models.User, int64, error)
+	GetByEmail(ctx context.Context, email string) (*models.User, error)
+	List(ctx context.Context, opts ListUsersOptions) (*UserPage, error)
 	Update(ctx context.Context, user *models.User) error
 	Delete(ctx context.Context, id string) error
+	Restore(ctx context.Context, id string) (*models.User, error)
+	ListRoles(ctx context.Context, userID string) ([]string, error)
+	AddRole(ctx context.Context, userID, role string) error
+	RemoveRole(ctx context.Context, userID, role string) error
+}
+
+// MFARepository stores the second factors of users
+type MFARepository interface {
+	GetTOTP(ctx context.Context, userID string) (*models.UserTOTP, error)
+	// SaveTOTP creates or replaces the authenticator app of totp.UserID and
+	// drops its recovery codes
+	SaveTOTP(ctx context.Context, totp *models.UserTOTP) error
+	// ConfirmTOTP enables the authenticator app and stores its recovery codes
+	ConfirmTOTP(ctx context.Context, userID string, codeHashes []string) error
+	DeleteTOTP(ctx context.Context, userID string) error
+	// ReplaceRecoveryCodes drops all recovery codes, used or not, for new ones
+	ReplaceRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error
+	// UseRecoveryCode marks an unused code as used and reports whether there was one
+	UseRecoveryCode(ctx context.Context, userID, codeHash string) (bool, error)
+	CountRecoveryCodes(ctx context.Context, userID string) (int64, error)
+}
+
+// WebAuthnRepository stores the passkeys of users
+type WebAuthnRepository interface {
+	ListByUser(ctx context.Context, userID string) ([]models.WebAuthnCredential, error)
+	GetByCredentialID(ctx context.Context, credentialID []byte) (*models.WebAuthnCredential, error)
+	Create(ctx context.Context, cred *models.WebAuthnCredential) error
+	// UpdateUsage stores the sign count and backup state of a successful login
+	UpdateUsage(ctx context.Context, cred *models.WebAuthnCredential) error
+	// Delete removes the passkey id of the user, ErrWebAuthnCredentialNotFound if they have none by that id
+	Delete(ctx context.Context, userID, id string) error
+}
+
+// OAuthRepository stores the OpenID Connect clients and the consents users gave them
+type OAuthRepository interface {
+	ListClients(ctx context.Context) ([]models.OAuthClient, error)
+	GetClient(ctx context.Context, id string) (*models.OAuthClient, error)
+	CreateClient(ctx context.Context, client *models.OAuthClient) error
+	UpdateClient(ctx context.Context, client *models.OAuthClient) error
+	// DeleteClient removes the client and the consents given to it
+	DeleteClient(ctx context.Context, id string) error
+	GetConsent(ctx context.Context, userID, clientID string) (*models.OAuthConsent, error)
+	// SaveConsent creates or replaces the consent of consent.UserID to consent.ClientID
+	SaveConsent(ctx context.Context, consent *models.OAuthConsent) error
 }
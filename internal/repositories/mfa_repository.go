@@ -0,0 +1,138 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rznas/zeus/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type mfaRepository struct {
+	db *gorm.DB
+}
+
+func NewMFARepository(db *gorm.DB) MFARepository {
+	return &mfaRepository{db: db}
+}
+
+func (r *mfaRepository) GetTOTP(ctx context.Context, userID string) (*models.UserTOTP, error) {
+	if userID == "" {
+		return nil, errors.New("user id cannot be empty")
+	}
+
+	var totp models.UserTOTP
+	err := r.db.WithContext(ctx).Where("user_id = ?", userID).First(&totp).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTOTPNotFound
+		}
+		return nil, err
+	}
+
+	return &totp, nil
+}
+
+func (r *mfaRepository) SaveTOTP(ctx context.Context, totp *models.UserTOTP) error {
+	if totp == nil || totp.UserID == uuid.Nil {
+		return errors.New("totp and its user id cannot be empty")
+	}
+
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", totp.UserID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"secret", "confirmed_at", "updated_at"}),
+		}).Create(totp).Error
+	})
+}
+
+func (r *mfaRepository) ConfirmTOTP(ctx context.Context, userID string, codeHashes []string) error {
+	if userID == "" {
+		return errors.New("user id cannot be empty")
+	}
+
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.UserTOTP{}).
+			Where("user_id = ? AND confirmed_at IS NULL", userID).
+			Update("confirmed_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		// confirmed in the meantime, or replaced by a new enrollment and gone
+		if res.RowsAffected == 0 {
+			return ErrTOTPNotFound
+		}
+		return replaceRecoveryCodes(tx, userID, codeHashes)
+	})
+}
+
+func (r *mfaRepository) DeleteTOTP(ctx context.Context, userID string) error {
+	if userID == "" {
+		return errors.New("user id cannot be empty")
+	}
+
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.UserTOTP{}).Error
+	})
+}
+
+func (r *mfaRepository) ReplaceRecoveryCodes(ctx context.Context, userID string, codeHashes []string) error {
+	if userID == "" {
+		return errors.New("user id cannot be empty")
+	}
+
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userID, codeHashes)
+	})
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID string, codeHashes []string) error {
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+	if len(codeHashes) == 0 {
+		return nil
+	}
+	codes := make([]models.RecoveryCode, len(codeHashes))
+	for i, h := range codeHashes {
+		codes[i] = models.RecoveryCode{UserID: uid, CodeHash: h}
+	}
+	return tx.Create(&codes).Error
+}
+
+func (r *mfaRepository) UseRecoveryCode(ctx context.Context, userID, codeHash string) (bool, error) {
+	if userID == "" || codeHash == "" {
+		return false, errors.New("user id and code cannot be empty")
+	}
+
+	// the condition on used_at makes concurrent uses of one code race for a single row
+	res := r.db.WithContext(ctx).Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	return res.RowsAffected == 1, res.Error
+}
+
+func (r *mfaRepository) CountRecoveryCodes(ctx context.Context, userID string) (int64, error) {
+	if userID == "" {
+		return 0, errors.New("user id cannot be empty")
+	}
+
+	var n int64
+	err := r.db.WithContext(ctx).Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Count(&n).Error
+	return n, err
+}
@@ -0,0 +1,115 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/rznas/zeus/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type oauthRepository struct {
+	db *gorm.DB
+}
+
+func NewOAuthRepository(db *gorm.DB) OAuthRepository {
+	return &oauthRepository{db: db}
+}
+
+func (r *oauthRepository) ListClients(ctx context.Context) ([]models.OAuthClient, error) {
+	var clients []models.OAuthClient
+	err := r.db.WithContext(ctx).Order("created_at").Find(&clients).Error
+	return clients, err
+}
+
+func (r *oauthRepository) GetClient(ctx context.Context, id string) (*models.OAuthClient, error) {
+	if id == "" {
+		return nil, errors.New("id cannot be empty")
+	}
+
+	var client models.OAuthClient
+	err := r.db.WithContext(ctx).Where("id = ?", id).First(&client).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrOAuthClientNotFound
+		}
+		return nil, err
+	}
+
+	return &client, nil
+}
+
+func (r *oauthRepository) CreateClient(ctx context.Context, client *models.OAuthClient) error {
+	if client == nil || client.ID == "" {
+		return errors.New("client and its id cannot be empty")
+	}
+
+	return r.db.WithContext(ctx).Create(client).Error
+}
+
+func (r *oauthRepository) UpdateClient(ctx context.Context, client *models.OAuthClient) error {
+	if client == nil || client.ID == "" {
+		return errors.New("client and its id cannot be empty")
+	}
+
+	res := r.db.WithContext(ctx).Model(client).
+		Select("name", "secret_hash", "redirect_uris", "trusted", "updated_at").
+		Updates(client)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrOAuthClientNotFound
+	}
+	return nil
+}
+
+func (r *oauthRepository) DeleteClient(ctx context.Context, id string) error {
+	if id == "" {
+		return errors.New("id cannot be empty")
+	}
+
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("client_id = ?", id).Delete(&models.OAuthConsent{}).Error; err != nil {
+			return err
+		}
+		res := tx.Where("id = ?", id).Delete(&models.OAuthClient{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrOAuthClientNotFound
+		}
+		return nil
+	})
+}
+
+func (r *oauthRepository) GetConsent(ctx context.Context, userID, clientID string) (*models.OAuthConsent, error) {
+	if userID == "" || clientID == "" {
+		return nil, errors.New("user id and client id cannot be empty")
+	}
+
+	var consent models.OAuthConsent
+	err := r.db.WithContext(ctx).Where("user_id = ? AND client_id = ?", userID, clientID).First(&consent).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrConsentNotFound
+		}
+		return nil, err
+	}
+
+	return &consent, nil
+}
+
+func (r *oauthRepository) SaveConsent(ctx context.Context, consent *models.OAuthConsent) error {
+	if consent == nil || consent.UserID == uuid.Nil || consent.ClientID == "" {
+		return errors.New("consent and its user and client ids cannot be empty")
+	}
+
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "client_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"scope", "updated_at"}),
+	}).Create(consent).Error
+}
@@ -2,19 +2,28 @@ package repositories
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"slices"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rznas/zeus/internal/email"
 	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/phone"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type userRepository struct {
-	db *gorm.DB
+	db     *gorm.DB
+	phones *phone.Parser
 }
 
-func NewUserRepository(db *gorm.DB) UserRepository {
-	return &userRepository{db: db}
+func NewUserRepository(db *gorm.DB, phones *phone.Parser) UserRepository {
+	return &userRepository{db: db, phones: phones}
 }
 
 func (r *userRepository) Create(ctx context.Context, user *models.User) error {
@@ -22,7 +31,9 @@ func (r *userRepository) Create(ctx context.Context, user *models.User) error {
 		return errors.New("user cannot be nil")
 	}
 
-	return r.db.WithContext(ctx).Create(user).Error
+	user.Phone = r.phones.Canonical(user.Phone)
+	user.Email = email.Canonical(user.Email)
+	return uniqueViolation(r.db.WithContext(ctx).Create(user).Error)
 }
 
 func (r *userRepository) GetByID(ctx context.Context, id string) (*models.User, error) {
@@ -34,7 +45,7 @@ func (r *userRepository) GetByID(ctx context.Context, id string) (*models.User,
 	err := r.db.WithContext(ctx).Where("id = ?", id).First(&user).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, nil
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
@@ -48,10 +59,10 @@ func (r *userRepository) GetByPhone(ctx context.Context, phone string) (*models.
 	}
 
 	var user models.User
-	err := r.db.WithContext(ctx).Where("phone = ?", phone).First(&user).Error
+	err := r.db.WithContext(ctx).Where("phone = ?", r.phones.Canonical(phone)).First(&user).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, nil
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
@@ -59,33 +70,149 @@ func (r *userRepository) GetByPhone(ctx context.Context, phone string) (*models.
 	return &user, nil
 }
 
-func (r *userRepository) List(ctx context.Context, page, pageSize int) ([]models.User, int64, error) {
-	if page < 1 {
-		page = 1
+// GetByEmail looks up an active user by email. Only a verified address is unique,
+// so the user who verified it is preferred over those who merely entered it.
+func (r *userRepository) GetByEmail(ctx context.Context, address string) (*models.User, error) {
+	address = email.Canonical(address)
+	if address == "" {
+		return nil, errors.New("email cannot be empty")
 	}
-	if pageSize < 1 {
-		pageSize = 10
+
+	var user models.User
+	err := r.db.WithContext(ctx).Where("email = ?", address).Order("email_verified_at IS NULL").Order("created_at").First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
 	}
 
-	var users []models.User
-	var total int64
+	return &user, nil
+}
+
+func (r *userRepository) List(ctx context.Context, opts ListUsersOptions) (*UserPage, error) {
+	if opts.Limit < 1 {
+		opts.Limit = 10
+	}
+	if opts.SortBy == "" {
+		opts.SortBy = "created_at"
+	}
+	if !slices.Contains(UserSortFields, opts.SortBy) {
+		return nil, fmt.Errorf("unsupported sort field %q", opts.SortBy)
+	}
+
+	query := r.filteredUsers(ctx, opts.Filter)
 
-	// Count total records
-	if err := r.db.WithContext(ctx).Model(&models.User{}).Count(&total).Error; err != nil {
-		return nil, 0, err
+	var total *int64
+	if opts.WithTotal {
+		estimate, err := r.estimateRows(query)
+		if err != nil {
+			return nil, err
+		}
+		total = &estimate
 	}
 
-	// Calculate offset
-	offset := (page - 1) * pageSize
+	dir, cmp := "ASC", ">"
+	if opts.Desc {
+		dir, cmp = "DESC", "<"
+	}
+	if opts.Cursor != "" {
+		cur, err := decodeCursor(opts.Cursor, opts.SortBy, opts.Desc)
+		if err != nil {
+			return nil, err
+		}
+		var value any = cur.Value
+		if opts.SortBy != "phone" {
+			t, err := time.Parse(time.RFC3339Nano, cur.Value)
+			if err != nil {
+				return nil, ErrInvalidCursor
+			}
+			value = t
+		}
+		// row comparison keeps the keyset stable when sort values tie
+		query = query.Where(fmt.Sprintf("(%s, id) %s (?, ?)", opts.SortBy, cmp), value, cur.ID)
+	}
 
-	// Get paginated results
-	err := r.db.WithContext(ctx).
-		Offset(offset).
-		Limit(pageSize).
-		Order("created_at DESC").
+	var users []models.User
+	err := query.
+		Order(fmt.Sprintf("%s %s, id %s", opts.SortBy, dir, dir)).
+		Limit(opts.Limit + 1).
 		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	page := &UserPage{Users: users, EstimatedTotal: total}
+	if len(users) > opts.Limit {
+		page.Users = users[:opts.Limit]
+		last := page.Users[opts.Limit-1]
+		page.NextCursor = encodeCursor(cursor{
+			Sort:  opts.SortBy,
+			Desc:  opts.Desc,
+			Value: sortValue(last, opts.SortBy),
+			ID:    last.ID.String(),
+		})
+	}
+	return page, nil
+}
+
+func (r *userRepository) filteredUsers(ctx context.Context, f UserFilter) *gorm.DB {
+	query := r.db.WithContext(ctx).Model(&models.User{})
+	if f.IncludeDeleted || f.Status == UserStatusDeleted {
+		query = query.Unscoped()
+	}
+	if f.PhonePrefix != "" {
+		query = query.Where("phone LIKE ?", f.PhonePrefix+"%")
+	}
+	if f.CreatedAfter != nil {
+		query = query.Where("created_at >= ?", *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		query = query.Where("created_at < ?", *f.CreatedBefore)
+	}
+	switch f.Status {
+	case UserStatusActive:
+		query = query.Where("blocked_at IS NULL AND deleted_at IS NULL")
+	case UserStatusBlocked:
+		query = query.Where("blocked_at IS NOT NULL")
+	case UserStatusDeleted:
+		query = query.Where("deleted_at IS NOT NULL")
+	}
+	return query
+}
+
+// estimateRows asks the Postgres planner how many rows the query matches,
+// which is far cheaper than COUNT(*) on a large table
+func (r *userRepository) estimateRows(query *gorm.DB) (int64, error) {
+	stmt := query.Session(&gorm.Session{DryRun: true}).Find(&[]models.User{}).Statement
 
-	return users, total, err
+	var plan string
+	if err := r.db.WithContext(stmt.Context).Raw("EXPLAIN (FORMAT JSON) "+stmt.SQL.String(), stmt.Vars...).Scan(&plan).Error; err != nil {
+		return 0, err
+	}
+	var parsed []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal([]byte(plan), &parsed); err != nil {
+		return 0, err
+	}
+	if len(parsed) == 0 {
+		return 0, errors.New("empty explain output")
+	}
+	return int64(parsed[0].Plan.Rows), nil
+}
+
+func sortValue(u models.User, field string) string {
+	switch field {
+	case "updated_at":
+		return u.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	case "phone":
+		return u.Phone
+	default:
+		return u.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
 }
 
 func (r *userRepository) Update(ctx context.Context, user *models.User) error {
@@ -97,7 +224,24 @@ func (r *userRepository) Update(ctx context.Context, user *models.User) error {
 		return errors.New("user ID cannot be nil")
 	}
 
-	return r.db.WithContext(ctx).Save(user).Error
+	user.Email = email.Canonical(user.Email)
+	return uniqueViolation(r.db.WithContext(ctx).Save(user).Error)
+}
+
+// uniqueViolation reports a write that lost the race for a phone or email to a
+// concurrent one as ErrPhoneInUse or ErrEmailInUse, the callers check first
+func uniqueViolation(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+		return err
+	}
+	switch pgErr.ConstraintName {
+	case "idx_users_phone_active":
+		return ErrPhoneInUse
+	case "idx_users_email_active":
+		return ErrEmailInUse
+	}
+	return err
 }
 
 func (r *userRepository) Delete(ctx context.Context, id string) error {
@@ -107,3 +251,82 @@ func (r *userRepository) Delete(ctx context.Context, id string) error {
 
 	return r.db.WithContext(ctx).Where("id = ?", id).Delete(&models.User{}).Error
 }
+
+// Restore undeletes a soft-deleted user. It returns ErrUserNotFound if no deleted user has
+// the id and ErrPhoneInUse or ErrEmailInUse if the phone or verified email was registered
+// again in the meantime.
+func (r *userRepository) Restore(ctx context.Context, id string) (*models.User, error) {
+	if id == "" {
+		return nil, errors.New("id cannot be empty")
+	}
+
+	var user models.User
+	err := r.db.WithContext(ctx).Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	var taken int64
+	if err := r.db.WithContext(ctx).Model(&models.User{}).Where("phone = ?", user.Phone).Count(&taken).Error; err != nil {
+		return nil, err
+	}
+	if taken > 0 {
+		return nil, ErrPhoneInUse
+	}
+	if user.Email != "" && user.EmailVerifiedAt != nil {
+		if err := r.db.WithContext(ctx).Model(&models.User{}).Where("email = ? AND email_verified_at IS NOT NULL", user.Email).Count(&taken).Error; err != nil {
+			return nil, err
+		}
+		if taken > 0 {
+			return nil, ErrEmailInUse
+		}
+	}
+
+	if err := r.db.WithContext(ctx).Unscoped().Model(&user).Update("deleted_at", nil).Error; err != nil {
+		return nil, err
+	}
+	user.DeletedAt = gorm.DeletedAt{}
+
+	return &user, nil
+}
+
+func (r *userRepository) ListRoles(ctx context.Context, userID string) ([]string, error) {
+	if userID == "" {
+		return nil, errors.New("user id cannot be empty")
+	}
+
+	var roles []string
+	err := r.db.WithContext(ctx).
+		Model(&models.UserRole{}).
+		Where("user_id = ?", userID).
+		Order("role").
+		Pluck("role", &roles).Error
+
+	return roles, err
+}
+
+func (r *userRepository) AddRole(ctx context.Context, userID, role string) error {
+	if userID == "" || role == "" {
+		return errors.New("user id and role cannot be empty")
+	}
+
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return err
+	}
+
+	return r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.UserRole{UserID: uid, Role: role}).Error
+}
+
+func (r *userRepository) RemoveRole(ctx context.Context, userID, role string) error {
+	if userID == "" || role == "" {
+		return errors.New("user id and role cannot be empty")
+	}
+
+	return r.db.WithContext(ctx).Where("user_id = ? AND role = ?", userID, role).Delete(&models.UserRole{}).Error
+}
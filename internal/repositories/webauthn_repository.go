@@ -0,0 +1,89 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rznas/zeus/internal/models"
+	"gorm.io/gorm"
+)
+
+type webAuthnRepository struct {
+	db *gorm.DB
+}
+
+func NewWebAuthnRepository(db *gorm.DB) WebAuthnRepository {
+	return &webAuthnRepository{db: db}
+}
+
+func (r *webAuthnRepository) ListByUser(ctx context.Context, userID string) ([]models.WebAuthnCredential, error) {
+	if userID == "" {
+		return nil, errors.New("user id cannot be empty")
+	}
+
+	var creds []models.WebAuthnCredential
+	err := r.db.WithContext(ctx).Where("user_id = ?", userID).Order("created_at").Find(&creds).Error
+	return creds, err
+}
+
+func (r *webAuthnRepository) GetByCredentialID(ctx context.Context, credentialID []byte) (*models.WebAuthnCredential, error) {
+	if len(credentialID) == 0 {
+		return nil, errors.New("credential id cannot be empty")
+	}
+
+	var cred models.WebAuthnCredential
+	err := r.db.WithContext(ctx).Where("credential_id = ?", credentialID).First(&cred).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWebAuthnCredentialNotFound
+		}
+		return nil, err
+	}
+
+	return &cred, nil
+}
+
+func (r *webAuthnRepository) Create(ctx context.Context, cred *models.WebAuthnCredential) error {
+	if cred == nil || cred.UserID == uuid.Nil || len(cred.CredentialID) == 0 {
+		return errors.New("credential and its user and credential ids cannot be empty")
+	}
+
+	return r.db.WithContext(ctx).Create(cred).Error
+}
+
+func (r *webAuthnRepository) UpdateUsage(ctx context.Context, cred *models.WebAuthnCredential) error {
+	if cred == nil || cred.ID == uuid.Nil {
+		return errors.New("credential and its id cannot be empty")
+	}
+
+	now := time.Now()
+	err := r.db.WithContext(ctx).Model(&models.WebAuthnCredential{}).
+		Where("id = ?", cred.ID).
+		Updates(map[string]any{
+			"sign_count":   cred.SignCount,
+			"backup_state": cred.BackupState,
+			"last_used_at": now,
+		}).Error
+	if err != nil {
+		return err
+	}
+	cred.LastUsedAt = &now
+	return nil
+}
+
+func (r *webAuthnRepository) Delete(ctx context.Context, userID, id string) error {
+	if userID == "" || id == "" {
+		return errors.New("user id and id cannot be empty")
+	}
+
+	res := r.db.WithContext(ctx).Where("user_id = ? AND id = ?", userID, id).Delete(&models.WebAuthnCredential{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrWebAuthnCredentialNotFound
+	}
+	return nil
+}
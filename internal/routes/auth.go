@@ -2,65 +2,213 @@ package routes
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
+	"math"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"gorm.io/gorm"
 
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/email"
+	"github.com/rznas/zeus/internal/middleware"
 	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/phone"
+	"github.com/rznas/zeus/internal/ratelimit"
+	"github.com/rznas/zeus/internal/repositories"
 	"github.com/rznas/zeus/internal/services"
+	"github.com/rznas/zeus/internal/validation"
 )
 
 type AuthHandlers struct {
-	DB  *gorm.DB
-	OTP *services.OTPService
-	JWT *services.JWTService
-	Env string
+	Users       repositories.UserRepository
+	OTP         *services.OTPService
+	Phones      *phone.Parser
+	JWT         *services.JWTService
+	Refresh     *services.RefreshTokenService
+	Revocations *services.RevocationService
+	// EmailOTP and MagicLinks serve the email login, which is open to users
+	// with a verified email only
+	EmailOTP   *services.OTPService
+	MagicLinks *services.MagicLinks
+	// MFA holds back the tokens of users with a second factor until it is verified
+	MFA *services.MFAService
+	// WebAuthn signs users in with passkeys, which need neither SMS nor email
+	WebAuthn *services.WebAuthnService
+	Env      string
+	// Limiter enforces the per-route limits below
+	Limiter *ratelimit.Limiter
+	// VerifyPerIPMin limits OTP verification attempts per IP, zero disables it
+	VerifyPerIPMin int
+	// LoginPerPhoneHour limits code requests per phone or email, zero disables it
+	LoginPerPhoneHour int
+	Logger            *slog.Logger
 }
 
 type phoneReq struct {
-	Phone string `json:"phone"`
+	Phone string `json:"phone" validate:"required"`
 }
 
 type otpVerifyReq struct {
-	Phone string `json:"phone"`
-	Code  string `json:"code"`
+	Phone string `json:"phone" validate:"required"`
+	Code  string `json:"code" validate:"required,alphanum,max=16"`
+}
+
+type emailLoginReq struct {
+	Email string `json:"email" validate:"required,max=254,email"`
+}
+
+// emailVerifyReq carries either the code typed by the user or the token of a magic link
+type emailVerifyReq struct {
+	Email string `json:"email" validate:"required_without=Token,omitempty,max=254,email"`
+	Code  string `json:"code" validate:"required_with=Email,omitempty,alphanum,max=16"`
+	Token string `json:"token" validate:"required_without=Email,omitempty,max=1024"`
+}
+
+type mfaVerifyReq struct {
+	MFAToken string `json:"mfa_token" validate:"required,max=128"`
+	// Code is from the authenticator app, or one of the recovery codes
+	Code string `json:"code" validate:"required,max=16"`
+}
+
+type refreshReq struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type tokenResp struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// mfaChallengeResp replaces tokenResp for users with a second factor
+type mfaChallengeResp struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// otpStatusResp tells clients when the code expires and what they may do next
+type otpStatusResp struct {
+	Sent               bool `json:"sent,omitempty"`
+	ExpiresInSeconds   int  `json:"expires_in_seconds"`
+	ResendAfterSeconds int  `json:"resend_after_seconds"`
+	SendsRemaining     int  `json:"sends_remaining"`
+	// omitted when wrong codes are not limited
+	AttemptsRemaining *int `json:"attempts_remaining,omitempty"`
+}
+
+func newOTPStatusResp(st services.OTPStatus) otpStatusResp {
+	resp := otpStatusResp{
+		ExpiresInSeconds:   ceilSeconds(st.ExpiresIn),
+		ResendAfterSeconds: ceilSeconds(st.ResendAfter),
+		SendsRemaining:     st.SendsRemaining,
+	}
+	if st.AttemptsRemaining >= 0 {
+		resp.AttemptsRemaining = &st.AttemptsRemaining
+	}
+	return resp
+}
+
+// extensions returns the members added to OTP errors
+func (r otpStatusResp) extensions() map[string]any {
+	ext := map[string]any{
+		"expires_in_seconds":   r.ExpiresInSeconds,
+		"resend_after_seconds": r.ResendAfterSeconds,
+		"sends_remaining":      r.SendsRemaining,
+	}
+	if r.AttemptsRemaining != nil {
+		ext["attempts_remaining"] = *r.AttemptsRemaining
+	}
+	return ext
+}
+
+// ceilSeconds rounds up so clients never retry too early
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
 
 func (h *AuthHandlers) RegisterRoutes(r fiber.Router) {
 	// Merge login with OTP request
-	r.Post("/login", h.requestOTP)
-	r.Post("/otp/verify", h.verifyOTP)
+	r.Post("/login", middleware.RateLimit(h.Limiter, middleware.RateLimitConfig{
+		Name:   "otp_login",
+		Limit:  ratelimit.PerHour(h.LoginPerPhoneHour),
+		Key:    middleware.KeyByPhone(h.Phones),
+		Logger: h.Logger,
+	}), h.requestOTP)
+	// a single client must not spray guesses across many phone numbers
+	r.Post("/otp/verify", middleware.RateLimit(h.Limiter, middleware.RateLimitConfig{
+		Name:   "otp_verify",
+		Limit:  ratelimit.PerMinute(h.VerifyPerIPMin),
+		Key:    middleware.KeyByIP,
+		Err:    middleware.ErrTooManyAttempts,
+		Logger: h.Logger,
+	}), h.verifyOTP)
+	r.Post("/email/login", middleware.RateLimit(h.Limiter, middleware.RateLimitConfig{
+		Name:   "email_login",
+		Limit:  ratelimit.PerHour(h.LoginPerPhoneHour),
+		Key:    middleware.KeyByEmail,
+		Logger: h.Logger,
+	}), h.requestEmailOTP)
+	r.Post("/email/verify", middleware.RateLimit(h.Limiter, middleware.RateLimitConfig{
+		Name:   "email_verify",
+		Limit:  ratelimit.PerMinute(h.VerifyPerIPMin),
+		Key:    middleware.KeyByIP,
+		Err:    middleware.ErrTooManyAttempts,
+		Logger: h.Logger,
+	}), h.verifyEmailOTP)
+	r.Post("/mfa/verify", middleware.RateLimit(h.Limiter, middleware.RateLimitConfig{
+		Name:   "mfa_verify",
+		Limit:  ratelimit.PerMinute(h.VerifyPerIPMin),
+		Key:    middleware.KeyByIP,
+		Err:    middleware.ErrTooManyAttempts,
+		Logger: h.Logger,
+	}), h.verifyMFA)
+	h.registerWebAuthnRoutes(r)
+	r.Post("/refresh", h.refresh)
 }
 
-func normalizePhone(p string) string { return strings.TrimSpace(p) }
+// RegisterProtectedRoutes registers the auth routes that require a valid access token
+func (h *AuthHandlers) RegisterProtectedRoutes(r fiber.Router) {
+	r.Post("/logout", h.logout)
+	r.Post("/logout/all", h.logoutAll)
+	h.registerProtectedWebAuthnRoutes(r)
+}
 
 // requestOTP
 // @Summary Login (request OTP)
 // @Tags Auth
 // @Accept json
 // @Produce json
+// @Description Sends a code to the phone. The response, and any error about the code, tells when it expires, when another may be requested and how many sends and wrong codes are left.
 // @Param data body phoneReq true "Phone"
-// @Success 200 {object} map[string]any
+// @Success 200 {object} otpStatusResp
 // @Router /api/auth/login [post]
 func (h *AuthHandlers) requestOTP(c *fiber.Ctx) error {
 	var req phoneReq
-	if err := c.BodyParser(&req); err != nil || req.Phone == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "phone required"})
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
 	}
-	phone := normalizePhone(req.Phone)
-	code, err := h.OTP.Generate(c.Context(), phone)
+	// canonical E.164 so every spelling of a number maps to the same user
+	phone, err := normalizePhone(h.Phones, "phone", req.Phone)
 	if err != nil {
-		if err == services.ErrRateLimitExceeded {
-			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "rate limit exceeded, please try again later"})
+		return err
+	}
+	if _, err := h.OTP.Generate(c.UserContext(), services.PurposeLogin, phone); err != nil {
+		if errors.Is(err, services.ErrDeliveryFailed) {
+			h.Logger.ErrorContext(c.UserContext(), "otp delivery failed", "phone", phone, "error", err)
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "otp error"})
+		return withOTPStatus(c, h.Logger, h.OTP, services.PurposeLogin, phone, err)
 	}
-	if h.Env == "development" {
-		log.Printf("DEV OTP for %s: %s", phone, code)
+	st, err := h.OTP.Status(c.UserContext(), services.PurposeLogin, phone)
+	if err != nil {
+		return err
 	}
-	return c.JSON(fiber.Map{"sent": true})
+	resp := newOTPStatusResp(st)
+	resp.Sent = true
+	return c.JSON(resp)
 }
 
 // verifyOTP
@@ -68,27 +216,322 @@ func (h *AuthHandlers) requestOTP(c *fiber.Ctx) error {
 // @Tags Auth
 // @Accept json
 // @Produce json
+// @Description A wrong or expired code is answered with a problem that carries the same members as the login response. Users with an authenticator app get a challenge (mfa_required, mfa_token, expires_in) instead of tokens, to be completed at /api/auth/mfa/verify.
 // @Param data body otpVerifyReq true "Verify"
-// @Success 200 {object} map[string]string
+// @Success 200 {object} tokenResp
 // @Router /api/auth/otp/verify [post]
 func (h *AuthHandlers) verifyOTP(c *fiber.Ctx) error {
 	var req otpVerifyReq
-	if err := c.BodyParser(&req); err != nil || req.Phone == "" || req.Code == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "phone and code required"})
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	// canonical E.164 so every spelling of a number maps to the same user
+	phone, err := normalizePhone(h.Phones, "phone", req.Phone)
+	if err != nil {
+		return err
+	}
+	if err := h.OTP.Verify(c.UserContext(), services.PurposeLogin, phone, req.Code); err != nil {
+		return withOTPStatus(c, h.Logger, h.OTP, services.PurposeLogin, phone, err)
+	}
+	u, err := h.userByPhone(c.UserContext(), phone)
+	if err != nil {
+		return err
+	}
+	if u.BlockedAt != nil {
+		return errAccountBlocked
+	}
+	return h.login(c, u)
+}
+
+// userByPhone returns the user with the phone, registering one on the first
+// login. Of two concurrent first logins one creates the user and the other
+// finds it once its own insert ran into the unique phone.
+func (h *AuthHandlers) userByPhone(ctx context.Context, phone string) (*models.User, error) {
+	u, err := h.Users.GetByPhone(ctx, phone)
+	if !errors.Is(err, repositories.ErrUserNotFound) {
+		return u, err
+	}
+	u = &models.User{Phone: phone}
+	err = h.Users.Create(ctx, u)
+	if errors.Is(err, repositories.ErrPhoneInUse) {
+		return h.Users.GetByPhone(ctx, phone)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// requestEmailOTP
+// @Summary Login by email (request code and magic link)
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Description Emails a code and a magic link to a verified address. Unknown and unverified addresses get the same response without an email, so the endpoint doesn't reveal who has an account.
+// @Param data body emailLoginReq true "Email"
+// @Success 200 {object} map[string]bool
+// @Router /api/auth/email/login [post]
+func (h *AuthHandlers) requestEmailOTP(c *fiber.Ctx) error {
+	var req emailLoginReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	u, err := h.Users.GetByEmail(c.UserContext(), req.Email)
+	if errors.Is(err, repositories.ErrUserNotFound) || err == nil && u.EmailVerifiedAt == nil {
+		return c.JSON(fiber.Map{"sent": true})
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := h.EmailOTP.Generate(c.UserContext(), services.PurposeLogin, req.Email); err != nil {
+		if errors.Is(err, services.ErrDeliveryFailed) {
+			h.Logger.ErrorContext(c.UserContext(), "otp delivery failed", "email", req.Email, "error", err)
+		}
+		return err
+	}
+	return c.JSON(fiber.Map{"sent": true})
+}
+
+// verifyEmailOTP
+// @Summary Verify email code or magic link (login)
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Description Takes either the email and the code from the message, or the token of the magic link. Unlike SMS login it never creates a user. Users with an authenticator app get an mfa_required challenge instead of tokens.
+// @Param data body emailVerifyReq true "Verify"
+// @Success 200 {object} tokenResp
+// @Router /api/auth/email/verify [post]
+func (h *AuthHandlers) verifyEmailOTP(c *fiber.Ctx) error {
+	var req emailVerifyReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	addr, code := req.Email, req.Code
+	if req.Token != "" {
+		var err error
+		if addr, code, err = h.MagicLinks.Parse(req.Token); err != nil {
+			return err
+		}
+	}
+	// no code is ever sent to unknown addresses, so they fail here like expired codes
+	if err := h.EmailOTP.Verify(c.UserContext(), services.PurposeLogin, addr, code); err != nil {
+		return withOTPStatus(c, h.Logger, h.EmailOTP, services.PurposeLogin, addr, err)
+	}
+	u, err := h.Users.GetByEmail(c.UserContext(), addr)
+	// the address may have changed hands since the code was sent
+	if errors.Is(err, repositories.ErrUserNotFound) || err == nil && u.EmailVerifiedAt == nil {
+		return services.ErrOTPExpired
+	}
+	if err != nil {
+		return err
+	}
+	if u.BlockedAt != nil {
+		return errAccountBlocked
+	}
+	return h.login(c, u)
+}
+
+// verifyMFA
+// @Summary Verify second factor (login)
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Description Completes a login that answered with mfa_required, using a code from the authenticator app or a recovery code. A wrong code leaves the challenge open until it expires; too many wrong codes lock the second factor.
+// @Param data body mfaVerifyReq true "Verify"
+// @Success 200 {object} tokenResp
+// @Router /api/auth/mfa/verify [post]
+func (h *AuthHandlers) verifyMFA(c *fiber.Ctx) error {
+	var req mfaVerifyReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	uid, err := h.MFA.CompleteChallenge(c.UserContext(), req.MFAToken, req.Code)
+	if err != nil {
+		return err
+	}
+	// the user may have been deleted or blocked since the first factor
+	u, err := h.Users.GetByID(c.UserContext(), uid.String())
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return services.ErrInvalidMFAToken
+	}
+	if err != nil {
+		return err
+	}
+	if u.BlockedAt != nil {
+		return errAccountBlocked
+	}
+	refreshToken, err := h.Refresh.Issue(c.UserContext(), u.ID)
+	if err != nil {
+		return err
+	}
+	return h.respondTokens(c, refreshToken)
+}
+
+// refresh
+// @Summary Rotate refresh token
+// @Description Exchanges a refresh token for a new access/refresh pair. Each refresh token can be used once; replaying a used token revokes every token from the same login.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param data body refreshReq true "Refresh token"
+// @Success 200 {object} tokenResp
+// @Router /api/auth/refresh [post]
+func (h *AuthHandlers) refresh(c *fiber.Ctx) error {
+	var req refreshReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	refreshToken, err := h.Refresh.Rotate(c.UserContext(), req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, services.ErrRefreshTokenReused) {
+			h.Logger.WarnContext(c.UserContext(), "refresh token reuse detected, token family revoked", "ip", c.IP())
+		}
+		return err
+	}
+	// deleted users must not be able to keep their sessions alive
+	u, err := h.Users.GetByID(c.UserContext(), refreshToken.UserID.String())
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return services.ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return err
+	}
+	if u.BlockedAt != nil {
+		return errAccountBlocked
+	}
+	return h.respondTokens(c, refreshToken)
+}
+
+// logout
+// @Summary Logout current session
+// @Description Revokes the presented access token and the refresh tokens of the same session.
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} map[string]bool
+// @Security BearerAuth
+// @Router /api/auth/logout [post]
+func (h *AuthHandlers) logout(c *fiber.Ctx) error {
+	claims, ok := middleware.GetClaims(c)
+	if !ok {
+		return errUnauthorized
+	}
+	if claims.ExpiresAt != nil {
+		if err := h.Revocations.RevokeToken(c.UserContext(), claims.ID, claims.ExpiresAt.Time); err != nil {
+			return err
+		}
 	}
-	phone := normalizePhone(req.Phone)
-	ok, err := h.OTP.Verify(c.Context(), phone, req.Code)
-	if err != nil || !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid code"})
+	if claims.SessionID != "" {
+		if err := h.Refresh.RevokeFamily(c.UserContext(), claims.SessionID); err != nil {
+			return err
+		}
 	}
-	// Create user if not exists
-	u := models.User{Phone: phone}
-	if err := h.DB.WithContext(context.Background()).FirstOrCreate(&u, models.User{Phone: phone}).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	return c.JSON(fiber.Map{"logged_out": true})
+}
+
+// logoutAll
+// @Summary Logout all sessions
+// @Description Revokes every access and refresh token issued to the current user so far.
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} map[string]bool
+// @Security BearerAuth
+// @Router /api/auth/logout/all [post]
+func (h *AuthHandlers) logoutAll(c *fiber.Ctx) error {
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return errUnauthorized
 	}
-	tok, err := h.JWT.Generate(u.ID)
+	if err := h.Revocations.RevokeUser(c.UserContext(), uid); err != nil {
+		return err
+	}
+	if err := h.Refresh.RevokeUser(c.UserContext(), uid); err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"logged_out": true})
+}
+
+// login finishes a successful first factor: users with a second factor get a
+// challenge for /mfa/verify, everyone else their tokens
+func (h *AuthHandlers) login(c *fiber.Ctx, u *models.User) error {
+	enabled, err := h.MFA.Enabled(c.UserContext(), u.ID)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		token, err := h.MFA.Challenge(c.UserContext(), u.ID)
+		if err != nil {
+			return err
+		}
+		return c.JSON(mfaChallengeResp{
+			MFARequired: true,
+			MFAToken:    token,
+			ExpiresIn:   int(h.MFA.ChallengeTTL().Seconds()),
+		})
+	}
+	refreshToken, err := h.Refresh.Issue(c.UserContext(), u.ID)
+	if err != nil {
+		return err
+	}
+	return h.respondTokens(c, refreshToken)
+}
+
+func (h *AuthHandlers) respondTokens(c *fiber.Ctx, refreshToken *services.RefreshToken) error {
+	roles, err := h.Users.ListRoles(c.UserContext(), refreshToken.UserID.String())
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "jwt error"})
+		return err
+	}
+	tok, err := h.JWT.Generate(refreshToken.UserID, refreshToken.FamilyID, roles)
+	if err != nil {
+		return err
+	}
+	return c.JSON(tokenResp{
+		Token:        tok,
+		RefreshToken: refreshToken.Token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(h.JWT.TTL().Seconds()),
+	})
+}
+
+// Normalize canonicalizes the email so every spelling maps to the same user
+func (r *emailLoginReq) Normalize() {
+	r.Email = email.Canonical(r.Email)
+}
+
+// Normalize canonicalizes the email and trims the code and token
+func (r *emailVerifyReq) Normalize() {
+	r.Email = email.Canonical(r.Email)
+	r.Code = strings.TrimSpace(r.Code)
+	r.Token = strings.TrimSpace(r.Token)
+}
+
+// sendCode sends a code for purpose to "to" and responds with its status
+func sendCode(c *fiber.Ctx, logger *slog.Logger, otp *services.OTPService, purpose services.OTPPurpose, to string) error {
+	if _, err := otp.Generate(c.UserContext(), purpose, to); err != nil {
+		if errors.Is(err, services.ErrDeliveryFailed) {
+			logger.ErrorContext(c.UserContext(), "otp delivery failed", "to", to, "purpose", purpose, "error", err)
+		}
+		return withOTPStatus(c, logger, otp, purpose, to, err)
+	}
+	st, err := otp.Status(c.UserContext(), purpose, to)
+	if err != nil {
+		return err
+	}
+	resp := newOTPStatusResp(st)
+	resp.Sent = true
+	return c.JSON(resp)
+}
+
+// withOTPStatus adds the status of the code sent to "to" to an OTP error. The
+// error is returned as is if the status can't be read, it matters more than the hints.
+func withOTPStatus(c *fiber.Ctx, logger *slog.Logger, otp *services.OTPService, purpose services.OTPPurpose, to string, err error) error {
+	var appErr *apperr.Error
+	if !errors.As(err, &appErr) {
+		return err
+	}
+	st, statusErr := otp.Status(c.UserContext(), purpose, to)
+	if statusErr != nil {
+		logger.WarnContext(c.UserContext(), "otp status unavailable", "to", to, "error", statusErr)
+		return err
 	}
-	return c.JSON(fiber.Map{"token": tok})
+	return appErr.WithExtensions(newOTPStatusResp(st).extensions())
 }
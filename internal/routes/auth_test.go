@@ -0,0 +1,288 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/middleware"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/phone"
+	"github.com/rznas/zeus/internal/repositories"
+	"github.com/rznas/zeus/internal/services"
+	"github.com/rznas/zeus/internal/validation"
+)
+
+func TestOTPStatusResponses(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	phones := phone.NewParser("US")
+	h := &AuthHandlers{
+		OTP: services.NewOTPService(rdb, nil, phones, services.OTPOptions{
+			TTLSeconds:              300,
+			RateLimitPerMin:         3,
+			RateLimitTimeoutSeconds: 600,
+			ResendCooldownSeconds:   30,
+			MaxAttempts:             5,
+			LockoutSeconds:          300,
+		}),
+		Phones: phones,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	app := fiber.New(fiber.Config{ErrorHandler: middleware.ErrorHandler})
+	h.RegisterRoutes(app)
+
+	post := func(path, body string) (int, string, map[string]any) {
+		t.Helper()
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		var out map[string]any
+		if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return res.StatusCode, res.Header.Get(fiber.HeaderRetryAfter), out
+	}
+	expect := func(got map[string]any, want map[string]float64) {
+		t.Helper()
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s: expected %v, got %v", k, v, got[k])
+			}
+		}
+	}
+
+	status, _, body := post("/login", `{"phone": "+12025550100"}`)
+	if status != fiber.StatusOK || body["sent"] != true {
+		t.Fatalf("expected code to be sent, got %d %v", status, body)
+	}
+	expect(body, map[string]float64{"expires_in_seconds": 300, "resend_after_seconds": 30, "sends_remaining": 2, "attempts_remaining": 5})
+
+	status, retryAfter, body := post("/login", `{"phone": "+12025550100"}`)
+	if status != fiber.StatusTooManyRequests || retryAfter != "30" || body["code"] != "otp_resend_too_soon" {
+		t.Fatalf("expected cooldown, got %d %q %v", status, retryAfter, body)
+	}
+	expect(body, map[string]float64{"resend_after_seconds": 30, "retry_after": 30})
+
+	status, _, body = post("/otp/verify", `{"phone": "+12025550100", "code": "000000"}`)
+	if status != fiber.StatusUnauthorized || body["code"] != "otp_invalid" {
+		t.Fatalf("expected invalid code, got %d %v", status, body)
+	}
+	expect(body, map[string]float64{"expires_in_seconds": 300, "attempts_remaining": 4, "sends_remaining": 2})
+}
+
+func TestEmailVerifyReq_Validation(t *testing.T) {
+	cases := []struct {
+		req    emailVerifyReq
+		fields []string
+	}{
+		{emailVerifyReq{Email: " Ada@Example.com", Code: "123456"}, nil},
+		{emailVerifyReq{Token: "payload.signature"}, nil},
+		{emailVerifyReq{}, []string{"email", "token"}},
+		{emailVerifyReq{Email: "ada@example.com"}, []string{"code"}},
+		{emailVerifyReq{Email: "not an email", Code: "12-34"}, []string{"email", "code"}},
+	}
+	for _, tc := range cases {
+		fields := validation.Fields(&tc.req)
+		if len(fields) != len(tc.fields) {
+			t.Errorf("%+v: expected problems with %v, got %v", tc.req, tc.fields, fields)
+			continue
+		}
+		for _, name := range tc.fields {
+			if _, ok := fields[name]; !ok {
+				t.Errorf("%+v: expected %s to be rejected, got %v", tc.req, name, fields)
+			}
+		}
+	}
+
+	req := emailVerifyReq{Email: " Ada@Example.com "}
+	req.Normalize()
+	if req.Email != "ada@example.com" {
+		t.Errorf("expected canonical email, got %q", req.Email)
+	}
+}
+
+func TestVerifyMFA_UnknownChallenge(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	mfa, err := services.NewMFAService(nil, rdb, services.MFAOptions{Secret: []byte("test-mfa-secret")})
+	if err != nil {
+		t.Fatalf("new mfa service: %v", err)
+	}
+	h := &AuthHandlers{MFA: mfa, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	app := fiber.New(fiber.Config{ErrorHandler: middleware.ErrorHandler})
+	h.RegisterRoutes(app)
+
+	cases := map[string]struct {
+		body   string
+		status int
+		code   string
+	}{
+		"unknown token": {`{"mfa_token": "nope", "code": "123456"}`, fiber.StatusUnauthorized, "invalid_mfa_token"},
+		"missing code":  {`{"mfa_token": "nope"}`, fiber.StatusBadRequest, "validation_failed"},
+	}
+	for name, tc := range cases {
+		req := httptest.NewRequest("POST", "/mfa/verify", strings.NewReader(tc.body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("%s: request: %v", name, err)
+		}
+		var out map[string]any
+		if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+			t.Fatalf("%s: decode: %v", name, err)
+		}
+		if res.StatusCode != tc.status || out["code"] != tc.code {
+			t.Errorf("%s: expected %d %s, got %d %v", name, tc.status, tc.code, res.StatusCode, out)
+		}
+	}
+}
+
+func TestPasskeyLogin_Sessions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	wa, err := services.NewWebAuthnService(nil, rdb, services.WebAuthnOptions{RPID: "localhost", RPOrigins: []string{"http://localhost:3000"}})
+	if err != nil {
+		t.Fatalf("new webauthn service: %v", err)
+	}
+	h := &AuthHandlers{WebAuthn: wa, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	app := fiber.New(fiber.Config{ErrorHandler: middleware.ErrorHandler})
+	h.RegisterRoutes(app)
+
+	res, err := app.Test(httptest.NewRequest("POST", "/webauthn/login/begin", nil))
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	var begin struct {
+		SessionID string `json:"session_id"`
+		Options   struct {
+			PublicKey struct {
+				Challenge        string `json:"challenge"`
+				RPID             string `json:"rpId"`
+				UserVerification string `json:"userVerification"`
+			} `json:"publicKey"`
+		} `json:"options"`
+		ExpiresIn int `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&begin); err != nil {
+		t.Fatalf("decode begin: %v", err)
+	}
+	pk := begin.Options.PublicKey
+	if res.StatusCode != fiber.StatusOK || begin.SessionID == "" || pk.Challenge == "" || pk.RPID != "localhost" || pk.UserVerification != "required" || begin.ExpiresIn != 300 {
+		t.Fatalf("unexpected begin response %d %+v", res.StatusCode, begin)
+	}
+
+	cases := map[string]struct {
+		body   string
+		status int
+		code   string
+	}{
+		"unknown session":    {`{"session_id": "nope", "credential": {}}`, fiber.StatusUnauthorized, "invalid_webauthn_session"},
+		"garbled credential": {`{"session_id": "` + begin.SessionID + `", "credential": {"id": "x"}}`, fiber.StatusUnauthorized, "passkey_invalid"},
+		"missing credential": {`{"session_id": "nope"}`, fiber.StatusBadRequest, "validation_failed"},
+	}
+	for name, tc := range cases {
+		req := httptest.NewRequest("POST", "/webauthn/login/finish", strings.NewReader(tc.body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		res, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("%s: request: %v", name, err)
+		}
+		var out map[string]any
+		if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+			t.Fatalf("%s: decode: %v", name, err)
+		}
+		if res.StatusCode != tc.status || out["code"] != tc.code {
+			t.Errorf("%s: expected %d %s, got %d %v", name, tc.status, tc.code, res.StatusCode, out)
+		}
+	}
+}
+
+// lateUsers misses the user on the first phone lookup, as if a concurrent
+// first login created it right after
+type lateUsers struct {
+	*memoryUsers
+	missed bool
+}
+
+func (r *lateUsers) GetByPhone(ctx context.Context, p string) (*models.User, error) {
+	if !r.missed {
+		r.missed = true
+		return nil, repositories.ErrUserNotFound
+	}
+	return r.memoryUsers.GetByPhone(ctx, p)
+}
+
+// noTOTP is a repositories.MFARepository without enrolled apps
+type noTOTP struct {
+	repositories.MFARepository
+}
+
+func (noTOTP) GetTOTP(context.Context, string) (*models.UserTOTP, error) {
+	return nil, repositories.ErrTOTPNotFound
+}
+
+func TestVerifyOTP_ConcurrentFirstLogin(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	mfa, err := services.NewMFAService(noTOTP{}, rdb, services.MFAOptions{Secret: []byte("test-mfa-secret")})
+	if err != nil {
+		t.Fatalf("new mfa service: %v", err)
+	}
+	phones := phone.NewParser("US")
+	ada := &models.User{ID: uuid.New(), Phone: "+12025550100"}
+	users := newMemoryUsers(ada)
+	h := &AuthHandlers{
+		Users:   &lateUsers{memoryUsers: users},
+		OTP:     services.NewOTPService(rdb, nil, phones, services.OTPOptions{TTLSeconds: 60, RateLimitPerMin: 5, RateLimitTimeoutSeconds: 60}),
+		Phones:  phones,
+		JWT:     services.NewJWTService("secret", 15),
+		Refresh: services.NewRefreshTokenService(rdb, 1),
+		MFA:     mfa,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	app := fiber.New(fiber.Config{ErrorHandler: middleware.ErrorHandler})
+	h.RegisterRoutes(app)
+
+	// the insert loses against the other login and the user it created logs in
+	code, err := h.OTP.Generate(context.Background(), services.PurposeLogin, ada.Phone)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	status, out := call(t, app, "POST", "/otp/verify", `{"phone": "+12025550100", "code": "`+code+`"}`)
+	if status != fiber.StatusOK || out["token"] == nil {
+		t.Fatalf("expected tokens, got %d %v", status, out)
+	}
+	if len(users.users) != 1 {
+		t.Fatalf("expected no second user, got %d", len(users.users))
+	}
+	claims, err := h.JWT.Parse(out["token"].(string))
+	if err != nil || claims.UserID != ada.ID.String() {
+		t.Fatalf("expected a token of the existing user, got %+v %v", claims, err)
+	}
+
+	// a new phone registers a user
+	code, _ = h.OTP.Generate(context.Background(), services.PurposeLogin, "+14155552671")
+	if status, out := call(t, app, "POST", "/otp/verify", `{"phone": "+14155552671", "code": "`+code+`"}`); status != fiber.StatusOK {
+		t.Fatalf("expected tokens, got %d %v", status, out)
+	}
+	if len(users.users) != 2 {
+		t.Fatalf("expected the user to be registered, got %d users", len(users.users))
+	}
+}
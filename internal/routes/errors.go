@@ -0,0 +1,63 @@
+package routes
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/phone"
+	"github.com/rznas/zeus/internal/repositories"
+)
+
+// errors shared by several handlers, anything else comes from the services and
+// repositories or is reported as an internal error by middleware.ErrorHandler
+var (
+	errInvalidUserID  = apperr.Invalid("invalid_user_id", "invalid user id")
+	errUnauthorized   = apperr.Unauthorized("unauthorized", "unauthorized")
+	errAccountBlocked = apperr.Forbidden("account_blocked", "account blocked")
+	errUserNotDeleted = apperr.Conflict("user_not_deleted", "user is not deleted")
+)
+
+// normalizePhone converts a phone that passed validation to E.164, reporting
+// numbers the parser rejects as a validation error on the named field
+func normalizePhone(phones *phone.Parser, field, raw string) (string, error) {
+	p, err := phones.Normalize(raw)
+	if err != nil {
+		return "", apperr.Validation(map[string]string{field: err.Error()})
+	}
+	return p, nil
+}
+
+// checkPhoneFree returns ErrPhoneInUse if an active user other than exceptID already has the phone
+func checkPhoneFree(ctx context.Context, users repositories.UserRepository, p string, exceptID uuid.UUID) error {
+	existing, err := users.GetByPhone(ctx, p)
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.ID != exceptID {
+		return repositories.ErrPhoneInUse
+	}
+	return nil
+}
+
+// checkEmailFree returns ErrEmailInUse if an active user other than exceptID
+// verified the email. An unverified claim doesn't hold the address, or anyone
+// could lock its owner out by typing it into a profile.
+func checkEmailFree(ctx context.Context, users repositories.UserRepository, addr string, exceptID uuid.UUID) error {
+	existing, err := users.GetByEmail(ctx, addr)
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.ID != exceptID && existing.EmailVerifiedAt != nil {
+		return repositories.ErrEmailInUse
+	}
+	return nil
+}
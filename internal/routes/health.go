@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	redisv9 "github.com/redis/go-redis/v9"
+)
+
+// Pinger is implemented by *sql.DB
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// HealthHandlers serves the liveness and readiness probes
+type HealthHandlers struct {
+	DB      Pinger
+	Redis   *redisv9.Client
+	Timeout time.Duration // per dependency
+	Logger  *slog.Logger
+}
+
+type dependencyStatus struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type readinessResp struct {
+	Status string                      `json:"status"`
+	Checks map[string]dependencyStatus `json:"checks"`
+}
+
+func (h *HealthHandlers) RegisterRoutes(r fiber.Router) {
+	r.Get("/health", h.livez)
+	r.Get("/livez", h.livez)
+	r.Get("/readyz", h.readyz)
+}
+
+// livez
+// @Summary Liveness probe
+// @Description Reports that the process is up. It does not check dependencies.
+// @Tags Health
+// @Produce json
+// @Success 200 {object} map[string]string
+// @Router /livez [get]
+func (h *HealthHandlers) livez(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// readyz
+// @Summary Readiness probe
+// @Description Pings Postgres and Redis and reports the status of each. Responds 503 if any of them is unavailable.
+// @Tags Health
+// @Produce json
+// @Success 200 {object} readinessResp
+// @Failure 503 {object} readinessResp
+// @Router /readyz [get]
+func (h *HealthHandlers) readyz(c *fiber.Ctx) error {
+	checks := map[string]func(context.Context) error{
+		"postgres": h.DB.PingContext,
+		"redis":    func(ctx context.Context) error { return h.Redis.Ping(ctx).Err() },
+	}
+
+	resp := readinessResp{Status: "ok", Checks: make(map[string]dependencyStatus, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st := h.check(c.UserContext(), name, check)
+			mu.Lock()
+			resp.Checks[name] = st
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for _, st := range resp.Checks {
+		if st.Status != "ok" {
+			resp.Status = "unavailable"
+			return c.Status(fiber.StatusServiceUnavailable).JSON(resp)
+		}
+	}
+	return c.JSON(resp)
+}
+
+// check runs one ping under the timeout. The cause is only logged, the probe is public.
+func (h *HealthHandlers) check(parent context.Context, name string, check func(context.Context) error) dependencyStatus {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	st := dependencyStatus{Status: "ok", LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		h.Logger.WarnContext(parent, "readiness check failed", "dependency", name, "error", err)
+		st.Status = "unavailable"
+		st.Error = "ping failed"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			st.Error = "timeout"
+		}
+	}
+	return st
+}
@@ -0,0 +1,72 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	redisv9 "github.com/redis/go-redis/v9"
+)
+
+type pingFunc func(ctx context.Context) error
+
+func (f pingFunc) PingContext(ctx context.Context) error { return f(ctx) }
+
+func probe(t *testing.T, h *HealthHandlers) (int, readinessResp) {
+	t.Helper()
+	app := fiber.New()
+	h.RegisterRoutes(app)
+	res, err := app.Test(httptest.NewRequest("GET", "/readyz", nil), -1)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	var body readinessResp
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return res.StatusCode, body
+}
+
+func TestReadyz(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	h := &HealthHandlers{DB: pingFunc(func(context.Context) error { return nil }), Redis: rdb, Timeout: time.Second, Logger: slog.New(slog.DiscardHandler)}
+	status, body := probe(t, h)
+	if status != fiber.StatusOK || body.Status != "ok" || body.Checks["postgres"].Status != "ok" || body.Checks["redis"].Status != "ok" {
+		t.Fatalf("expected ready, got %d %+v", status, body)
+	}
+
+	mr.Close()
+	h.DB = pingFunc(func(context.Context) error { return errors.New("connection refused") })
+	status, body = probe(t, h)
+	if status != fiber.StatusServiceUnavailable || body.Status != "unavailable" {
+		t.Fatalf("expected unavailable, got %d %+v", status, body)
+	}
+	if body.Checks["postgres"].Error != "ping failed" || body.Checks["redis"].Status != "unavailable" {
+		t.Fatalf("unexpected checks %+v", body.Checks)
+	}
+}
+
+func TestReadyzTimeout(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	slow := pingFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	h := &HealthHandlers{DB: slow, Redis: rdb, Timeout: 50 * time.Millisecond, Logger: slog.New(slog.DiscardHandler)}
+	status, body := probe(t, h)
+	if status != fiber.StatusServiceUnavailable || body.Checks["postgres"].Error != "timeout" || body.Checks["redis"].Status != "ok" {
+		t.Fatalf("expected postgres timeout, got %d %+v", status, body)
+	}
+}
@@ -0,0 +1,333 @@
+package routes
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/language"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/email"
+	"github.com/rznas/zeus/internal/middleware"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/phone"
+	"github.com/rznas/zeus/internal/repositories"
+	"github.com/rznas/zeus/internal/services"
+	"github.com/rznas/zeus/internal/validation"
+)
+
+// MeHandlers serves the profile of the authenticated user
+type MeHandlers struct {
+	UserRepo    repositories.UserRepository
+	Refresh     *services.RefreshTokenService
+	Revocations *services.RevocationService
+	// EmailOTP sends the codes that confirm a profile email
+	EmailOTP *services.OTPService
+	// OTP sends the SMS codes that confirm a phone change or the deletion of the account
+	OTP    *services.OTPService
+	Phones *phone.Parser
+	Logger *slog.Logger
+}
+
+var (
+	errEmailNotSet          = apperr.Conflict("email_not_set", "no email address on the profile")
+	errEmailAlreadyVerified = apperr.Conflict("email_already_verified", "email address already verified")
+	errPhoneUnchanged       = apperr.Conflict("phone_unchanged", "phone is already the account's phone")
+)
+
+// codeReq carries a code sent to the user
+type codeReq struct {
+	Code string `json:"code" validate:"required,alphanum,max=16"`
+}
+
+// updateMeReq is a partial update: omitted fields are left unchanged, empty strings clear them
+type updateMeReq struct {
+	DisplayName *string `json:"display_name" validate:"omitnil,max=64"`
+	Email       *string `json:"email" validate:"omitzero,max=254,email"`
+	Locale      *string `json:"locale" validate:"omitzero,max=35,bcp47_language_tag"`
+	AvatarURL   *string `json:"avatar_url" validate:"omitzero,max=2048,http_url"`
+}
+
+func (h *MeHandlers) RegisterRoutes(r fiber.Router) {
+	r.Get("/me", h.getMe)
+	r.Patch("/me", h.updateMe)
+	r.Delete("/me", h.deleteMe)
+	r.Post("/me/delete/code", h.requestDeletionCode)
+	r.Post("/me/phone/code", h.requestPhoneCode)
+	r.Post("/me/phone/verify", h.verifyPhone)
+	r.Post("/me/email/code", h.requestEmailCode)
+	r.Post("/me/email/verify", h.verifyEmail)
+}
+
+// currentUser loads the user behind the access token
+func (h *MeHandlers) currentUser(c *fiber.Ctx) (*models.User, error) {
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return nil, errUnauthorized
+	}
+	return h.UserRepo.GetByID(c.UserContext(), uid.String())
+}
+
+// getMe
+// @Summary Get current user
+// @Tags Me
+// @Produce json
+// @Success 200 {object} models.User
+// @Security BearerAuth
+// @Router /api/me [get]
+func (h *MeHandlers) getMe(c *fiber.Ctx) error {
+	u, err := h.currentUser(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(u)
+}
+
+// updateMe
+// @Summary Update current user
+// @Description Partial update: omitted fields are left unchanged, empty strings clear them. Changing the email marks it unverified until it is confirmed with /api/me/email/verify.
+// @Tags Me
+// @Accept json
+// @Produce json
+// @Param data body updateMeReq true "Profile"
+// @Success 200 {object} models.User
+// @Security BearerAuth
+// @Router /api/me [patch]
+func (h *MeHandlers) updateMe(c *fiber.Ctx) error {
+	var req updateMeReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+
+	u, err := h.currentUser(c)
+	if err != nil {
+		return err
+	}
+	if req.Email != nil && *req.Email != "" && *req.Email != u.Email {
+		if err := checkEmailFree(c.UserContext(), h.UserRepo, *req.Email, u.ID); err != nil {
+			return err
+		}
+	}
+	req.apply(u)
+	if err := h.UserRepo.Update(c.UserContext(), u); err != nil {
+		return err
+	}
+	return c.JSON(u)
+}
+
+// deleteMe
+// @Summary Delete current user
+// @Description Deletes the account and revokes all of its tokens. Takes the code sent to the phone by /api/me/delete/code, so a stolen access token can't delete the account.
+// @Tags Me
+// @Accept json
+// @Param data body codeReq true "Code"
+// @Success 204
+// @Security BearerAuth
+// @Router /api/me [delete]
+func (h *MeHandlers) deleteMe(c *fiber.Ctx) error {
+	var req codeReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	u, err := h.currentUser(c)
+	if err != nil {
+		return err
+	}
+	if err := h.OTP.Verify(c.UserContext(), services.PurposeAccountDeletion, u.Phone, req.Code); err != nil {
+		return withOTPStatus(c, h.Logger, h.OTP, services.PurposeAccountDeletion, u.Phone, err)
+	}
+	if err := h.UserRepo.Delete(c.UserContext(), u.ID.String()); err != nil {
+		return err
+	}
+	if err := h.Revocations.RevokeUser(c.UserContext(), u.ID); err != nil {
+		return err
+	}
+	if err := h.Refresh.RevokeUser(c.UserContext(), u.ID); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// requestDeletionCode
+// @Summary Send account deletion code
+// @Description Sends the code that confirms DELETE /api/me to the phone of the account.
+// @Tags Me
+// @Produce json
+// @Success 200 {object} otpStatusResp
+// @Security BearerAuth
+// @Router /api/me/delete/code [post]
+func (h *MeHandlers) requestDeletionCode(c *fiber.Ctx) error {
+	u, err := h.currentUser(c)
+	if err != nil {
+		return err
+	}
+	return sendCode(c, h.Logger, h.OTP, services.PurposeAccountDeletion, u.Phone)
+}
+
+// requestPhoneCode
+// @Summary Send phone change code
+// @Description Sends a code to the new phone, which is taken over once the code is confirmed with /api/me/phone/verify.
+// @Tags Me
+// @Accept json
+// @Produce json
+// @Param data body phoneReq true "New phone"
+// @Success 200 {object} otpStatusResp
+// @Security BearerAuth
+// @Router /api/me/phone/code [post]
+func (h *MeHandlers) requestPhoneCode(c *fiber.Ctx) error {
+	var req phoneReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	p, err := normalizePhone(h.Phones, "phone", req.Phone)
+	if err != nil {
+		return err
+	}
+	u, err := h.currentUser(c)
+	if err != nil {
+		return err
+	}
+	if p == u.Phone {
+		return errPhoneUnchanged
+	}
+	if err := checkPhoneFree(c.UserContext(), h.UserRepo, p, u.ID); err != nil {
+		return err
+	}
+	return sendCode(c, h.Logger, h.OTP, services.PurposePhoneChange, p)
+}
+
+// verifyPhone
+// @Summary Change phone
+// @Description Makes the new phone the account's phone with the code sent to it by /api/me/phone/code. Logins use the new phone from then on.
+// @Tags Me
+// @Accept json
+// @Produce json
+// @Param data body otpVerifyReq true "New phone and code"
+// @Success 200 {object} models.User
+// @Security BearerAuth
+// @Router /api/me/phone/verify [post]
+func (h *MeHandlers) verifyPhone(c *fiber.Ctx) error {
+	var req otpVerifyReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	p, err := normalizePhone(h.Phones, "phone", req.Phone)
+	if err != nil {
+		return err
+	}
+	u, err := h.currentUser(c)
+	if err != nil {
+		return err
+	}
+	if err := h.OTP.Verify(c.UserContext(), services.PurposePhoneChange, p, req.Code); err != nil {
+		return withOTPStatus(c, h.Logger, h.OTP, services.PurposePhoneChange, p, err)
+	}
+	// someone may have taken the phone since the code was sent
+	if err := checkPhoneFree(c.UserContext(), h.UserRepo, p, u.ID); err != nil {
+		return err
+	}
+	u.Phone = p
+	if err := h.UserRepo.Update(c.UserContext(), u); err != nil {
+		return err
+	}
+	return c.JSON(u)
+}
+
+// requestEmailCode
+// @Summary Send email verification code
+// @Description Sends a code to the profile email. Email login is only possible once the address is verified.
+// @Tags Me
+// @Produce json
+// @Success 200 {object} otpStatusResp
+// @Security BearerAuth
+// @Router /api/me/email/code [post]
+func (h *MeHandlers) requestEmailCode(c *fiber.Ctx) error {
+	u, err := h.currentUser(c)
+	if err != nil {
+		return err
+	}
+	if u.Email == "" {
+		return errEmailNotSet
+	}
+	if u.EmailVerifiedAt != nil {
+		return errEmailAlreadyVerified
+	}
+	return sendCode(c, h.Logger, h.EmailOTP, services.PurposeEmailVerification, u.Email)
+}
+
+// verifyEmail
+// @Summary Verify email
+// @Description Confirms the profile email with the code sent by /api/me/email/code.
+// @Tags Me
+// @Accept json
+// @Produce json
+// @Param data body codeReq true "Code"
+// @Success 200 {object} models.User
+// @Security BearerAuth
+// @Router /api/me/email/verify [post]
+func (h *MeHandlers) verifyEmail(c *fiber.Ctx) error {
+	var req codeReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	u, err := h.currentUser(c)
+	if err != nil {
+		return err
+	}
+	if u.Email == "" {
+		return errEmailNotSet
+	}
+	if u.EmailVerifiedAt != nil {
+		return errEmailAlreadyVerified
+	}
+	if err := h.EmailOTP.Verify(c.UserContext(), services.PurposeEmailVerification, u.Email, req.Code); err != nil {
+		return withOTPStatus(c, h.Logger, h.EmailOTP, services.PurposeEmailVerification, u.Email, err)
+	}
+	// someone may have verified the same address since the code was sent
+	if err := checkEmailFree(c.UserContext(), h.UserRepo, u.Email, u.ID); err != nil {
+		return err
+	}
+	now := time.Now()
+	u.EmailVerifiedAt = &now
+	if err := h.UserRepo.Update(c.UserContext(), u); err != nil {
+		return err
+	}
+	return c.JSON(u)
+}
+
+// Normalize trims the provided fields and canonicalizes the locale and email
+func (r *updateMeReq) Normalize() {
+	for _, f := range []*string{r.DisplayName, r.Email, r.Locale, r.AvatarURL} {
+		if f != nil {
+			*f = strings.TrimSpace(*f)
+		}
+	}
+	if r.Locale != nil && *r.Locale != "" {
+		// invalid tags are left for validation to reject
+		if tag, err := language.Parse(*r.Locale); err == nil {
+			*r.Locale = tag.String()
+		}
+	}
+	if r.Email != nil {
+		*r.Email = email.Canonical(*r.Email)
+	}
+}
+
+func (r *updateMeReq) apply(u *models.User) {
+	if r.DisplayName != nil {
+		u.DisplayName = *r.DisplayName
+	}
+	if r.Email != nil && *r.Email != u.Email {
+		// a new address has to be confirmed before it can be used to log in
+		u.Email = *r.Email
+		u.EmailVerifiedAt = nil
+	}
+	if r.Locale != nil {
+		u.Locale = *r.Locale
+	}
+	if r.AvatarURL != nil {
+		u.AvatarURL = *r.AvatarURL
+	}
+}
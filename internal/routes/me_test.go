@@ -0,0 +1,287 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/email"
+	"github.com/rznas/zeus/internal/middleware"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/phone"
+	"github.com/rznas/zeus/internal/repositories"
+	"github.com/rznas/zeus/internal/services"
+	"github.com/rznas/zeus/internal/validation"
+)
+
+func strPtr(s string) *string { return &s }
+
+func TestUpdateMeReq_Validation(t *testing.T) {
+	req := updateMeReq{
+		DisplayName: strPtr("  Ada  "),
+		Email:       strPtr(" Ada@Example.com "),
+		Locale:      strPtr("en-us"),
+		AvatarURL:   strPtr("https://cdn.example.com/ada.png"),
+	}
+	if fields := validation.Fields(&req); len(fields) != 0 {
+		t.Fatalf("expected valid request, got %v", fields)
+	}
+	if *req.DisplayName != "Ada" || *req.Locale != "en-US" || *req.Email != "ada@example.com" {
+		t.Fatalf("expected trimmed name and canonical locale and email, got %q %q %q", *req.DisplayName, *req.Locale, *req.Email)
+	}
+
+	req = updateMeReq{
+		Email:     strPtr("Ada <ada@example.com>"),
+		Locale:    strPtr("not a locale"),
+		AvatarURL: strPtr("javascript:alert(1)"),
+	}
+	fields := validation.Fields(&req)
+	for _, name := range []string{"email", "locale", "avatar_url"} {
+		if _, ok := fields[name]; !ok {
+			t.Fatalf("expected %s to be rejected, got %v", name, fields)
+		}
+	}
+
+	// empty strings clear a field and are always valid
+	req = updateMeReq{Email: strPtr(""), Locale: strPtr(""), AvatarURL: strPtr("")}
+	if fields := validation.Fields(&req); len(fields) != 0 {
+		t.Fatalf("expected clearing fields to be valid, got %v", fields)
+	}
+}
+
+// memoryUsers is an in-memory repositories.UserRepository for handler tests,
+// the listing and role changing methods are not implemented
+type memoryUsers struct {
+	repositories.UserRepository
+	users map[uuid.UUID]*models.User
+}
+
+func newMemoryUsers(users ...*models.User) *memoryUsers {
+	r := &memoryUsers{users: map[uuid.UUID]*models.User{}}
+	for _, u := range users {
+		r.users[u.ID] = u
+	}
+	return r
+}
+
+func (r *memoryUsers) Create(_ context.Context, u *models.User) error {
+	for _, other := range r.users {
+		if other.Phone == u.Phone {
+			return repositories.ErrPhoneInUse
+		}
+	}
+	if u.ID == uuid.Nil {
+		u.ID = uuid.New()
+	}
+	cp := *u
+	r.users[u.ID] = &cp
+	return nil
+}
+
+func (r *memoryUsers) GetByID(_ context.Context, id string) (*models.User, error) {
+	for _, u := range r.users {
+		if u.ID.String() == id {
+			cp := *u
+			return &cp, nil
+		}
+	}
+	return nil, repositories.ErrUserNotFound
+}
+
+func (r *memoryUsers) GetByPhone(_ context.Context, p string) (*models.User, error) {
+	for _, u := range r.users {
+		if u.Phone == p {
+			cp := *u
+			return &cp, nil
+		}
+	}
+	return nil, repositories.ErrUserNotFound
+}
+
+func (r *memoryUsers) GetByEmail(_ context.Context, addr string) (*models.User, error) {
+	var found *models.User
+	for _, u := range r.users {
+		if u.Email == addr && (found == nil || found.EmailVerifiedAt == nil) {
+			found = u
+		}
+	}
+	if found == nil {
+		return nil, repositories.ErrUserNotFound
+	}
+	cp := *found
+	return &cp, nil
+}
+
+func (r *memoryUsers) Update(_ context.Context, u *models.User) error {
+	if _, ok := r.users[u.ID]; !ok {
+		return repositories.ErrUserNotFound
+	}
+	cp := *u
+	r.users[u.ID] = &cp
+	return nil
+}
+
+func (r *memoryUsers) Delete(_ context.Context, id string) error {
+	for uid := range r.users {
+		if uid.String() == id {
+			delete(r.users, uid)
+			return nil
+		}
+	}
+	return repositories.ErrUserNotFound
+}
+
+func (r *memoryUsers) ListRoles(context.Context, string) ([]string, error) {
+	return nil, nil
+}
+
+// lastMessage remembers the last text sent, to read codes from
+type lastMessage struct {
+	to, message string
+}
+
+func (m *lastMessage) Send(_ context.Context, to, message string) error {
+	m.to, m.message = to, message
+	return nil
+}
+
+// code returns the code at the end of the last message
+func (m *lastMessage) code() string {
+	return m.message[strings.LastIndex(m.message, " ")+1:]
+}
+
+// asUser authenticates every request as uid
+func asUser(uid uuid.UUID) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals(string(middleware.ContextUserID), uid)
+		return c.Next()
+	}
+}
+
+// call sends a JSON request and returns the status and the decoded body
+func call(t *testing.T, app *fiber.App, method, path, body string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	var out map[string]any
+	_ = json.NewDecoder(res.Body).Decode(&out)
+	return res.StatusCode, out
+}
+
+func TestMeHandlers_PhoneChangeAndDeletion(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	phones := phone.NewParser("US")
+	sms := &lastMessage{}
+	ada := &models.User{ID: uuid.New(), Phone: "+12025550100"}
+	bob := &models.User{ID: uuid.New(), Phone: "+14155552671"}
+	users := newMemoryUsers(ada, bob)
+	h := &MeHandlers{
+		UserRepo:    users,
+		Refresh:     services.NewRefreshTokenService(rdb, 1),
+		Revocations: services.NewRevocationService(rdb, 15),
+		OTP:         services.NewOTPService(rdb, sms, phones, services.OTPOptions{TTLSeconds: 60, RateLimitPerMin: 5, RateLimitTimeoutSeconds: 60, MaxAttempts: 5, LockoutSeconds: 60}),
+		Phones:      phones,
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	app := fiber.New(fiber.Config{ErrorHandler: middleware.ErrorHandler})
+	h.RegisterRoutes(app.Group("", asUser(ada.ID)))
+
+	if status, out := call(t, app, "POST", "/me/phone/code", `{"phone": "(415) 555-2671"}`); status != fiber.StatusConflict || out["code"] != "phone_in_use" {
+		t.Fatalf("expected phone_in_use, got %d %v", status, out)
+	}
+	if status, out := call(t, app, "POST", "/me/phone/code", `{"phone": "+12025550100"}`); status != fiber.StatusConflict || out["code"] != "phone_unchanged" {
+		t.Fatalf("expected phone_unchanged, got %d %v", status, out)
+	}
+
+	// bob moves away, ada takes over his old number
+	bob.Phone = "+14155550100"
+	if status, out := call(t, app, "POST", "/me/phone/code", `{"phone": "+14155552671"}`); status != fiber.StatusOK || out["sent"] != true || sms.to != "+14155552671" {
+		t.Fatalf("expected a code sent to the new phone, got %d %v to %s", status, out, sms.to)
+	}
+	phoneCode := sms.code()
+
+	// the code only confirms the phone change
+	if status, out := call(t, app, "POST", "/me/delete/code", ""); status != fiber.StatusOK || sms.to != "+12025550100" {
+		t.Fatalf("expected a deletion code sent to the current phone, got %d %v to %s", status, out, sms.to)
+	}
+	deletionCode := sms.code()
+	if status, out := call(t, app, "DELETE", "/me", `{"code": "`+phoneCode+`"}`); status != fiber.StatusUnauthorized {
+		t.Fatalf("expected the phone change code to be refused for deletion, got %d %v", status, out)
+	}
+
+	status, out := call(t, app, "POST", "/me/phone/verify", `{"phone": "+14155552671", "code": "`+phoneCode+`"}`)
+	if status != fiber.StatusOK || out["phone"] != "+14155552671" || users.users[ada.ID].Phone != "+14155552671" {
+		t.Fatalf("expected the phone to change, got %d %v", status, out)
+	}
+
+	// the deletion code was sent to the old phone and is bound to it
+	if status, out := call(t, app, "DELETE", "/me", `{}`); status != fiber.StatusBadRequest || out["code"] != "validation_failed" {
+		t.Fatalf("expected a code to be required, got %d %v", status, out)
+	}
+	if status, out := call(t, app, "DELETE", "/me", `{"code": "`+deletionCode+`"}`); status != fiber.StatusUnauthorized {
+		t.Fatalf("expected a code for the old phone to be refused, got %d %v", status, out)
+	}
+	call(t, app, "POST", "/me/delete/code", "")
+	if status, out := call(t, app, "DELETE", "/me", `{"code": "`+sms.code()+`"}`); status != fiber.StatusNoContent {
+		t.Fatalf("expected the account to be deleted, got %d %v", status, out)
+	}
+	if _, ok := users.users[ada.ID]; ok {
+		t.Fatalf("expected the user to be gone")
+	}
+}
+
+func TestMeHandlers_OnlyVerifiedEmailsAreTaken(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	mail := &lastMessage{}
+	ada := &models.User{ID: uuid.New(), Phone: "+12025550100"}
+	eve := &models.User{ID: uuid.New(), Phone: "+14155552671", Email: "ada@example.com"}
+	bob := &models.User{ID: uuid.New(), Phone: "+14155550100"}
+	users := newMemoryUsers(ada, eve, bob)
+	h := &MeHandlers{
+		UserRepo: users,
+		EmailOTP: services.NewOTPService(rdb, mail, email.Addresses{}, services.OTPOptions{TTLSeconds: 60, RateLimitPerMin: 5, RateLimitTimeoutSeconds: 60, MaxAttempts: 5, LockoutSeconds: 60}),
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	as := func(u *models.User) *fiber.App {
+		app := fiber.New(fiber.Config{ErrorHandler: middleware.ErrorHandler})
+		h.RegisterRoutes(app.Group("", asUser(u.ID)))
+		return app
+	}
+
+	// eve never verified the address, so it doesn't keep ada out
+	if status, out := call(t, as(ada), "PATCH", "/me", `{"email": "ada@example.com"}`); status != fiber.StatusOK {
+		t.Fatalf("expected an unverified claim to be ignored, got %d %v", status, out)
+	}
+	call(t, as(ada), "POST", "/me/email/code", "")
+	if status, out := call(t, as(ada), "POST", "/me/email/verify", `{"code": "`+mail.code()+`"}`); status != fiber.StatusOK || out["email_verified_at"] == nil {
+		t.Fatalf("expected ada to verify the address, got %d %v", status, out)
+	}
+
+	// once verified the address is taken, and eve can no longer verify it
+	if status, out := call(t, as(bob), "PATCH", "/me", `{"email": "ada@example.com"}`); status != fiber.StatusConflict || out["code"] != "email_in_use" {
+		t.Fatalf("expected email_in_use, got %d %v", status, out)
+	}
+	call(t, as(eve), "POST", "/me/email/code", "")
+	if status, out := call(t, as(eve), "POST", "/me/email/verify", `{"code": "`+mail.code()+`"}`); status != fiber.StatusConflict || out["code"] != "email_in_use" {
+		t.Fatalf("expected email_in_use, got %d %v", status, out)
+	}
+}
@@ -0,0 +1,170 @@
+package routes
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/rznas/zeus/internal/middleware"
+	"github.com/rznas/zeus/internal/repositories"
+	"github.com/rznas/zeus/internal/services"
+	"github.com/rznas/zeus/internal/validation"
+)
+
+// MFAHandlers let the authenticated user manage their second factor
+type MFAHandlers struct {
+	UserRepo repositories.UserRepository
+	MFA      *services.MFAService
+}
+
+type mfaCodeReq struct {
+	// Code is from the authenticator app, or one of the recovery codes
+	Code string `json:"code" validate:"required,max=16"`
+}
+
+type mfaStatusResp struct {
+	TOTPEnabled            bool `json:"totp_enabled"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+type totpEnrollmentResp struct {
+	Secret string `json:"secret"`
+	// ProvisioningURI is the otpauth:// URI to show as a QR code
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type recoveryCodesResp struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func (h *MFAHandlers) RegisterRoutes(r fiber.Router) {
+	r.Get("/me/mfa", h.getStatus)
+	r.Post("/me/mfa/totp", h.enrollTOTP)
+	r.Post("/me/mfa/totp/confirm", h.confirmTOTP)
+	r.Post("/me/mfa/totp/disable", h.disableTOTP)
+	r.Post("/me/mfa/recovery-codes", h.regenerateRecoveryCodes)
+}
+
+// getStatus
+// @Summary Get second factor status
+// @Tags MFA
+// @Produce json
+// @Success 200 {object} mfaStatusResp
+// @Security BearerAuth
+// @Router /api/me/mfa [get]
+func (h *MFAHandlers) getStatus(c *fiber.Ctx) error {
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return errUnauthorized
+	}
+	st, err := h.MFA.Status(c.UserContext(), uid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(mfaStatusResp{TOTPEnabled: st.TOTPEnabled, RecoveryCodesRemaining: st.RecoveryCodesRemaining})
+}
+
+// enrollTOTP
+// @Summary Enroll authenticator app
+// @Description Returns a new secret and its otpauth:// URI for a QR code, replacing an enrollment that was never confirmed. Login only asks for the app once /api/me/mfa/totp/confirm received a code from it.
+// @Tags MFA
+// @Produce json
+// @Success 200 {object} totpEnrollmentResp
+// @Security BearerAuth
+// @Router /api/me/mfa/totp [post]
+func (h *MFAHandlers) enrollTOTP(c *fiber.Ctx) error {
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return errUnauthorized
+	}
+	u, err := h.UserRepo.GetByID(c.UserContext(), uid.String())
+	if err != nil {
+		return err
+	}
+	enrollment, err := h.MFA.Enroll(c.UserContext(), u.ID, u.Phone)
+	if err != nil {
+		return err
+	}
+	return c.JSON(totpEnrollmentResp{Secret: enrollment.Secret, ProvisioningURI: enrollment.URI})
+}
+
+// confirmTOTP
+// @Summary Confirm authenticator app
+// @Description Enables the enrolled app with a code from it. The response holds the recovery codes, which are not shown again.
+// @Tags MFA
+// @Accept json
+// @Produce json
+// @Param data body mfaCodeReq true "Code from the app"
+// @Success 200 {object} recoveryCodesResp
+// @Security BearerAuth
+// @Router /api/me/mfa/totp/confirm [post]
+func (h *MFAHandlers) confirmTOTP(c *fiber.Ctx) error {
+	var req mfaCodeReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return errUnauthorized
+	}
+	codes, err := h.MFA.Confirm(c.UserContext(), uid, req.Code)
+	if err != nil {
+		return err
+	}
+	return c.JSON(recoveryCodesResp{RecoveryCodes: codes})
+}
+
+// disableTOTP
+// @Summary Disable authenticator app
+// @Description Removes the app and the recovery codes. Requires a code from the app or a recovery code.
+// @Tags MFA
+// @Accept json
+// @Param data body mfaCodeReq true "Code"
+// @Success 204
+// @Security BearerAuth
+// @Router /api/me/mfa/totp/disable [post]
+func (h *MFAHandlers) disableTOTP(c *fiber.Ctx) error {
+	var req mfaCodeReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return errUnauthorized
+	}
+	if err := h.MFA.Disable(c.UserContext(), uid, req.Code); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// regenerateRecoveryCodes
+// @Summary Regenerate recovery codes
+// @Description Replaces all recovery codes, used or not. Requires a code from the app or a recovery code.
+// @Tags MFA
+// @Accept json
+// @Produce json
+// @Param data body mfaCodeReq true "Code"
+// @Success 200 {object} recoveryCodesResp
+// @Security BearerAuth
+// @Router /api/me/mfa/recovery-codes [post]
+func (h *MFAHandlers) regenerateRecoveryCodes(c *fiber.Ctx) error {
+	var req mfaCodeReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return errUnauthorized
+	}
+	codes, err := h.MFA.RegenerateRecoveryCodes(c.UserContext(), uid, req.Code)
+	if err != nil {
+		return err
+	}
+	return c.JSON(recoveryCodesResp{RecoveryCodes: codes})
+}
+
+// Normalize trims the code
+func (r *mfaCodeReq) Normalize() {
+	r.Code = strings.TrimSpace(r.Code)
+}
@@ -0,0 +1,488 @@
+package routes
+
+import (
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/middleware"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/ratelimit"
+	"github.com/rznas/zeus/internal/rbac"
+	"github.com/rznas/zeus/internal/repositories"
+	"github.com/rznas/zeus/internal/services"
+	"github.com/rznas/zeus/internal/validation"
+)
+
+var errUserInfoToken = apperr.Unauthorized("invalid_token", "invalid token")
+
+// OAuthHandlers serve the OpenID Connect provider: the endpoints of the
+// protocol for the client applications, the answers of the login page and
+// the registration of clients
+type OAuthHandlers struct {
+	OIDC        *services.OIDCService
+	Clients     repositories.OAuthRepository
+	JWT         *services.JWTService
+	Revocations *services.RevocationService
+	// Limiter enforces TokenPerIPMin
+	Limiter *ratelimit.Limiter
+	// TokenPerIPMin limits token requests per IP, zero disables it
+	TokenPerIPMin int
+	Logger        *slog.Logger
+}
+
+type createClientReq struct {
+	Name         string   `json:"name" validate:"required,max=64"`
+	RedirectURIs []string `json:"redirect_uris" validate:"required,min=1,max=10,dive,redirect_uri"`
+	// Public clients, like browser and mobile apps, can't keep a secret
+	Public bool `json:"public"`
+	// Trusted clients skip the consent screen
+	Trusted bool `json:"trusted"`
+}
+
+type updateClientReq struct {
+	Name         *string  `json:"name" validate:"omitnil,required,max=64"`
+	RedirectURIs []string `json:"redirect_uris" validate:"omitempty,max=10,dive,redirect_uri"`
+	Trusted      *bool    `json:"trusted"`
+}
+
+// clientSecretResp carries a client secret, which is shown only once
+type clientSecretResp struct {
+	Client       *models.OAuthClient `json:"client,omitempty"`
+	ClientSecret string              `json:"client_secret,omitempty"`
+}
+
+type authorizationPromptResp struct {
+	ClientID   string `json:"client_id"`
+	ClientName string `json:"client_name"`
+	// Scopes the client asks for, among openid, profile, email and phone
+	Scopes []string `json:"scopes"`
+	// Prompt is passed on from the client, "login" asks to sign in again
+	Prompt          string `json:"prompt,omitempty"`
+	ConsentRequired bool   `json:"consent_required"`
+	ExpiresIn       int    `json:"expires_in"`
+}
+
+// redirectResp tells the login page where to send the browser
+type redirectResp struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+type userInfoResp struct {
+	Subject string `json:"sub"`
+	services.UserProfile
+}
+
+func init() {
+	validation.Register("redirect_uri", "must be an https URL without fragment, or http on a loopback address", validRedirectURI)
+}
+
+// RegisterRoutes registers the endpoints of the protocol, which live outside /api
+func (h *OAuthHandlers) RegisterRoutes(r fiber.Router) {
+	r.Get("/authorize", h.authorize)
+	r.Post("/authorize", h.authorize)
+	r.Post("/token", middleware.RateLimit(h.Limiter, middleware.RateLimitConfig{
+		Name:   "oauth_token",
+		Limit:  ratelimit.PerMinute(h.TokenPerIPMin),
+		Key:    middleware.KeyByIP,
+		Err:    middleware.ErrTooManyAttempts,
+		Logger: h.Logger,
+	}), h.token)
+	userInfoAuth := middleware.ClientTokenMiddleware(h.JWT, h.Revocations, services.ScopeOpenID)
+	r.Get("/userinfo", userInfoAuth, h.userInfo)
+	r.Post("/userinfo", userInfoAuth, h.userInfo)
+}
+
+// RegisterProtectedRoutes registers the answers of the login page and the client registration
+func (h *OAuthHandlers) RegisterProtectedRoutes(r fiber.Router) {
+	r.Get("/requests/:id", h.getAuthorizationRequest)
+	r.Post("/requests/:id/approve", h.approveAuthorizationRequest)
+	r.Post("/requests/:id/deny", h.denyAuthorizationRequest)
+
+	r.Get("/clients", middleware.RequirePermission(rbac.PermClientsManage), h.listClients)
+	r.Post("/clients", middleware.RequirePermission(rbac.PermClientsManage), h.createClient)
+	r.Get("/clients/:id", middleware.RequirePermission(rbac.PermClientsManage), h.getClient)
+	r.Patch("/clients/:id", middleware.RequirePermission(rbac.PermClientsManage), h.updateClient)
+	r.Delete("/clients/:id", middleware.RequirePermission(rbac.PermClientsManage), h.deleteClient)
+	r.Post("/clients/:id/secret", middleware.RequirePermission(rbac.PermClientsManage), h.rotateClientSecret)
+}
+
+// authorize
+// @Summary Authorization endpoint
+// @Description Starts the OpenID Connect authorization code flow. PKCE with S256 and the openid scope are required. A valid request is stored and the browser redirected to the login page with its request_id; errors are reported to the redirect_uri, except for an unknown client or redirect_uri, which are shown as a problem.
+// @Tags OAuth
+// @Param client_id query string true "Client ID"
+// @Param redirect_uri query string false "Registered redirect URI, may be left out if the client has only one"
+// @Param response_type query string true "Must be code"
+// @Param scope query string true "Space separated, openid and any of profile, email and phone"
+// @Param state query string false "Returned to the client as is"
+// @Param nonce query string false "Copied into the ID token"
+// @Param prompt query string false "none is answered with login_required, login and consent are passed on to the login page"
+// @Param code_challenge query string true "PKCE challenge"
+// @Param code_challenge_method query string true "Must be S256"
+// @Success 302
+// @Router /oauth/authorize [get]
+func (h *OAuthHandlers) authorize(c *fiber.Ctx) error {
+	param := c.Query
+	if c.Method() == fiber.MethodPost {
+		param = func(key string, defaultValue ...string) string { return c.FormValue(key, defaultValue...) }
+	}
+	location, err := h.OIDC.Authorize(c.UserContext(), services.AuthorizeParams{
+		ResponseType:        param("response_type"),
+		ClientID:            param("client_id"),
+		RedirectURI:         param("redirect_uri"),
+		Scope:               param("scope"),
+		State:               param("state"),
+		Nonce:               param("nonce"),
+		Prompt:              param("prompt"),
+		CodeChallenge:       param("code_challenge"),
+		CodeChallengeMethod: param("code_challenge_method"),
+	})
+	if err != nil {
+		return err
+	}
+	return c.Redirect(location, fiber.StatusFound)
+}
+
+// token
+// @Summary Token endpoint
+// @Description Exchanges an authorization code for an ID token and an access token for the userinfo endpoint. Confidential clients authenticate with HTTP Basic or client_secret in the body, public clients send only client_id. Each code can be exchanged once. Errors follow RFC 6749 section 5.2 rather than the problem format.
+// @Tags OAuth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "Must be authorization_code"
+// @Param code formData string true "Authorization code"
+// @Param redirect_uri formData string true "Redirect URI of the authorization request"
+// @Param code_verifier formData string true "PKCE verifier"
+// @Param client_id formData string false "Client ID, unless sent with HTTP Basic"
+// @Param client_secret formData string false "Client secret, unless sent with HTTP Basic"
+// @Success 200 {object} services.TokenResponse
+// @Failure 400 {object} services.OAuthError
+// @Failure 401 {object} services.OAuthError
+// @Router /oauth/token [post]
+func (h *OAuthHandlers) token(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set(fiber.HeaderPragma, "no-cache")
+	req := services.TokenRequest{
+		ClientID:     c.FormValue("client_id"),
+		ClientSecret: c.FormValue("client_secret"),
+		Code:         c.FormValue("code"),
+		RedirectURI:  c.FormValue("redirect_uri"),
+		CodeVerifier: c.FormValue("code_verifier"),
+	}
+	basic := strings.HasPrefix(c.Get(fiber.HeaderAuthorization), "Basic ")
+	if basic {
+		id, secret, ok := parseBasicAuth(c.Get(fiber.HeaderAuthorization))
+		if !ok || req.ClientSecret != "" || (req.ClientID != "" && req.ClientID != id) {
+			return oauthErrorResponse(c, &services.OAuthError{Code: "invalid_request", Description: "malformed client authentication"}, basic)
+		}
+		req.ClientID, req.ClientSecret = id, secret
+	}
+	if grantType := c.FormValue("grant_type"); grantType != "authorization_code" {
+		return oauthErrorResponse(c, &services.OAuthError{Code: "unsupported_grant_type", Description: "only authorization_code is supported"}, basic)
+	}
+	resp, err := h.OIDC.Exchange(c.UserContext(), req)
+	var oauthErr *services.OAuthError
+	if errors.As(err, &oauthErr) {
+		return oauthErrorResponse(c, oauthErr, basic)
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(resp)
+}
+
+// userInfo
+// @Summary UserInfo endpoint
+// @Description Returns the claims about the user released by the scopes of the access token from the token endpoint. Tokens of the API are rejected.
+// @Tags OAuth
+// @Produce json
+// @Success 200 {object} userInfoResp
+// @Security BearerAuth
+// @Router /oauth/userinfo [get]
+func (h *OAuthHandlers) userInfo(c *fiber.Ctx) error {
+	claims, ok := middleware.GetClaims(c)
+	if !ok {
+		return errUnauthorized
+	}
+	uid, _ := middleware.GetUserID(c)
+	profile, err := h.OIDC.UserInfo(c.UserContext(), uid, claims.Scope)
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return errUserInfoToken
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(userInfoResp{Subject: uid.String(), UserProfile: profile})
+}
+
+// getAuthorizationRequest
+// @Summary Get authorization request
+// @Description For the login page: describes the request it was opened with, so it can ask the signed in user for consent when consent_required is set.
+// @Tags OAuth
+// @Produce json
+// @Param id path string true "Request ID"
+// @Success 200 {object} authorizationPromptResp
+// @Security BearerAuth
+// @Router /api/oauth/requests/{id} [get]
+func (h *OAuthHandlers) getAuthorizationRequest(c *fiber.Ctx) error {
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return errUnauthorized
+	}
+	p, err := h.OIDC.Describe(c.UserContext(), c.Params("id"), uid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(authorizationPromptResp{
+		ClientID:        p.Client.ID,
+		ClientName:      p.Client.Name,
+		Scopes:          p.Scopes,
+		Prompt:          p.Prompt,
+		ConsentRequired: p.ConsentRequired,
+		ExpiresIn:       int(p.ExpiresIn.Seconds()),
+	})
+}
+
+// approveAuthorizationRequest
+// @Summary Approve authorization request
+// @Description For the login page: grants the client access as the signed in user and remembers the consent. The browser is to be sent to redirect_to, which carries the authorization code.
+// @Tags OAuth
+// @Produce json
+// @Param id path string true "Request ID"
+// @Success 200 {object} redirectResp
+// @Security BearerAuth
+// @Router /api/oauth/requests/{id}/approve [post]
+func (h *OAuthHandlers) approveAuthorizationRequest(c *fiber.Ctx) error {
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return errUnauthorized
+	}
+	location, err := h.OIDC.Approve(c.UserContext(), c.Params("id"), uid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(redirectResp{RedirectTo: location})
+}
+
+// denyAuthorizationRequest
+// @Summary Deny authorization request
+// @Description For the login page: the user refused, the browser is to be sent to redirect_to, which tells the client.
+// @Tags OAuth
+// @Produce json
+// @Param id path string true "Request ID"
+// @Success 200 {object} redirectResp
+// @Security BearerAuth
+// @Router /api/oauth/requests/{id}/deny [post]
+func (h *OAuthHandlers) denyAuthorizationRequest(c *fiber.Ctx) error {
+	location, err := h.OIDC.Deny(c.UserContext(), c.Params("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(redirectResp{RedirectTo: location})
+}
+
+// listClients
+// @Summary List OAuth clients
+// @Description Requires the clients:manage permission.
+// @Tags OAuth
+// @Produce json
+// @Success 200 {array} models.OAuthClient
+// @Security BearerAuth
+// @Router /api/oauth/clients [get]
+func (h *OAuthHandlers) listClients(c *fiber.Ctx) error {
+	clients, err := h.Clients.ListClients(c.UserContext())
+	if err != nil {
+		return err
+	}
+	if clients == nil {
+		clients = []models.OAuthClient{}
+	}
+	return c.JSON(clients)
+}
+
+// createClient
+// @Summary Register OAuth client
+// @Description Registers an application that signs users in with Zeus. The secret of a confidential client is returned once and can't be shown again. Requires the clients:manage permission.
+// @Tags OAuth
+// @Accept json
+// @Produce json
+// @Param data body createClientReq true "Client"
+// @Success 201 {object} clientSecretResp
+// @Security BearerAuth
+// @Router /api/oauth/clients [post]
+func (h *OAuthHandlers) createClient(c *fiber.Ctx) error {
+	var req createClientReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	client := &models.OAuthClient{
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		Public:       req.Public,
+		Trusted:      req.Trusted,
+	}
+	secret, err := h.OIDC.CreateClient(c.UserContext(), client)
+	if err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(clientSecretResp{Client: client, ClientSecret: secret})
+}
+
+// getClient
+// @Summary Get OAuth client
+// @Description Requires the clients:manage permission.
+// @Tags OAuth
+// @Produce json
+// @Param id path string true "Client ID"
+// @Success 200 {object} models.OAuthClient
+// @Security BearerAuth
+// @Router /api/oauth/clients/{id} [get]
+func (h *OAuthHandlers) getClient(c *fiber.Ctx) error {
+	client, err := h.Clients.GetClient(c.UserContext(), c.Params("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(client)
+}
+
+// updateClient
+// @Summary Update OAuth client
+// @Description Changes the name, the redirect URIs or whether the client is trusted. Requires the clients:manage permission.
+// @Tags OAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Client ID"
+// @Param data body updateClientReq true "Fields to change"
+// @Success 200 {object} models.OAuthClient
+// @Security BearerAuth
+// @Router /api/oauth/clients/{id} [patch]
+func (h *OAuthHandlers) updateClient(c *fiber.Ctx) error {
+	var req updateClientReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	client, err := h.Clients.GetClient(c.UserContext(), c.Params("id"))
+	if err != nil {
+		return err
+	}
+	if req.Name != nil {
+		client.Name = *req.Name
+	}
+	if len(req.RedirectURIs) > 0 {
+		client.RedirectURIs = req.RedirectURIs
+	}
+	if req.Trusted != nil {
+		client.Trusted = *req.Trusted
+	}
+	if err := h.Clients.UpdateClient(c.UserContext(), client); err != nil {
+		return err
+	}
+	return c.JSON(client)
+}
+
+// deleteClient
+// @Summary Delete OAuth client
+// @Description Removes the client and the consents given to it. Access tokens already issued stay valid until they expire. Requires the clients:manage permission.
+// @Tags OAuth
+// @Param id path string true "Client ID"
+// @Success 204
+// @Security BearerAuth
+// @Router /api/oauth/clients/{id} [delete]
+func (h *OAuthHandlers) deleteClient(c *fiber.Ctx) error {
+	if err := h.Clients.DeleteClient(c.UserContext(), c.Params("id")); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// rotateClientSecret
+// @Summary Rotate OAuth client secret
+// @Description Replaces the secret of a confidential client, the old one stops working at once. The new secret is returned once. Requires the clients:manage permission.
+// @Tags OAuth
+// @Produce json
+// @Param id path string true "Client ID"
+// @Success 200 {object} clientSecretResp
+// @Security BearerAuth
+// @Router /api/oauth/clients/{id}/secret [post]
+func (h *OAuthHandlers) rotateClientSecret(c *fiber.Ctx) error {
+	secret, err := h.OIDC.RotateClientSecret(c.UserContext(), c.Params("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(clientSecretResp{ClientSecret: secret})
+}
+
+// oauthErrorResponse writes a token endpoint error as RFC 6749 section 5.2 asks
+func oauthErrorResponse(c *fiber.Ctx, e *services.OAuthError, basic bool) error {
+	if e.Code == "invalid_client" && basic {
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="zeus"`)
+	}
+	return c.Status(e.Status()).JSON(e)
+}
+
+// parseBasicAuth decodes client credentials sent with HTTP Basic, which are
+// form encoded before being joined (RFC 6749 section 2.3.1)
+func parseBasicAuth(header string) (string, string, bool) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+	if err != nil {
+		return "", "", false
+	}
+	id, secret, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return "", "", false
+	}
+	id, err = url.QueryUnescape(id)
+	if err != nil {
+		return "", "", false
+	}
+	secret, err = url.QueryUnescape(secret)
+	if err != nil {
+		return "", "", false
+	}
+	return id, secret, true
+}
+
+// validRedirectURI accepts absolute https URLs without fragment, and http
+// ones on a loopback address for development and native apps (RFC 8252)
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Fragment != "" || u.User != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		ip := net.ParseIP(host)
+		return host == "localhost" || (ip != nil && ip.IsLoopback())
+	}
+	return false
+}
+
+// Normalize trims the name and the redirect URIs
+func (r *createClientReq) Normalize() {
+	r.Name = strings.TrimSpace(r.Name)
+	for i := range r.RedirectURIs {
+		r.RedirectURIs[i] = strings.TrimSpace(r.RedirectURIs[i])
+	}
+}
+
+// Normalize trims the name and the redirect URIs
+func (r *updateClientReq) Normalize() {
+	if r.Name != nil {
+		name := strings.TrimSpace(*r.Name)
+		r.Name = &name
+	}
+	for i := range r.RedirectURIs {
+		r.RedirectURIs[i] = strings.TrimSpace(r.RedirectURIs[i])
+	}
+}
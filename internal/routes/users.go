@@ -2,48 +2,401 @@ package routes
 
 import (
 	"context"
-	"strconv"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 
+	"github.com/rznas/zeus/internal/middleware"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/phone"
+	"github.com/rznas/zeus/internal/rbac"
 	"github.com/rznas/zeus/internal/repositories"
+	"github.com/rznas/zeus/internal/services"
+	"github.com/rznas/zeus/internal/validation"
 )
 
 type UsersHandlers struct {
-	UserRepo repositories.UserRepository
+	UserRepo    repositories.UserRepository
+	Phones      *phone.Parser
+	Refresh     *services.RefreshTokenService
+	Revocations *services.RevocationService
+	MFA         *services.MFAService
+}
+
+type createUserReq struct {
+	Phone string `json:"phone" validate:"required"`
+	updateMeReq
+}
+
+type updateUserReq struct {
+	Phone *string `json:"phone" validate:"omitnil,required"`
+	updateMeReq
+}
+
+// listUsersQuery holds the query parameters of listUsers
+type listUsersQuery struct {
+	Limit          int        `query:"limit" validate:"min=1,max=100"`
+	Cursor         string     `query:"cursor"`
+	Sort           string     `query:"sort" validate:"oneof=created_at -created_at updated_at -updated_at phone -phone"`
+	PhonePrefix    string     `query:"phone_prefix" validate:"omitempty,phone_prefix"`
+	CreatedAfter   *time.Time `query:"created_after"`
+	CreatedBefore  *time.Time `query:"created_before"`
+	Status         string     `query:"status" validate:"omitempty,oneof=active blocked deleted"`
+	IncludeDeleted bool       `query:"include_deleted"`
+	IncludeTotal   bool       `query:"include_total"`
+}
+
+type lookupUserQuery struct {
+	Phone string `query:"phone" validate:"required"`
+}
+
+var phonePrefixPattern = regexp.MustCompile(`^\+?[0-9]{1,15}$`)
+
+func init() {
+	validation.Register("phone_prefix", "must be digits, optionally starting with +", phonePrefixPattern.MatchString)
 }
 
 func (h *UsersHandlers) RegisterRoutes(r fiber.Router) {
-	r.Get("/users", h.listUsers)
+	r.Get("/users", middleware.RequirePermission(rbac.PermUsersList), h.listUsers)
+	r.Post("/users", middleware.RequirePermission(rbac.PermUsersWrite), h.createUser)
+	// registered before /users/:id so "lookup" is not taken for an id
+	r.Get("/users/lookup", middleware.RequirePermission(rbac.PermUsersRead), h.lookupUser)
+	r.Get("/users/:id", middleware.RequirePermission(rbac.PermUsersRead), h.getUser)
+	r.Patch("/users/:id", middleware.RequirePermission(rbac.PermUsersWrite), h.updateUser)
+	r.Delete("/users/:id", middleware.RequirePermission(rbac.PermUsersDelete), h.deleteUser)
+	r.Post("/users/:id/block", middleware.RequirePermission(rbac.PermUsersBlock), h.blockUser)
+	r.Post("/users/:id/unblock", middleware.RequirePermission(rbac.PermUsersBlock), h.unblockUser)
+	r.Post("/users/:id/restore", middleware.RequirePermission(rbac.PermUsersDelete), h.restoreUser)
+	r.Delete("/users/:id/mfa", middleware.RequirePermission(rbac.PermUsersWrite), h.resetMFA)
 }
 
 // listUsers
 // @Summary List users
+// @Description Keyset paginated listing. Pass next_cursor from the previous response as cursor to get the next page; a cursor is only valid with the sort it was issued for. Requires the users:list permission.
 // @Tags Users
-// @Param page query int false "Page"
-// @Param page_size query int false "Page Size"
+// @Param limit query int false "Page size (1-100, default 20)"
+// @Param cursor query string false "Cursor from the previous page"
+// @Param sort query string false "created_at, updated_at or phone; prefix with - for descending (default -created_at)"
+// @Param phone_prefix query string false "E.164 prefix, e.g. +1415"
+// @Param created_after query string false "RFC 3339 timestamp (inclusive)"
+// @Param created_before query string false "RFC 3339 timestamp (exclusive)"
+// @Param status query string false "active, blocked or deleted"
+// @Param include_deleted query bool false "Include soft-deleted users"
+// @Param include_total query bool false "Include the estimated number of matching users"
 // @Success 200 {object} map[string]any
 // @Security BearerAuth
 // @Router /api/users [get]
 func (h *UsersHandlers) listUsers(c *fiber.Ctx) error {
-	page, _ := strconv.Atoi(c.Query("page", "1"))
-	pageSize, _ := strconv.Atoi(c.Query("page_size", "20"))
-	if page < 1 {
-		page = 1
+	opts, err := parseListUsersQuery(c)
+	if err != nil {
+		return err
 	}
-	if pageSize < 1 || pageSize > 100 {
-		pageSize = 20
+
+	page, err := h.UserRepo.List(c.UserContext(), opts)
+	if err != nil {
+		return err
 	}
 
-	users, total, err := h.UserRepo.List(context.Background(), page, pageSize)
+	resp := fiber.Map{
+		"data":        page.Users,
+		"limit":       opts.Limit,
+		"next_cursor": page.NextCursor,
+	}
+	if page.EstimatedTotal != nil {
+		resp["estimated_total"] = *page.EstimatedTotal
+	}
+	return c.JSON(resp)
+}
+
+// parseListUsersQuery reads the listing options from the query string
+func parseListUsersQuery(c *fiber.Ctx) (repositories.ListUsersOptions, error) {
+	q := listUsersQuery{Limit: 20, Sort: "-created_at"}
+	if err := validation.ParseQuery(c, &q); err != nil {
+		return repositories.ListUsersOptions{}, err
+	}
+	opts := repositories.ListUsersOptions{
+		Limit:     q.Limit,
+		SortBy:    strings.TrimPrefix(q.Sort, "-"),
+		Desc:      strings.HasPrefix(q.Sort, "-"),
+		Cursor:    q.Cursor,
+		WithTotal: q.IncludeTotal,
+		Filter: repositories.UserFilter{
+			CreatedAfter:   q.CreatedAfter,
+			CreatedBefore:  q.CreatedBefore,
+			Status:         q.Status,
+			IncludeDeleted: q.IncludeDeleted,
+		},
+	}
+	if q.PhonePrefix != "" {
+		// phones are stored in E.164
+		opts.Filter.PhonePrefix = "+" + strings.TrimPrefix(q.PhonePrefix, "+")
+	}
+	return opts, nil
+}
+
+// loadUser fetches the user named by the :id path parameter
+func (h *UsersHandlers) loadUser(c *fiber.Ctx) (*models.User, error) {
+	id, err := uuid.Parse(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+		return nil, errInvalidUserID
+	}
+	return h.UserRepo.GetByID(c.UserContext(), id.String())
+}
+
+// revokeSessions ends every session of the user
+func (h *UsersHandlers) revokeSessions(ctx context.Context, id uuid.UUID) error {
+	if err := h.Revocations.RevokeUser(ctx, id); err != nil {
+		return err
 	}
+	return h.Refresh.RevokeUser(ctx, id)
+}
 
-	return c.JSON(fiber.Map{
-		"data":      users,
-		"page":      page,
-		"page_size": pageSize,
-		"total":     total,
-	})
+// createUser
+// @Summary Create user
+// @Description Creates a user without OTP verification. Requires the users:write permission.
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param data body createUserReq true "User"
+// @Success 201 {object} models.User
+// @Security BearerAuth
+// @Router /api/users [post]
+func (h *UsersHandlers) createUser(c *fiber.Ctx) error {
+	var req createUserReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	p, err := normalizePhone(h.Phones, "phone", req.Phone)
+	if err != nil {
+		return err
+	}
+
+	if err := checkPhoneFree(c.UserContext(), h.UserRepo, p, uuid.Nil); err != nil {
+		return err
+	}
+	if req.Email != nil && *req.Email != "" {
+		if err := checkEmailFree(c.UserContext(), h.UserRepo, *req.Email, uuid.Nil); err != nil {
+			return err
+		}
+	}
+
+	u := &models.User{Phone: p}
+	req.apply(u)
+	if err := h.UserRepo.Create(c.UserContext(), u); err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(u)
+}
+
+// lookupUser
+// @Summary Find user by phone
+// @Description Requires the users:read permission.
+// @Tags Users
+// @Produce json
+// @Param phone query string true "Phone"
+// @Success 200 {object} models.User
+// @Security BearerAuth
+// @Router /api/users/lookup [get]
+func (h *UsersHandlers) lookupUser(c *fiber.Ctx) error {
+	var q lookupUserQuery
+	if err := validation.ParseQuery(c, &q); err != nil {
+		return err
+	}
+	p, err := normalizePhone(h.Phones, "phone", q.Phone)
+	if err != nil {
+		return err
+	}
+	u, err := h.UserRepo.GetByPhone(c.UserContext(), p)
+	if err != nil {
+		return err
+	}
+	return c.JSON(u)
+}
+
+// getUser
+// @Summary Get user
+// @Description Requires the users:read permission.
+// @Tags Users
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} models.User
+// @Security BearerAuth
+// @Router /api/users/{id} [get]
+func (h *UsersHandlers) getUser(c *fiber.Ctx) error {
+	u, err := h.loadUser(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(u)
+}
+
+// updateUser
+// @Summary Update user
+// @Description Partial update: omitted fields are left unchanged, empty strings clear them. Requires the users:write permission.
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param data body updateUserReq true "User"
+// @Success 200 {object} models.User
+// @Security BearerAuth
+// @Router /api/users/{id} [patch]
+func (h *UsersHandlers) updateUser(c *fiber.Ctx) error {
+	var req updateUserReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	var newPhone string
+	if req.Phone != nil {
+		p, err := normalizePhone(h.Phones, "phone", *req.Phone)
+		if err != nil {
+			return err
+		}
+		newPhone = p
+	}
+
+	u, err := h.loadUser(c)
+	if err != nil {
+		return err
+	}
+	if newPhone != "" && newPhone != u.Phone {
+		if err := checkPhoneFree(c.UserContext(), h.UserRepo, newPhone, u.ID); err != nil {
+			return err
+		}
+		u.Phone = newPhone
+	}
+	if req.Email != nil && *req.Email != "" && *req.Email != u.Email {
+		if err := checkEmailFree(c.UserContext(), h.UserRepo, *req.Email, u.ID); err != nil {
+			return err
+		}
+	}
+	req.apply(u)
+	if err := h.UserRepo.Update(c.UserContext(), u); err != nil {
+		return err
+	}
+	return c.JSON(u)
+}
+
+// deleteUser
+// @Summary Delete user
+// @Description Soft-deletes the user and revokes all of its tokens. Requires the users:delete permission.
+// @Tags Users
+// @Param id path string true "User ID"
+// @Success 204
+// @Security BearerAuth
+// @Router /api/users/{id} [delete]
+func (h *UsersHandlers) deleteUser(c *fiber.Ctx) error {
+	u, err := h.loadUser(c)
+	if err != nil {
+		return err
+	}
+	if err := h.UserRepo.Delete(c.UserContext(), u.ID.String()); err != nil {
+		return err
+	}
+	if err := h.revokeSessions(c.UserContext(), u.ID); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// blockUser
+// @Summary Block user
+// @Description Prevents the user from logging in and revokes all of its tokens. Requires the users:block permission.
+// @Tags Users
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} models.User
+// @Security BearerAuth
+// @Router /api/users/{id}/block [post]
+func (h *UsersHandlers) blockUser(c *fiber.Ctx) error {
+	u, err := h.loadUser(c)
+	if err != nil {
+		return err
+	}
+	if u.BlockedAt == nil {
+		now := time.Now().UTC()
+		u.BlockedAt = &now
+		if err := h.UserRepo.Update(c.UserContext(), u); err != nil {
+			return err
+		}
+	}
+	if err := h.revokeSessions(c.UserContext(), u.ID); err != nil {
+		return err
+	}
+	return c.JSON(u)
+}
+
+// unblockUser
+// @Summary Unblock user
+// @Description Requires the users:block permission.
+// @Tags Users
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} models.User
+// @Security BearerAuth
+// @Router /api/users/{id}/unblock [post]
+func (h *UsersHandlers) unblockUser(c *fiber.Ctx) error {
+	u, err := h.loadUser(c)
+	if err != nil {
+		return err
+	}
+	if u.BlockedAt != nil {
+		u.BlockedAt = nil
+		if err := h.UserRepo.Update(c.UserContext(), u); err != nil {
+			return err
+		}
+	}
+	return c.JSON(u)
+}
+
+// restoreUser
+// @Summary Restore deleted user
+// @Description Undeletes a soft-deleted user. Fails with 409 if its phone was registered again in the meantime. Requires the users:delete permission.
+// @Tags Users
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} models.User
+// @Security BearerAuth
+// @Router /api/users/{id}/restore [post]
+func (h *UsersHandlers) restoreUser(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return errInvalidUserID
+	}
+	_, err = h.UserRepo.GetByID(c.UserContext(), id.String())
+	if err == nil {
+		return errUserNotDeleted
+	}
+	if !errors.Is(err, repositories.ErrUserNotFound) {
+		return err
+	}
+
+	u, err := h.UserRepo.Restore(c.UserContext(), id.String())
+	if err != nil {
+		return err
+	}
+	return c.JSON(u)
+}
+
+// resetMFA
+// @Summary Reset second factor
+// @Description Removes the authenticator app and recovery codes of a user who lost both, so they can log in with the first factor alone and enroll again. Requires the users:write permission.
+// @Tags Users
+// @Param id path string true "User ID"
+// @Success 204
+// @Security BearerAuth
+// @Router /api/users/{id}/mfa [delete]
+func (h *UsersHandlers) resetMFA(c *fiber.Ctx) error {
+	u, err := h.loadUser(c)
+	if err != nil {
+		return err
+	}
+	if err := h.MFA.Reset(c.UserContext(), u.ID); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
 }
@@ -0,0 +1,108 @@
+package routes
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/middleware"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/phone"
+	"github.com/rznas/zeus/internal/rbac"
+	"github.com/rznas/zeus/internal/repositories"
+	"github.com/rznas/zeus/internal/services"
+)
+
+func parseQuery(t *testing.T, query string) (repositories.ListUsersOptions, map[string]string) {
+	t.Helper()
+	var opts repositories.ListUsersOptions
+	var fields map[string]string
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		var err error
+		opts, err = parseListUsersQuery(c)
+		var appErr *apperr.Error
+		if errors.As(err, &appErr) {
+			fields = appErr.Fields
+		}
+		return nil
+	})
+	if _, err := app.Test(httptest.NewRequest("GET", "/?"+query, nil)); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	return opts, fields
+}
+
+func TestParseListUsersQuery_Defaults(t *testing.T) {
+	opts, fields := parseQuery(t, "")
+	if len(fields) != 0 {
+		t.Fatalf("unexpected errors %v", fields)
+	}
+	if opts.Limit != 20 || opts.SortBy != "created_at" || !opts.Desc {
+		t.Fatalf("unexpected defaults %+v", opts)
+	}
+}
+
+func TestParseListUsersQuery_Filters(t *testing.T) {
+	opts, fields := parseQuery(t, "limit=5&sort=phone&phone_prefix=1415&created_after=2026-01-01T00:00:00Z&status=blocked&include_total=true")
+	if len(fields) != 0 {
+		t.Fatalf("unexpected errors %v", fields)
+	}
+	if opts.Limit != 5 || opts.SortBy != "phone" || opts.Desc {
+		t.Fatalf("unexpected paging %+v", opts)
+	}
+	if opts.Filter.PhonePrefix != "+1415" || opts.Filter.CreatedAfter == nil || opts.Filter.Status != "blocked" || !opts.WithTotal {
+		t.Fatalf("unexpected filter %+v", opts.Filter)
+	}
+}
+
+func TestParseListUsersQuery_Invalid(t *testing.T) {
+	_, fields := parseQuery(t, "limit=abc&sort=password&phone_prefix=1%25&created_before=yesterday&status=gone&include_deleted=maybe")
+	for _, name := range []string{"limit", "sort", "phone_prefix", "created_before", "status", "include_deleted"} {
+		if _, ok := fields[name]; !ok {
+			t.Fatalf("expected %s to be rejected, got %v", name, fields)
+		}
+	}
+}
+
+func TestUsersHandlers_EmailInUse(t *testing.T) {
+	now := time.Now()
+	ada := &models.User{ID: uuid.New(), Phone: "+12025550100", Email: "ada@example.com", EmailVerifiedAt: &now}
+	bob := &models.User{ID: uuid.New(), Phone: "+14155552671"}
+	eve := &models.User{ID: uuid.New(), Phone: "+12025550199", Email: "eve@example.com"}
+	users := newMemoryUsers(ada, bob, eve)
+	h := &UsersHandlers{UserRepo: users, Phones: phone.NewParser("US")}
+	app := fiber.New(fiber.Config{ErrorHandler: middleware.ErrorHandler})
+	admin := func(c *fiber.Ctx) error {
+		c.Locals(string(middleware.ContextClaims), &services.Claims{Roles: []string{rbac.RoleAdmin}})
+		return c.Next()
+	}
+	h.RegisterRoutes(app.Group("", admin))
+
+	cases := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{"POST", "/users", `{"phone": "+14155550100", "email": "Ada@Example.com"}`, fiber.StatusConflict, "email_in_use"},
+		{"PATCH", "/users/" + bob.ID.String(), `{"email": "ada@example.com"}`, fiber.StatusConflict, "email_in_use"},
+		{"PATCH", "/users/" + ada.ID.String(), `{"email": "ada@example.com", "display_name": "Ada"}`, fiber.StatusOK, ""},
+		{"PATCH", "/users/" + bob.ID.String(), `{"email": "bob@example.com"}`, fiber.StatusOK, ""},
+		// eve never verified the address, so it is free
+		{"POST", "/users", `{"phone": "+14155550100", "email": "eve@example.com"}`, fiber.StatusCreated, ""},
+	}
+	for _, tc := range cases {
+		status, out := call(t, app, tc.method, tc.path, tc.body)
+		if status != tc.status || tc.code != "" && out["code"] != tc.code {
+			t.Errorf("%s %s %s: expected %d %s, got %d %v", tc.method, tc.path, tc.body, tc.status, tc.code, status, out)
+		}
+	}
+	if users.users[bob.ID].Email != "bob@example.com" {
+		t.Fatalf("expected bob's email to change, got %+v", users.users[bob.ID])
+	}
+}
@@ -0,0 +1,264 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/middleware"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/ratelimit"
+	"github.com/rznas/zeus/internal/repositories"
+	"github.com/rznas/zeus/internal/services"
+	"github.com/rznas/zeus/internal/validation"
+)
+
+var errInvalidPasskeyID = apperr.Invalid("invalid_passkey_id", "invalid passkey id")
+
+// webAuthnFinishReq carries the PublicKeyCredential returned by the browser,
+// serialized as by its toJSON method
+type webAuthnFinishReq struct {
+	SessionID  string          `json:"session_id" validate:"required,max=128"`
+	Credential json.RawMessage `json:"credential" validate:"required" swaggertype:"object"`
+}
+
+type webAuthnRegisterReq struct {
+	webAuthnFinishReq
+	// Name tells the user's passkeys apart, like "Work laptop"
+	Name string `json:"name" validate:"max=64"`
+}
+
+// webAuthnCreationResp holds the argument for navigator.credentials.create
+type webAuthnCreationResp struct {
+	SessionID string                       `json:"session_id"`
+	Options   *protocol.CredentialCreation `json:"options" swaggertype:"object"`
+	ExpiresIn int                          `json:"expires_in"`
+}
+
+// webAuthnAssertionResp holds the argument for navigator.credentials.get
+type webAuthnAssertionResp struct {
+	SessionID string                        `json:"session_id"`
+	Options   *protocol.CredentialAssertion `json:"options" swaggertype:"object"`
+	ExpiresIn int                           `json:"expires_in"`
+}
+
+// registerWebAuthnRoutes registers the passkey login next to the other logins
+func (h *AuthHandlers) registerWebAuthnRoutes(r fiber.Router) {
+	r.Post("/webauthn/login/begin", h.beginPasskeyLogin)
+	r.Post("/webauthn/login/finish", middleware.RateLimit(h.Limiter, middleware.RateLimitConfig{
+		Name:   "passkey_verify",
+		Limit:  ratelimit.PerMinute(h.VerifyPerIPMin),
+		Key:    middleware.KeyByIP,
+		Err:    middleware.ErrTooManyAttempts,
+		Logger: h.Logger,
+	}), h.finishPasskeyLogin)
+}
+
+// registerProtectedWebAuthnRoutes registers passkey management for the current user
+func (h *AuthHandlers) registerProtectedWebAuthnRoutes(r fiber.Router) {
+	r.Post("/webauthn/register/code", h.requestPasskeyCode)
+	r.Post("/webauthn/register/begin", h.beginPasskeyRegistration)
+	r.Post("/webauthn/register/finish", h.finishPasskeyRegistration)
+	r.Get("/webauthn/credentials", h.listPasskeys)
+	r.Delete("/webauthn/credentials/:id", h.deletePasskey)
+}
+
+// beginPasskeyLogin
+// @Summary Begin passkey login
+// @Description Returns the options for navigator.credentials.get. No account is named, the browser offers the passkeys it holds for this site.
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} webAuthnAssertionResp
+// @Router /api/auth/webauthn/login/begin [post]
+func (h *AuthHandlers) beginPasskeyLogin(c *fiber.Ctx) error {
+	assertion, sessionID, err := h.WebAuthn.BeginLogin(c.UserContext())
+	if err != nil {
+		return err
+	}
+	return c.JSON(webAuthnAssertionResp{
+		SessionID: sessionID,
+		Options:   assertion,
+		ExpiresIn: int(h.WebAuthn.SessionTTL().Seconds()),
+	})
+}
+
+// finishPasskeyLogin
+// @Summary Finish passkey login
+// @Description Verifies the credential returned by navigator.credentials.get and issues tokens. The authenticator verified the user with a PIN or biometrics, so no second factor is asked for. Each session can be finished once.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param data body webAuthnFinishReq true "Assertion"
+// @Success 200 {object} tokenResp
+// @Router /api/auth/webauthn/login/finish [post]
+func (h *AuthHandlers) finishPasskeyLogin(c *fiber.Ctx) error {
+	var req webAuthnFinishReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	uid, err := h.WebAuthn.FinishLogin(c.UserContext(), req.SessionID, req.Credential)
+	if err != nil {
+		return err
+	}
+	// the passkey outlives a soft deleted account
+	u, err := h.Users.GetByID(c.UserContext(), uid.String())
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return services.ErrPasskeyInvalid
+	}
+	if err != nil {
+		return err
+	}
+	if u.BlockedAt != nil {
+		return errAccountBlocked
+	}
+	refreshToken, err := h.Refresh.Issue(c.UserContext(), u.ID)
+	if err != nil {
+		return err
+	}
+	return h.respondTokens(c, refreshToken)
+}
+
+// requestPasskeyCode
+// @Summary Send passkey registration code
+// @Description Sends the code that confirms /api/auth/webauthn/register/begin to the phone of the account.
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} otpStatusResp
+// @Security BearerAuth
+// @Router /api/auth/webauthn/register/code [post]
+func (h *AuthHandlers) requestPasskeyCode(c *fiber.Ctx) error {
+	u, err := h.currentUser(c)
+	if err != nil {
+		return err
+	}
+	return sendCode(c, h.Logger, h.OTP, services.PurposePasskeyRegistration, u.Phone)
+}
+
+// beginPasskeyRegistration
+// @Summary Begin passkey registration
+// @Description Returns the options for navigator.credentials.create. Authenticators holding a passkey of the user already are excluded. Takes the code sent to the phone by /api/auth/webauthn/register/code: passkey logins skip the second factor, so a stolen access token must not be enough to add one.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param data body codeReq true "Code"
+// @Success 200 {object} webAuthnCreationResp
+// @Security BearerAuth
+// @Router /api/auth/webauthn/register/begin [post]
+func (h *AuthHandlers) beginPasskeyRegistration(c *fiber.Ctx) error {
+	var req codeReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	u, err := h.currentUser(c)
+	if err != nil {
+		return err
+	}
+	if err := h.OTP.Verify(c.UserContext(), services.PurposePasskeyRegistration, u.Phone, req.Code); err != nil {
+		return withOTPStatus(c, h.Logger, h.OTP, services.PurposePasskeyRegistration, u.Phone, err)
+	}
+	creation, sessionID, err := h.WebAuthn.BeginRegistration(c.UserContext(), u)
+	if err != nil {
+		return err
+	}
+	return c.JSON(webAuthnCreationResp{
+		SessionID: sessionID,
+		Options:   creation,
+		ExpiresIn: int(h.WebAuthn.SessionTTL().Seconds()),
+	})
+}
+
+// finishPasskeyRegistration
+// @Summary Finish passkey registration
+// @Description Verifies the credential returned by navigator.credentials.create and stores the passkey.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param data body webAuthnRegisterReq true "Attestation"
+// @Success 201 {object} models.WebAuthnCredential
+// @Security BearerAuth
+// @Router /api/auth/webauthn/register/finish [post]
+func (h *AuthHandlers) finishPasskeyRegistration(c *fiber.Ctx) error {
+	var req webAuthnRegisterReq
+	if err := validation.ParseBody(c, &req); err != nil {
+		return err
+	}
+	u, err := h.currentUser(c)
+	if err != nil {
+		return err
+	}
+	cred, err := h.WebAuthn.FinishRegistration(c.UserContext(), u, req.SessionID, req.Name, req.Credential)
+	if err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(cred)
+}
+
+// listPasskeys
+// @Summary List passkeys
+// @Tags Auth
+// @Produce json
+// @Success 200 {array} models.WebAuthnCredential
+// @Security BearerAuth
+// @Router /api/auth/webauthn/credentials [get]
+func (h *AuthHandlers) listPasskeys(c *fiber.Ctx) error {
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return errUnauthorized
+	}
+	creds, err := h.WebAuthn.Credentials(c.UserContext(), uid)
+	if err != nil {
+		return err
+	}
+	if creds == nil {
+		creds = []models.WebAuthnCredential{}
+	}
+	return c.JSON(creds)
+}
+
+// deletePasskey
+// @Summary Delete passkey
+// @Description Removes the passkey from the account. The authenticator keeps it until the user deletes it there, but it no longer signs in.
+// @Tags Auth
+// @Param id path string true "Passkey ID"
+// @Success 204
+// @Security BearerAuth
+// @Router /api/auth/webauthn/credentials/{id} [delete]
+func (h *AuthHandlers) deletePasskey(c *fiber.Ctx) error {
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return errUnauthorized
+	}
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return errInvalidPasskeyID
+	}
+	if err := h.WebAuthn.DeleteCredential(c.UserContext(), uid, id); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// currentUser loads the user of the access token
+func (h *AuthHandlers) currentUser(c *fiber.Ctx) (*models.User, error) {
+	uid, ok := middleware.GetUserID(c)
+	if !ok {
+		return nil, errUnauthorized
+	}
+	return h.Users.GetByID(c.UserContext(), uid.String())
+}
+
+// Normalize trims the session id
+func (r *webAuthnFinishReq) Normalize() {
+	r.SessionID = strings.TrimSpace(r.SessionID)
+}
+
+// Normalize trims the session id and the name
+func (r *webAuthnRegisterReq) Normalize() {
+	r.webAuthnFinishReq.Normalize()
+	r.Name = strings.TrimSpace(r.Name)
+}
@@ -0,0 +1,76 @@
+package routes
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/middleware"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/phone"
+	"github.com/rznas/zeus/internal/repositories"
+	"github.com/rznas/zeus/internal/services"
+)
+
+// noPasskeys is a repositories.WebAuthnRepository of a user without passkeys
+type noPasskeys struct {
+	repositories.WebAuthnRepository
+}
+
+func (noPasskeys) ListByUser(context.Context, string) ([]models.WebAuthnCredential, error) {
+	return nil, nil
+}
+
+func TestPasskeyRegistration_RequiresCode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	webAuthn, err := services.NewWebAuthnService(noPasskeys{}, rdb, services.WebAuthnOptions{RPID: "localhost", RPOrigins: []string{"http://localhost:3000"}})
+	if err != nil {
+		t.Fatalf("webauthn: %v", err)
+	}
+	sms := &lastMessage{}
+	ada := &models.User{ID: uuid.New(), Phone: "+12025550100"}
+	h := &AuthHandlers{
+		Users:    newMemoryUsers(ada),
+		OTP:      services.NewOTPService(rdb, sms, phone.NewParser("US"), services.OTPOptions{TTLSeconds: 60, RateLimitPerMin: 5, RateLimitTimeoutSeconds: 60, MaxAttempts: 5, LockoutSeconds: 60}),
+		WebAuthn: webAuthn,
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	app := fiber.New(fiber.Config{ErrorHandler: middleware.ErrorHandler})
+	h.registerProtectedWebAuthnRoutes(app.Group("", asUser(ada.ID)))
+
+	// an access token alone doesn't add a passkey
+	if status, out := call(t, app, "POST", "/webauthn/register/begin", `{}`); status != fiber.StatusBadRequest || out["code"] != "validation_failed" {
+		t.Fatalf("expected a code to be required, got %d %v", status, out)
+	}
+	if status, out := call(t, app, "POST", "/webauthn/register/begin", `{"code": "123456"}`); status != fiber.StatusUnauthorized || out["code"] != "otp_expired" {
+		t.Fatalf("expected otp_expired without a code sent, got %d %v", status, out)
+	}
+
+	if status, out := call(t, app, "POST", "/webauthn/register/code", ""); status != fiber.StatusOK || out["sent"] != true || sms.to != ada.Phone {
+		t.Fatalf("expected a code sent to the phone, got %d %v to %s", status, out, sms.to)
+	}
+	code := sms.code()
+
+	// a login code for the same phone is no confirmation
+	if _, err := h.OTP.Generate(context.Background(), services.PurposeLogin, ada.Phone); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if status, out := call(t, app, "POST", "/webauthn/register/begin", `{"code": "`+sms.code()+`"}`); status != fiber.StatusUnauthorized {
+		t.Fatalf("expected a login code to be refused, got %d %v", status, out)
+	}
+
+	if status, out := call(t, app, "POST", "/webauthn/register/begin", `{"code": "`+code+`"}`); status != fiber.StatusOK || out["session_id"] == "" || out["options"] == nil {
+		t.Fatalf("expected registration options, got %d %v", status, out)
+	}
+	if status, out := call(t, app, "POST", "/webauthn/register/begin", `{"code": "`+code+`"}`); status != fiber.StatusUnauthorized || out["code"] != "otp_expired" {
+		t.Fatalf("expected the code to be used up, got %d %v", status, out)
+	}
+}
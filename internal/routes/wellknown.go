@@ -0,0 +1,42 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/rznas/zeus/internal/services"
+)
+
+type WellKnownHandlers struct {
+	JWT *services.JWTService
+	// OIDC publishes the provider metadata
+	OIDC *services.OIDCService
+}
+
+func (h *WellKnownHandlers) RegisterRoutes(r fiber.Router) {
+	r.Get("/jwks.json", h.jwks)
+	r.Get("/openid-configuration", h.openIDConfiguration)
+}
+
+// jwks
+// @Summary JSON Web Key Set
+// @Description Public keys for verifying tokens issued by this service. Empty when tokens are signed with a shared secret.
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} services.JWKS
+// @Router /.well-known/jwks.json [get]
+func (h *WellKnownHandlers) jwks(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(h.JWT.JWKS())
+}
+
+// openIDConfiguration
+// @Summary OpenID Connect discovery
+// @Description Metadata of the OpenID Connect provider, from which client libraries find the endpoints and keys.
+// @Tags OAuth
+// @Produce json
+// @Success 200 {object} services.Discovery
+// @Router /.well-known/openid-configuration [get]
+func (h *WellKnownHandlers) openIDConfiguration(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(h.OIDC.Discovery())
+}
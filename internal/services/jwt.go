@@ -1,19 +1,52 @@
 package services
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+
+	"github.com/rznas/zeus/internal/metrics"
 )
 
+// JWTService signs and verifies access tokens.
+//
+// It either uses a single shared HS256 secret, or a set of asymmetric
+// SigningKeys identified by kid. With signing keys, the newest key whose
+// activation time has passed signs new tokens; superseded keys keep verifying
+// tokens (and stay published in the JWKS) for the overlap window.
 type JWTService struct {
 	secret         []byte
+	keys           []*SigningKey
+	overlap        time.Duration
 	expiresMinutes int
 }
 
 type Claims struct {
 	UserID string `json:"uid"`
+	// SessionID links the access token to the refresh token family it was issued with
+	SessionID string `json:"sid,omitempty"`
+	// Roles are the rbac roles the user held when the token was issued
+	Roles []string `json:"roles,omitempty"`
+	// ClientID is set on tokens issued to an OpenID Connect client, which
+	// only open the userinfo endpoint, never the rest of the API
+	ClientID string `json:"client_id,omitempty"`
+	// Scope is the space separated list of scopes the user granted the client
+	Scope string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// IDTokenClaims are the claims of an OpenID Connect ID token. The profile
+// claims are filled according to the scopes the user granted.
+type IDTokenClaims struct {
+	Nonce string `json:"nonce,omitempty"`
+	// AuthorizedParty is the client the token was issued to
+	AuthorizedParty string `json:"azp,omitempty"`
+	UserProfile
 	jwt.RegisteredClaims
 }
 
@@ -21,28 +54,190 @@ func NewJWTService(secret string, expiresMinutes int) *JWTService {
 	return &JWTService{secret: []byte(secret), expiresMinutes: expiresMinutes}
 }
 
-func (j *JWTService) Generate(userID uuid.UUID) (string, error) {
+// NewKeyedJWTService creates a JWT service signing with asymmetric keys.
+// overlapMinutes is how long a key keeps verifying tokens after its successor
+// became active; it should be at least the access token lifetime.
+func NewKeyedJWTService(keys []*SigningKey, overlapMinutes int, expiresMinutes int) (*JWTService, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one signing key is required")
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if seen[k.ID] {
+			return nil, fmt.Errorf("duplicate signing key id %q", k.ID)
+		}
+		seen[k.ID] = true
+	}
+	sorted := append([]*SigningKey(nil), keys...)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return sorted[a].ActivatesAt.Before(sorted[b].ActivatesAt)
+	})
+	return &JWTService{
+		keys:           sorted,
+		overlap:        time.Duration(overlapMinutes) * time.Minute,
+		expiresMinutes: expiresMinutes,
+	}, nil
+}
+
+// TTL returns the lifetime of an access token
+func (j *JWTService) TTL() time.Duration {
+	return time.Duration(j.expiresMinutes) * time.Minute
+}
+
+func (j *JWTService) Generate(userID uuid.UUID, sessionID string, roles []string) (string, error) {
 	expiresAt := time.Now().Add(time.Duration(j.expiresMinutes) * time.Minute)
 	claims := &Claims{
-		UserID: userID.String(),
+		UserID:    userID.String(),
+		SessionID: sessionID,
+		Roles:     roles,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
 			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return t.SignedString(j.secret)
+	token, err := j.sign(claims)
+	if err != nil {
+		metrics.JWTIssued.WithLabelValues("error").Inc()
+		return "", err
+	}
+	metrics.JWTIssued.WithLabelValues("ok").Inc()
+	return token, nil
+}
+
+// GenerateClientToken signs an access token for an OpenID Connect client.
+// Unlike the tokens from Generate it carries no roles and is bound to the
+// client by its audience.
+func (j *JWTService) GenerateClientToken(issuer string, userID uuid.UUID, clientID, scope string) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		UserID:   userID.String(),
+		ClientID: clientID,
+		Scope:    scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    issuer,
+			Subject:   userID.String(),
+			Audience:  jwt.ClaimStrings{clientID},
+			ExpiresAt: jwt.NewNumericDate(now.Add(j.TTL())),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	token, err := j.sign(claims)
+	if err != nil {
+		metrics.JWTIssued.WithLabelValues("error").Inc()
+		return "", err
+	}
+	metrics.JWTIssued.WithLabelValues("ok").Inc()
+	return token, nil
+}
+
+// GenerateIDToken signs an OpenID Connect ID token. The caller sets issuer,
+// subject, audience and nonce; the token lives as long as an access token.
+func (j *JWTService) GenerateIDToken(claims *IDTokenClaims) (string, error) {
+	now := time.Now()
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(j.TTL()))
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	token, err := j.sign(claims)
+	if err != nil {
+		metrics.JWTIssued.WithLabelValues("error").Inc()
+		return "", err
+	}
+	metrics.JWTIssued.WithLabelValues("ok").Inc()
+	return token, nil
+}
+
+// SigningAlgorithms returns the algs of the keys tokens may currently be signed with
+func (j *JWTService) SigningAlgorithms() []string {
+	if len(j.keys) == 0 {
+		return []string{jwt.SigningMethodHS256.Alg()}
+	}
+	var algs []string
+	for _, k := range j.verificationKeys(time.Now()) {
+		if !slices.Contains(algs, k.Method.Alg()) {
+			algs = append(algs, k.Method.Alg())
+		}
+	}
+	return algs
+}
+
+func (j *JWTService) sign(claims jwt.Claims) (string, error) {
+	if len(j.keys) == 0 {
+		t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return t.SignedString(j.secret)
+	}
+	key := j.activeKey(time.Now())
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+	t := jwt.NewWithClaims(key.Method, claims)
+	t.Header["kid"] = key.ID
+	return t.SignedString(key.Private)
 }
 
 func (j *JWTService) Parse(tokenStr string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return j.secret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, j.keyFunc)
 	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			metrics.JWTParsed.WithLabelValues("expired").Inc()
+		} else {
+			metrics.JWTParsed.WithLabelValues("invalid").Inc()
+		}
 		return nil, err
 	}
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+		metrics.JWTParsed.WithLabelValues("ok").Inc()
 		return claims, nil
 	}
+	metrics.JWTParsed.WithLabelValues("invalid").Inc()
 	return nil, jwt.ErrTokenInvalidClaims
 }
+
+func (j *JWTService) keyFunc(token *jwt.Token) (interface{}, error) {
+	if len(j.keys) == 0 {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return j.secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	for _, k := range j.verificationKeys(time.Now()) {
+		if k.ID != kid {
+			continue
+		}
+		if token.Method.Alg() != k.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), kid)
+		}
+		return k.Public, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// activeKey returns the most recently activated key, keys are sorted by activation
+func (j *JWTService) activeKey(now time.Time) *SigningKey {
+	var active *SigningKey
+	for _, k := range j.keys {
+		if k.ActivatesAt.After(now) {
+			break
+		}
+		active = k
+	}
+	return active
+}
+
+// verificationKeys returns the active key, keys scheduled to become active
+// (so verifiers can cache them ahead of time) and retired keys still inside
+// the overlap window.
+func (j *JWTService) verificationKeys(now time.Time) []*SigningKey {
+	var keys []*SigningKey
+	for i, k := range j.keys {
+		if i+1 < len(j.keys) {
+			successor := j.keys[i+1].ActivatesAt
+			if !successor.After(now) && now.Sub(successor) > j.overlap {
+				continue
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -1,16 +1,27 @@
 package services
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
 func TestJWTService_GenerateParse(t *testing.T) {
 	svc := NewJWTService("secret", 1)
 	uid := uuid.New()
-	tok, err := svc.Generate(uid)
+	tok, err := svc.Generate(uid, "", []string{"admin"})
 	if err != nil || tok == "" {
 		t.Fatalf("generate: %v, tok=%q", err, tok)
 	}
@@ -21,12 +32,18 @@ func TestJWTService_GenerateParse(t *testing.T) {
 	if claims.UserID != uid.String() {
 		t.Fatalf("expected uid %s, got %s", uid, claims.UserID)
 	}
+	if claims.ID == "" {
+		t.Fatalf("expected jti to be set")
+	}
+	if len(claims.Roles) != 1 || claims.Roles[0] != "admin" {
+		t.Fatalf("expected roles [admin], got %v", claims.Roles)
+	}
 }
 
 func TestJWTService_Expired(t *testing.T) {
 	svc := NewJWTService("secret", 0)
 	uid := uuid.New()
-	tok, err := svc.Generate(uid)
+	tok, err := svc.Generate(uid, "", nil)
 	if err != nil {
 		t.Fatalf("generate: %v", err)
 	}
@@ -35,4 +52,154 @@ func TestJWTService_Expired(t *testing.T) {
 	if err == nil {
 		t.Fatalf("expected error for expired token")
 	}
-} 
\ No newline at end of file
+}
+
+func writeKeyPEM(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return path
+}
+
+func TestJWTService_AsymmetricKeys(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	cases := []struct {
+		key     crypto.Signer
+		alg     string
+		kty     string
+		keyType string
+	}{
+		{rsaKey, "RS256", "RSA", "rsa"},
+		{ecKey, "ES256", "EC", "ec"},
+		{edKey, "EdDSA", "OKP", "ed25519"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.keyType, func(t *testing.T) {
+			key, err := LoadSigningKey(tc.keyType, writeKeyPEM(t, tc.key), time.Time{})
+			if err != nil {
+				t.Fatalf("load key: %v", err)
+			}
+			if key.Method.Alg() != tc.alg {
+				t.Fatalf("expected alg %s, got %s", tc.alg, key.Method.Alg())
+			}
+			svc, err := NewKeyedJWTService([]*SigningKey{key}, 60, 1)
+			if err != nil {
+				t.Fatalf("new service: %v", err)
+			}
+			uid := uuid.New()
+			tok, err := svc.Generate(uid, "", nil)
+			if err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+			claims, err := svc.Parse(tok)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if claims.UserID != uid.String() {
+				t.Fatalf("expected uid %s, got %s", uid, claims.UserID)
+			}
+			jwks := svc.JWKS()
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != tc.keyType || jwks.Keys[0].Kty != tc.kty {
+				t.Fatalf("unexpected jwks: %+v", jwks)
+			}
+		})
+	}
+}
+
+func TestJWTService_KeyRotation(t *testing.T) {
+	newKey := func(id string, activatesAt time.Time) *SigningKey {
+		k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		key := mustParseKey(t, k)
+		key.ID = id
+		key.ActivatesAt = activatesAt
+		return key
+	}
+	now := time.Now()
+	retired := newKey("retired", now.Add(-3*time.Hour))
+	previous := newKey("previous", now.Add(-2*time.Hour))
+	current := newKey("current", now.Add(-10*time.Minute))
+	upcoming := newKey("upcoming", now.Add(time.Hour))
+
+	svc, err := NewKeyedJWTService([]*SigningKey{upcoming, current, previous, retired}, 30, 1)
+	if err != nil {
+		t.Fatalf("new service: %v", err)
+	}
+
+	tok, err := svc.Generate(uuid.New(), "", nil)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if kid := headerKid(t, tok); kid != "current" {
+		t.Fatalf("expected token signed by current key, got %q", kid)
+	}
+
+	var kids []string
+	for _, k := range svc.JWKS().Keys {
+		kids = append(kids, k.Kid)
+	}
+	// previous is still inside the 30 minute overlap, retired is not
+	if len(kids) != 3 || kids[0] != "previous" || kids[1] != "current" || kids[2] != "upcoming" {
+		t.Fatalf("unexpected published keys %v", kids)
+	}
+
+	for _, tc := range []struct {
+		key   *SigningKey
+		valid bool
+	}{{previous, true}, {retired, false}} {
+		old, _ := NewKeyedJWTService([]*SigningKey{tc.key}, 30, 1)
+		tok, err := old.Generate(uuid.New(), "", nil)
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+		if _, err := svc.Parse(tok); (err == nil) != tc.valid {
+			t.Fatalf("key %s: expected valid=%v, got err=%v", tc.key.ID, tc.valid, err)
+		}
+	}
+}
+
+func TestJWTService_RejectsSecretTokensWhenKeyed(t *testing.T) {
+	k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	svc, err := NewKeyedJWTService([]*SigningKey{mustParseKey(t, k)}, 30, 1)
+	if err != nil {
+		t.Fatalf("new service: %v", err)
+	}
+	tok, err := NewJWTService("secret", 1).Generate(uuid.New(), "", nil)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if _, err := svc.Parse(tok); err == nil {
+		t.Fatalf("expected HS256 token to be rejected")
+	}
+}
+
+func mustParseKey(t *testing.T, key crypto.Signer) *SigningKey {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	k, err := ParseSigningKey("key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+	return k
+}
+
+func headerKid(t *testing.T, tok string) string {
+	t.Helper()
+	parsed, _, err := new(jwt.Parser).ParseUnverified(tok, &Claims{})
+	if err != nil {
+		t.Fatalf("parse unverified: %v", err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
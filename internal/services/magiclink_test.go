@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/email"
+)
+
+func TestMagicLinks(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	links := NewMagicLinks("https://app.example.com/login?from=mail", []byte("secret"), 5*time.Minute)
+	links.now = func() time.Time { return now }
+
+	link, err := url.Parse(links.URL("ada@example.com", "123456"))
+	if err != nil {
+		t.Fatalf("parse url: %v", err)
+	}
+	token := link.Query().Get("token")
+	if link.Query().Get("from") != "mail" || token == "" {
+		t.Fatalf("expected token next to the existing query, got %s", link)
+	}
+	addr, code, err := links.Parse(token)
+	if err != nil || addr != "ada@example.com" || code != "123456" {
+		t.Fatalf("expected round trip, got %q %q %v", addr, code, err)
+	}
+
+	// another secret, an edited payload and an expired link are all rejected
+	other := NewMagicLinks("https://app.example.com/login", []byte("other"), 5*time.Minute)
+	other.now = links.now
+	forged := other.Token("ada@example.com", "123456")
+	payload, sig, _ := strings.Cut(token, ".")
+	edited := strings.TrimSuffix(payload, "A") + "B." + sig
+	for name, tok := range map[string]string{"forged": forged, "edited": edited, "garbage": "not-a-token"} {
+		if _, _, err := links.Parse(tok); !errors.Is(err, ErrInvalidMagicLink) {
+			t.Errorf("%s: expected invalid link, got %v", name, err)
+		}
+	}
+	now = now.Add(5*time.Minute + time.Second)
+	if _, _, err := links.Parse(token); !errors.Is(err, ErrInvalidMagicLink) {
+		t.Errorf("expected expired link to be rejected, got %v", err)
+	}
+}
+
+type capturingSender struct {
+	to, message string
+}
+
+func (s *capturingSender) Send(_ context.Context, to, message string) error {
+	s.to, s.message = to, message
+	return nil
+}
+
+func TestEmailOTPWithMagicLink(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	links := NewMagicLinks("https://app.example.com/login", []byte("secret"), 5*time.Minute)
+	sender := &capturingSender{}
+	svc := NewOTPService(rdb, sender, email.Addresses{}, OTPOptions{
+		KeyPrefix:               "otp:email:",
+		Format:                  links.Message,
+		TTLSeconds:              300,
+		RateLimitPerMin:         3,
+		RateLimitTimeoutSeconds: 60,
+	})
+	ctx := context.Background()
+
+	code, err := svc.Generate(ctx, PurposeLogin, "Ada@Example.com")
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if !mr.Exists("otp:email:login:ada@example.com") {
+		t.Fatalf("expected the code under the email prefix, got keys %v", mr.Keys())
+	}
+	if !strings.Contains(sender.message, code) || !strings.Contains(sender.message, "valid for 5 minutes") {
+		t.Fatalf("expected code and link in message, got %q", sender.message)
+	}
+	token := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(sender.message)
+	if token == nil {
+		t.Fatalf("expected a link in %q", sender.message)
+	}
+	tok, _ := url.QueryUnescape(token[1])
+	addr, linkCode, err := links.Parse(tok)
+	if err != nil {
+		t.Fatalf("parse link: %v", err)
+	}
+	if err := svc.Verify(ctx, PurposeLogin, addr, linkCode); err != nil {
+		t.Fatalf("verify through link: %v", err)
+	}
+	// the link is as single-use as the code
+	if err := svc.Verify(ctx, PurposeLogin, addr, linkCode); !errors.Is(err, ErrOTPExpired) {
+		t.Fatalf("expected used link to fail, got %v", err)
+	}
+}
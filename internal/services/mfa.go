@@ -0,0 +1,468 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/metrics"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/repositories"
+	"github.com/rznas/zeus/internal/totp"
+)
+
+var (
+	// ErrTOTPAlreadyEnabled is returned when enrolling or confirming an app while one is enabled
+	ErrTOTPAlreadyEnabled = apperr.Conflict("totp_already_enabled", "authenticator app already enabled")
+	// ErrTOTPNotEnabled is returned when an operation needs an enrolled app and there is none
+	ErrTOTPNotEnabled = apperr.Conflict("totp_not_enabled", "no authenticator app enabled")
+	// ErrMFAInvalid is returned for wrong, reused or malformed authenticator and recovery codes
+	ErrMFAInvalid = apperr.Unauthorized("mfa_invalid", "invalid authentication code")
+	// ErrMFALocked is returned after too many wrong codes, with the seconds left in RetryAfter
+	ErrMFALocked = apperr.Locked("mfa_locked", "too many wrong authentication codes, try again later")
+	// ErrInvalidMFAToken is returned for unknown, expired or already completed login challenges
+	ErrInvalidMFAToken = apperr.Unauthorized("invalid_mfa_token", "mfa challenge is invalid or expired")
+)
+
+const (
+	// totpSkew is how many 30 second steps of clock drift are tolerated either way
+	totpSkew = 1
+	// recoveryCodeCount is the number of recovery codes handed out at once
+	recoveryCodeCount = 10
+	// recoveryCodeAlphabet leaves out i, l, o and u so codes can be read back without confusion
+	recoveryCodeAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+	recoveryCodeLength   = 10
+
+	defaultMFAIssuer       = "Zeus"
+	defaultChallengeTTL    = 5 * time.Minute
+	defaultMFAMaxAttempts  = 5
+	defaultMFALockoutDelay = 5 * time.Minute
+)
+
+// MFAOptions configures the authenticator app second factor
+type MFAOptions struct {
+	// Secret encrypts TOTP secrets at rest and keys the HMAC of recovery codes.
+	// Changing it makes every enrolled app and recovery code unusable.
+	Secret []byte
+	// Issuer names the account in authenticator apps, empty means "Zeus"
+	Issuer string
+	// ChallengeSeconds is how long the second step of a login may take, zero means 300
+	ChallengeSeconds int
+	// MaxAttempts is the number of wrong codes per user after which the second
+	// factor is locked for LockoutSeconds, counted from the first wrong code.
+	// Zero means 5.
+	MaxAttempts    int
+	LockoutSeconds int
+}
+
+// MFAService manages the authenticator app (TOTP) second factor of users:
+// enrollment, recovery codes and the challenges that stand between a
+// successful first factor and the access token.
+//
+// TOTP secrets are stored in Postgres, encrypted with AES-256-GCM; recovery
+// codes only as HMACs. Challenges, replay protection and attempt counters
+// live in Redis.
+type MFAService struct {
+	repo         repositories.MFARepository
+	redis        *redisv9.Client
+	aead         cipher.AEAD
+	hashKey      []byte
+	issuer       string
+	challengeTTL time.Duration
+	maxAttempts  int
+	lockout      time.Duration
+	now          func() time.Time
+}
+
+// TOTPEnrollment is what the user needs to add the account to their app
+type TOTPEnrollment struct {
+	Secret string
+	// URI is the otpauth:// URI to render as a QR code
+	URI string
+}
+
+// MFAStatus describes the second factors of a user
+type MFAStatus struct {
+	TOTPEnabled            bool
+	RecoveryCodesRemaining int
+}
+
+func NewMFAService(repo repositories.MFARepository, client *redisv9.Client, opts MFAOptions) (*MFAService, error) {
+	if len(opts.Secret) == 0 {
+		return nil, errors.New("mfa secret cannot be empty")
+	}
+	block, err := aes.NewCipher(deriveKey(opts.Secret, "zeus totp secret"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &MFAService{
+		repo:         repo,
+		redis:        client,
+		aead:         aead,
+		hashKey:      deriveKey(opts.Secret, "zeus recovery code"),
+		issuer:       opts.Issuer,
+		challengeTTL: time.Duration(opts.ChallengeSeconds) * time.Second,
+		maxAttempts:  opts.MaxAttempts,
+		lockout:      time.Duration(opts.LockoutSeconds) * time.Second,
+		now:          time.Now,
+	}
+	if s.issuer == "" {
+		s.issuer = defaultMFAIssuer
+	}
+	if s.challengeTTL <= 0 {
+		s.challengeTTL = defaultChallengeTTL
+	}
+	if s.maxAttempts <= 0 {
+		s.maxAttempts = defaultMFAMaxAttempts
+	}
+	if s.lockout <= 0 {
+		s.lockout = defaultMFALockoutDelay
+	}
+	return s, nil
+}
+
+// deriveKey gives every use of the configured secret its own 256 bit key
+func deriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// ChallengeTTL returns how long a login challenge is valid
+func (s *MFAService) ChallengeTTL() time.Duration {
+	return s.challengeTTL
+}
+
+func (s *MFAService) challengeKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "mfa:challenge:" + hex.EncodeToString(sum[:])
+}
+
+func (s *MFAService) attemptsKey(userID uuid.UUID) string {
+	return "mfa:attempts:" + userID.String()
+}
+
+func (s *MFAService) usedStepKey(userID uuid.UUID, step int64) string {
+	return "mfa:used:" + userID.String() + ":" + strconv.FormatInt(step, 10)
+}
+
+// Enroll starts adding an authenticator app, replacing an unconfirmed one.
+// The app is only enforced once Confirm received a code from it. account
+// labels the entry in the app, e.g. the phone.
+func (s *MFAService) Enroll(ctx context.Context, userID uuid.UUID, account string) (*TOTPEnrollment, error) {
+	existing, err := s.repo.GetTOTP(ctx, userID.String())
+	if err != nil && !errors.Is(err, repositories.ErrTOTPNotFound) {
+		return nil, err
+	}
+	if existing != nil && existing.ConfirmedAt != nil {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.seal(userID, secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SaveTOTP(ctx, &models.UserTOTP{UserID: userID, Secret: sealed}); err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{Secret: secret, URI: totp.URI(s.issuer, account, secret)}, nil
+}
+
+// Confirm enables the enrolled app with a code from it and returns the
+// recovery codes, which are shown to the user this once
+func (s *MFAService) Confirm(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	rec, err := s.repo.GetTOTP(ctx, userID.String())
+	if errors.Is(err, repositories.ErrTOTPNotFound) {
+		return nil, ErrTOTPNotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rec.ConfirmedAt != nil {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if err := s.check(ctx, userID, func() (bool, error) {
+		return s.checkTOTP(ctx, rec, code)
+	}); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := s.newRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.ConfirmTOTP(ctx, userID.String(), hashes); err != nil {
+		if errors.Is(err, repositories.ErrTOTPNotFound) {
+			return nil, ErrTOTPNotEnabled
+		}
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Enabled reports whether the user has to pass the second factor at login
+func (s *MFAService) Enabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	rec, err := s.repo.GetTOTP(ctx, userID.String())
+	if errors.Is(err, repositories.ErrTOTPNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return rec.ConfirmedAt != nil, nil
+}
+
+// Status returns whether the app is enabled and how many recovery codes are left
+func (s *MFAService) Status(ctx context.Context, userID uuid.UUID) (MFAStatus, error) {
+	enabled, err := s.Enabled(ctx, userID)
+	if err != nil || !enabled {
+		return MFAStatus{}, err
+	}
+	n, err := s.repo.CountRecoveryCodes(ctx, userID.String())
+	if err != nil {
+		return MFAStatus{}, err
+	}
+	return MFAStatus{TOTPEnabled: true, RecoveryCodesRemaining: int(n)}, nil
+}
+
+// Verify checks a code from the app, or an unused recovery code, which is
+// used up by it. Codes from the app are accepted once each.
+func (s *MFAService) Verify(ctx context.Context, userID uuid.UUID, code string) error {
+	rec, err := s.repo.GetTOTP(ctx, userID.String())
+	if errors.Is(err, repositories.ErrTOTPNotFound) {
+		return ErrTOTPNotEnabled
+	}
+	if err != nil {
+		return err
+	}
+	if rec.ConfirmedAt == nil {
+		return ErrTOTPNotEnabled
+	}
+	return s.check(ctx, userID, func() (bool, error) {
+		if normalized := normalizeRecoveryCode(code); len(normalized) == recoveryCodeLength {
+			ok, err := s.repo.UseRecoveryCode(ctx, userID.String(), s.hashRecoveryCode(userID, normalized))
+			if ok {
+				metrics.MFAVerified.WithLabelValues("recovery_code").Inc()
+			}
+			return ok, err
+		}
+		ok, err := s.checkTOTP(ctx, rec, code)
+		if ok {
+			metrics.MFAVerified.WithLabelValues("totp").Inc()
+		}
+		return ok, err
+	})
+}
+
+// Disable removes the app and the recovery codes after checking a code
+func (s *MFAService) Disable(ctx context.Context, userID uuid.UUID, code string) error {
+	if err := s.Verify(ctx, userID, code); err != nil {
+		return err
+	}
+	return s.repo.DeleteTOTP(ctx, userID.String())
+}
+
+// Reset removes the app and the recovery codes of a user who lost both
+func (s *MFAService) Reset(ctx context.Context, userID uuid.UUID) error {
+	return s.repo.DeleteTOTP(ctx, userID.String())
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a code
+func (s *MFAService) RegenerateRecoveryCodes(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	if err := s.Verify(ctx, userID, code); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := s.newRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.ReplaceRecoveryCodes(ctx, userID.String(), hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Challenge returns an opaque token standing for a login that passed its
+// first factor and still needs the second one
+func (s *MFAService) Challenge(ctx context.Context, userID uuid.UUID) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if err := s.redis.Set(ctx, s.challengeKey(token), userID.String(), s.challengeTTL).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// CompleteChallenge verifies the second factor of a login challenge and
+// returns the user it belongs to. A wrong code leaves the challenge open for
+// another try, up to the per-user attempt limit.
+func (s *MFAService) CompleteChallenge(ctx context.Context, token, code string) (uuid.UUID, error) {
+	key := s.challengeKey(token)
+	raw, err := s.redis.Get(ctx, key).Result()
+	if errors.Is(err, redisv9.Nil) {
+		return uuid.Nil, ErrInvalidMFAToken
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	userID, err := uuid.Parse(raw)
+	if err != nil {
+		return uuid.Nil, ErrInvalidMFAToken
+	}
+	if err := s.Verify(ctx, userID, code); err != nil {
+		return uuid.Nil, err
+	}
+	// only one of two concurrent completions gets the tokens
+	n, err := s.redis.Del(ctx, key).Result()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if n == 0 {
+		return uuid.Nil, ErrInvalidMFAToken
+	}
+	return userID, nil
+}
+
+// check runs verify unless the user is locked out. The attempt is counted
+// before verify runs, so parallel guesses can't all pass the check before any
+// of them is counted; success clears the count.
+func (s *MFAService) check(ctx context.Context, userID uuid.UUID, verify func() (bool, error)) error {
+	key := s.attemptsKey(userID)
+	pipe := s.redis.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.ExpireNX(ctx, key, s.lockout)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if incr.Val() > int64(s.maxAttempts) {
+		metrics.MFAVerified.WithLabelValues("locked").Inc()
+		return s.locked(ctx, key)
+	}
+	ok, err := verify()
+	if err != nil {
+		return err
+	}
+	if ok {
+		return s.redis.Del(ctx, key).Err()
+	}
+	metrics.MFAVerified.WithLabelValues("invalid").Inc()
+	if incr.Val() >= int64(s.maxAttempts) {
+		return s.locked(ctx, key)
+	}
+	return ErrMFAInvalid
+}
+
+func (s *MFAService) locked(ctx context.Context, key string) error {
+	ttl, err := s.redis.PTTL(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		ttl = s.lockout
+	}
+	return ErrMFALocked.WithRetryAfter(ttl)
+}
+
+// checkTOTP validates code against the enrolled secret and marks its time
+// step as used, so a code seen over someone's shoulder can't be replayed
+func (s *MFAService) checkTOTP(ctx context.Context, rec *models.UserTOTP, code string) (bool, error) {
+	secret, err := s.open(rec.UserID, rec.Secret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := totp.Validate(secret, strings.TrimSpace(code), s.now(), totpSkew)
+	if !ok {
+		return false, nil
+	}
+	// a step can't be accepted any more once it fell out of the skew window
+	window := time.Duration(2*totpSkew+1) * totp.Period
+	fresh, err := s.redis.SetNX(ctx, s.usedStepKey(rec.UserID, step), 1, window).Result()
+	if err != nil {
+		return false, err
+	}
+	return fresh, nil
+}
+
+// seal encrypts a TOTP secret, bound to the user so rows can't be swapped
+func (s *MFAService) seal(userID uuid.UUID, secret string) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, []byte(secret), userID[:]), nil
+}
+
+func (s *MFAService) open(userID uuid.UUID, sealed []byte) (string, error) {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("totp secret: sealed value too short")
+	}
+	plain, err := s.aead.Open(nil, sealed[:n], sealed[n:], userID[:])
+	if err != nil {
+		return "", fmt.Errorf("totp secret: %w", err)
+	}
+	return string(plain), nil
+}
+
+// newRecoveryCodes returns codes formatted for display and their HMACs
+func (s *MFAService) newRecoveryCodes(userID uuid.UUID) ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	size := big.NewInt(int64(len(recoveryCodeAlphabet)))
+	for i := range codes {
+		b := make([]byte, recoveryCodeLength)
+		for j := range b {
+			n, err := rand.Int(rand.Reader, size)
+			if err != nil {
+				return nil, nil, err
+			}
+			b[j] = recoveryCodeAlphabet[n.Int64()]
+		}
+		raw := string(b)
+		codes[i] = raw[:recoveryCodeLength/2] + "-" + raw[recoveryCodeLength/2:]
+		hashes[i] = s.hashRecoveryCode(userID, raw)
+	}
+	return codes, hashes, nil
+}
+
+func (s *MFAService) hashRecoveryCode(userID uuid.UUID, normalized string) string {
+	mac := hmac.New(sha256.New, s.hashKey)
+	mac.Write(userID[:])
+	mac.Write([]byte(normalized))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// normalizeRecoveryCode accepts codes typed with or without the dash, in any case
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/repositories"
+	"github.com/rznas/zeus/internal/totp"
+)
+
+// memoryMFARepo is an in-memory repositories.MFARepository
+type memoryMFARepo struct {
+	mu    sync.Mutex
+	totps map[string]models.UserTOTP
+	codes map[string]map[string]bool // user -> hash -> used
+	// delay slows recovery code lookups down like a database round trip
+	delay   time.Duration
+	lookups int
+}
+
+func newMemoryMFARepo() *memoryMFARepo {
+	return &memoryMFARepo{totps: map[string]models.UserTOTP{}, codes: map[string]map[string]bool{}}
+}
+
+func (r *memoryMFARepo) GetTOTP(_ context.Context, userID string) (*models.UserTOTP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.totps[userID]
+	if !ok {
+		return nil, repositories.ErrTOTPNotFound
+	}
+	return &rec, nil
+}
+
+func (r *memoryMFARepo) SaveTOTP(_ context.Context, rec *models.UserTOTP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.totps[rec.UserID.String()] = *rec
+	delete(r.codes, rec.UserID.String())
+	return nil
+}
+
+func (r *memoryMFARepo) ConfirmTOTP(_ context.Context, userID string, hashes []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.totps[userID]
+	if !ok || rec.ConfirmedAt != nil {
+		return repositories.ErrTOTPNotFound
+	}
+	now := time.Now()
+	rec.ConfirmedAt = &now
+	r.totps[userID] = rec
+	r.replace(userID, hashes)
+	return nil
+}
+
+func (r *memoryMFARepo) DeleteTOTP(_ context.Context, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.totps, userID)
+	delete(r.codes, userID)
+	return nil
+}
+
+func (r *memoryMFARepo) ReplaceRecoveryCodes(_ context.Context, userID string, hashes []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replace(userID, hashes)
+	return nil
+}
+
+func (r *memoryMFARepo) replace(userID string, hashes []string) {
+	r.codes[userID] = map[string]bool{}
+	for _, h := range hashes {
+		r.codes[userID][h] = false
+	}
+}
+
+func (r *memoryMFARepo) UseRecoveryCode(_ context.Context, userID, hash string) (bool, error) {
+	time.Sleep(r.delay)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	used, ok := r.codes[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+	r.codes[userID][hash] = true
+	return true, nil
+}
+
+func (r *memoryMFARepo) CountRecoveryCodes(_ context.Context, userID string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, used := range r.codes[userID] {
+		if !used {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func newTestMFAService(t *testing.T) (*MFAService, *miniredis.Miniredis, *memoryMFARepo) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	repo := newMemoryMFARepo()
+	svc, err := NewMFAService(repo, rdb, MFAOptions{Secret: []byte("test-mfa-secret"), MaxAttempts: 3, LockoutSeconds: 300})
+	if err != nil {
+		t.Fatalf("new mfa service: %v", err)
+	}
+	// a fixed clock keeps codes from crossing a step boundary mid-test
+	now := time.Now()
+	svc.now = func() time.Time { return now }
+	return svc, mr, repo
+}
+
+// codeAt returns the app's code for the enrolled secret at now+offset steps
+func codeAt(t *testing.T, svc *MFAService, secret string, offset int64) string {
+	t.Helper()
+	code, err := totp.Code(secret, totp.Step(svc.now())+offset)
+	if err != nil {
+		t.Fatalf("code: %v", err)
+	}
+	return code
+}
+
+func TestMFAService_EnrollConfirmVerify(t *testing.T) {
+	svc, _, repo := newTestMFAService(t)
+	ctx := context.Background()
+	uid := uuid.New()
+
+	enrollment, err := svc.Enroll(ctx, uid, "+12025550100")
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/Zeus:") || !strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Fatalf("unexpected provisioning uri %q", enrollment.URI)
+	}
+	// the secret is stored encrypted and only opens for its user
+	stored, _ := repo.GetTOTP(ctx, uid.String())
+	if strings.Contains(string(stored.Secret), enrollment.Secret) {
+		t.Fatal("expected the secret to be encrypted at rest")
+	}
+	if _, err := svc.open(uuid.New(), stored.Secret); err == nil {
+		t.Fatal("expected the secret not to open for another user")
+	}
+	if enabled, _ := svc.Enabled(ctx, uid); enabled {
+		t.Fatal("expected an unconfirmed app not to be enforced")
+	}
+
+	if _, err := svc.Confirm(ctx, uid, "000000"); !errors.Is(err, ErrMFAInvalid) {
+		t.Fatalf("expected wrong confirmation code to fail, got %v", err)
+	}
+	codes, err := svc.Confirm(ctx, uid, codeAt(t, svc, enrollment.Secret, 0))
+	if err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %v", recoveryCodeCount, codes)
+	}
+	if _, err := svc.Enroll(ctx, uid, "+12025550100"); !errors.Is(err, ErrTOTPAlreadyEnabled) {
+		t.Fatalf("expected enrolling twice to fail, got %v", err)
+	}
+
+	// the confirmation code can't be replayed, the next step's code works
+	if err := svc.Verify(ctx, uid, codeAt(t, svc, enrollment.Secret, 0)); !errors.Is(err, ErrMFAInvalid) {
+		t.Fatalf("expected a used code to be rejected, got %v", err)
+	}
+	if err := svc.Verify(ctx, uid, codeAt(t, svc, enrollment.Secret, 1)); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	// recovery codes work once, typed in any case and without the dash
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	if err := svc.Verify(ctx, uid, typed); err != nil {
+		t.Fatalf("verify recovery code: %v", err)
+	}
+	if err := svc.Verify(ctx, uid, codes[0]); !errors.Is(err, ErrMFAInvalid) {
+		t.Fatalf("expected a used recovery code to be rejected, got %v", err)
+	}
+	st, err := svc.Status(ctx, uid)
+	if err != nil || !st.TOTPEnabled || st.RecoveryCodesRemaining != recoveryCodeCount-1 {
+		t.Fatalf("unexpected status %+v %v", st, err)
+	}
+
+	if err := svc.Disable(ctx, uid, codes[1]); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	if enabled, _ := svc.Enabled(ctx, uid); enabled {
+		t.Fatal("expected the app to be disabled")
+	}
+	if err := svc.Verify(ctx, uid, codes[2]); !errors.Is(err, ErrTOTPNotEnabled) {
+		t.Fatalf("expected recovery codes to be gone with the app, got %v", err)
+	}
+}
+
+func TestMFAService_Lockout(t *testing.T) {
+	svc, mr, _ := newTestMFAService(t)
+	ctx := context.Background()
+	uid := uuid.New()
+	enrollment, _ := svc.Enroll(ctx, uid, "+12025550100")
+	if _, err := svc.Confirm(ctx, uid, codeAt(t, svc, enrollment.Secret, 0)); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+
+	for i := range 2 {
+		if err := svc.Verify(ctx, uid, "000000"); !errors.Is(err, ErrMFAInvalid) {
+			t.Fatalf("attempt %d: expected invalid code, got %v", i+1, err)
+		}
+	}
+	err := svc.Verify(ctx, uid, "000000")
+	var appErr *apperr.Error
+	if !errors.As(err, &appErr) || appErr.Code != "mfa_locked" || appErr.RetryAfter != 300*time.Second {
+		t.Fatalf("expected lockout with retry after, got %v", err)
+	}
+	// while locked even the right code is refused
+	if err := svc.Verify(ctx, uid, codeAt(t, svc, enrollment.Secret, 1)); !errors.Is(err, ErrMFALocked) {
+		t.Fatalf("expected lockout to hold, got %v", err)
+	}
+
+	mr.FastForward(301 * time.Second)
+	if err := svc.Verify(ctx, uid, codeAt(t, svc, enrollment.Secret, 1)); err != nil {
+		t.Fatalf("expected verify to work after the lockout, got %v", err)
+	}
+}
+
+func TestMFAService_LockoutConcurrent(t *testing.T) {
+	svc, _, repo := newTestMFAService(t)
+	ctx := context.Background()
+	uid := uuid.New()
+	enrollment, _ := svc.Enroll(ctx, uid, "+12025550100")
+	if _, err := svc.Confirm(ctx, uid, codeAt(t, svc, enrollment.Secret, 0)); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	// guesses overlap while the recovery codes are looked up
+	repo.delay = 20 * time.Millisecond
+
+	var (
+		wg              sync.WaitGroup
+		mu              sync.Mutex
+		invalid, locked int
+	)
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := svc.Verify(ctx, uid, "aaaaa-aaaaa")
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, ErrMFAInvalid):
+				invalid++
+			case errors.Is(err, ErrMFALocked):
+				locked++
+			default:
+				t.Errorf("verify: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// parallel guesses get no more than MaxAttempts tries, the last one locks
+	if invalid != 2 || locked != 48 {
+		t.Fatalf("expected 2 invalid and 48 locked, got %d and %d", invalid, locked)
+	}
+	if repo.lookups != 3 {
+		t.Fatalf("expected 3 guesses to be checked, %d were", repo.lookups)
+	}
+}
+
+func TestMFAService_Challenge(t *testing.T) {
+	svc, mr, _ := newTestMFAService(t)
+	ctx := context.Background()
+	uid := uuid.New()
+	enrollment, _ := svc.Enroll(ctx, uid, "+12025550100")
+	if _, err := svc.Confirm(ctx, uid, codeAt(t, svc, enrollment.Secret, 0)); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+
+	token, err := svc.Challenge(ctx, uid)
+	if err != nil {
+		t.Fatalf("challenge: %v", err)
+	}
+	if _, err := svc.CompleteChallenge(ctx, "unknown", codeAt(t, svc, enrollment.Secret, 1)); !errors.Is(err, ErrInvalidMFAToken) {
+		t.Fatalf("expected unknown token to fail, got %v", err)
+	}
+	// a wrong code leaves the challenge open
+	if _, err := svc.CompleteChallenge(ctx, token, "000000"); !errors.Is(err, ErrMFAInvalid) {
+		t.Fatalf("expected invalid code, got %v", err)
+	}
+	got, err := svc.CompleteChallenge(ctx, token, codeAt(t, svc, enrollment.Secret, 1))
+	if err != nil || got != uid {
+		t.Fatalf("expected challenge of %s to complete, got %s %v", uid, got, err)
+	}
+	if _, err := svc.CompleteChallenge(ctx, token, codeAt(t, svc, enrollment.Secret, -1)); !errors.Is(err, ErrInvalidMFAToken) {
+		t.Fatalf("expected a completed challenge to be gone, got %v", err)
+	}
+
+	token, _ = svc.Challenge(ctx, uid)
+	mr.FastForward(svc.ChallengeTTL() + time.Second)
+	if _, err := svc.CompleteChallenge(ctx, token, codeAt(t, svc, enrollment.Secret, -1)); !errors.Is(err, ErrInvalidMFAToken) {
+		t.Fatalf("expected an expired challenge to fail, got %v", err)
+	}
+}
@@ -0,0 +1,716 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/repositories"
+)
+
+var (
+	// ErrUnknownClient is returned by Authorize for a client_id that is not registered
+	ErrUnknownClient = apperr.Invalid("invalid_client", "unknown client")
+	// ErrInvalidRedirectURI is returned by Authorize for a redirect_uri the client did not register
+	ErrInvalidRedirectURI = apperr.Invalid("invalid_redirect_uri", "redirect_uri is not registered for the client")
+	// ErrAuthorizationRequestNotFound is returned for unknown, expired or already answered authorization requests
+	ErrAuthorizationRequestNotFound = apperr.NotFound("authorization_request_not_found", "authorization request is invalid or expired")
+	// ErrPublicClient is returned when asking for the secret of a client that has none
+	ErrPublicClient = apperr.Conflict("public_client", "public clients have no secret")
+)
+
+// Scopes understood by the provider. openid is required, the others release
+// the matching claims about the user.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+	ScopePhone   = "phone"
+)
+
+// SupportedScopes lists the scopes in the order they are reported
+var SupportedScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopePhone}
+
+const (
+	defaultAuthorizationRequestTTL = 10 * time.Minute
+	defaultAuthorizationCodeTTL    = time.Minute
+)
+
+// codeChallengePattern matches a base64url encoded SHA-256 (RFC 7636 section 4.2)
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// codeVerifierPattern matches the unreserved characters of a PKCE verifier (RFC 7636 section 4.1)
+var codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// OAuthError is an error reported in OAuth 2.0 terms, either to the
+// redirect URI of an authorization request or in the body of a token
+// response (RFC 6749 sections 4.1.2.1 and 5.2)
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// Status is the HTTP status of a token response carrying the error
+func (e *OAuthError) Status() int {
+	if e.Code == "invalid_client" {
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
+
+func oauthError(code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+// OIDCOptions configures the OpenID Connect provider
+type OIDCOptions struct {
+	// Issuer is the public base URL of Zeus, the endpoints are published below it
+	Issuer string
+	// LoginURL is the page that signs the user in and asks for consent. It is
+	// opened with the request_id of the pending authorization request.
+	LoginURL string
+	// RequestSeconds is how long the login page may take, zero means 600
+	RequestSeconds int
+	// CodeSeconds is how long an authorization code can be exchanged, zero means 60
+	CodeSeconds int
+}
+
+// OIDCService makes Zeus an OpenID Connect provider for other applications,
+// implementing the authorization code flow with PKCE.
+//
+// Zeus has no pages of its own: /authorize checks the request, stores it in
+// Redis and sends the browser to the login page, which signs the user in
+// with the usual API and then approves or denies the request on their
+// behalf. Approving hands the client an authorization code, which the
+// client exchanges for an ID token and an access token for the userinfo
+// endpoint. Both are signed by JWTService.
+type OIDCService struct {
+	repo       repositories.OAuthRepository
+	users      repositories.UserRepository
+	redis      *redisv9.Client
+	jwt        *JWTService
+	issuer     string
+	loginURL   string
+	requestTTL time.Duration
+	codeTTL    time.Duration
+}
+
+// AuthorizeParams are the parameters of an authorization request
+// (OpenID Connect Core section 3.1.2.1)
+type AuthorizeParams struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	Prompt              string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// authorizationRequest is a checked authorization request waiting for the user
+type authorizationRequest struct {
+	ClientID      string `json:"client_id"`
+	RedirectURI   string `json:"redirect_uri"`
+	Scope         string `json:"scope"`
+	State         string `json:"state,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+	Prompt        string `json:"prompt,omitempty"`
+	CodeChallenge string `json:"code_challenge"`
+}
+
+// authorizationCode is what an approved request left for the token endpoint
+type authorizationCode struct {
+	ClientID      string    `json:"client_id"`
+	UserID        uuid.UUID `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scope         string    `json:"scope"`
+	Nonce         string    `json:"nonce,omitempty"`
+	CodeChallenge string    `json:"code_challenge"`
+}
+
+// AuthorizationPrompt describes a pending authorization request to the login page
+type AuthorizationPrompt struct {
+	Client *models.OAuthClient
+	Scopes []string
+	// Prompt is the prompt parameter of the client, e.g. "login" to sign in
+	// again even if the login page has a session
+	Prompt string
+	// ConsentRequired is false for trusted clients and for scopes the user granted before
+	ConsentRequired bool
+	ExpiresIn       time.Duration
+}
+
+// TokenRequest is an authorization code grant (RFC 6749 section 4.1.3) with its PKCE verifier
+type TokenRequest struct {
+	ClientID     string
+	ClientSecret string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+}
+
+// TokenResponse is the successful response of the token endpoint
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// UserProfile holds the standard claims about a user (OpenID Connect Core
+// section 5.1) released by the profile, email and phone scopes
+type UserProfile struct {
+	Name                string `json:"name,omitempty"`
+	Picture             string `json:"picture,omitempty"`
+	Locale              string `json:"locale,omitempty"`
+	UpdatedAt           int64  `json:"updated_at,omitempty"`
+	Email               string `json:"email,omitempty"`
+	EmailVerified       *bool  `json:"email_verified,omitempty"`
+	PhoneNumber         string `json:"phone_number,omitempty"`
+	PhoneNumberVerified *bool  `json:"phone_number_verified,omitempty"`
+}
+
+// Discovery is the OpenID Provider metadata (OpenID Connect Discovery section 3)
+type Discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	AuthorizationResponseIssParameter bool     `json:"authorization_response_iss_parameter_supported"`
+}
+
+func NewOIDCService(repo repositories.OAuthRepository, users repositories.UserRepository, client *redisv9.Client, jwtSvc *JWTService, opts OIDCOptions) (*OIDCService, error) {
+	issuer, err := url.Parse(opts.Issuer)
+	if err != nil || issuer.Scheme == "" || issuer.Host == "" || issuer.RawQuery != "" || issuer.Fragment != "" {
+		return nil, errors.New("oidc issuer must be an absolute URL without query or fragment")
+	}
+	login, err := url.Parse(opts.LoginURL)
+	if err != nil || login.Scheme == "" || login.Host == "" {
+		return nil, errors.New("oidc login url must be an absolute URL")
+	}
+	s := &OIDCService{
+		repo:       repo,
+		users:      users,
+		redis:      client,
+		jwt:        jwtSvc,
+		issuer:     strings.TrimSuffix(opts.Issuer, "/"),
+		loginURL:   opts.LoginURL,
+		requestTTL: time.Duration(opts.RequestSeconds) * time.Second,
+		codeTTL:    time.Duration(opts.CodeSeconds) * time.Second,
+	}
+	if s.requestTTL <= 0 {
+		s.requestTTL = defaultAuthorizationRequestTTL
+	}
+	if s.codeTTL <= 0 {
+		s.codeTTL = defaultAuthorizationCodeTTL
+	}
+	return s, nil
+}
+
+// Issuer returns the issuer identifier, without a trailing slash
+func (s *OIDCService) Issuer() string {
+	return s.issuer
+}
+
+// Discovery returns the provider metadata
+func (s *OIDCService) Discovery() Discovery {
+	return Discovery{
+		Issuer:                            s.issuer,
+		AuthorizationEndpoint:             s.issuer + "/oauth/authorize",
+		TokenEndpoint:                     s.issuer + "/oauth/token",
+		UserinfoEndpoint:                  s.issuer + "/oauth/userinfo",
+		JWKSURI:                           s.issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   SupportedScopes,
+		ResponseTypesSupported:            []string{"code"},
+		ResponseModesSupported:            []string{"query"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  s.jwt.SigningAlgorithms(),
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		ClaimsSupported: []string{
+			"iss", "sub", "aud", "exp", "iat", "nonce", "azp",
+			"name", "picture", "locale", "updated_at", "email", "email_verified", "phone_number", "phone_number_verified",
+		},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		AuthorizationResponseIssParameter: true,
+	}
+}
+
+func (s *OIDCService) requestKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "oidc:request:" + hex.EncodeToString(sum[:])
+}
+
+func (s *OIDCService) codeKey(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return "oidc:code:" + hex.EncodeToString(sum[:])
+}
+
+// Authorize checks an authorization request and returns where to send the
+// browser: to the login page with the stored request, or back to the client
+// with an error. An error means the client or its redirect URI can't be
+// trusted, so it must be shown to the user instead.
+func (s *OIDCService) Authorize(ctx context.Context, p AuthorizeParams) (string, error) {
+	if p.ClientID == "" {
+		return "", ErrUnknownClient
+	}
+	client, err := s.repo.GetClient(ctx, p.ClientID)
+	if errors.Is(err, repositories.ErrOAuthClientNotFound) {
+		return "", ErrUnknownClient
+	}
+	if err != nil {
+		return "", err
+	}
+	redirectURI := p.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		return "", ErrInvalidRedirectURI
+	}
+
+	// from here on errors go back to the client
+	fail := func(code, description string) (string, error) {
+		return s.errorRedirect(redirectURI, p.State, oauthError(code, description)), nil
+	}
+	if p.ResponseType != "code" {
+		return fail("unsupported_response_type", "only the authorization code flow is supported")
+	}
+	scopes := parseScope(p.Scope)
+	if !slices.Contains(scopes, ScopeOpenID) {
+		return fail("invalid_scope", "the openid scope is required")
+	}
+	if p.CodeChallengeMethod != "S256" || !codeChallengePattern.MatchString(p.CodeChallenge) {
+		return fail("invalid_request", "PKCE with code_challenge_method S256 is required")
+	}
+	// there is no session to check without the login page
+	if slices.Contains(strings.Fields(p.Prompt), "none") {
+		return fail("login_required", "the user must sign in")
+	}
+
+	req := authorizationRequest{
+		ClientID:      client.ID,
+		RedirectURI:   redirectURI,
+		Scope:         strings.Join(scopes, " "),
+		State:         p.State,
+		Nonce:         p.Nonce,
+		Prompt:        p.Prompt,
+		CodeChallenge: p.CodeChallenge,
+	}
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	id, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	if err := s.redis.Set(ctx, s.requestKey(id), raw, s.requestTTL).Err(); err != nil {
+		return "", err
+	}
+	return withQuery(s.loginURL, url.Values{"request_id": {id}}), nil
+}
+
+func (s *OIDCService) loadRequest(ctx context.Context, id string, take bool) (*authorizationRequest, error) {
+	var (
+		raw []byte
+		err error
+	)
+	if take {
+		raw, err = s.redis.GetDel(ctx, s.requestKey(id)).Bytes()
+	} else {
+		raw, err = s.redis.Get(ctx, s.requestKey(id)).Bytes()
+	}
+	if errors.Is(err, redisv9.Nil) {
+		return nil, ErrAuthorizationRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var req authorizationRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, ErrAuthorizationRequestNotFound
+	}
+	return &req, nil
+}
+
+// Describe returns what the login page shows the user about a pending request
+func (s *OIDCService) Describe(ctx context.Context, id string, userID uuid.UUID) (*AuthorizationPrompt, error) {
+	req, err := s.loadRequest(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.repo.GetClient(ctx, req.ClientID)
+	if errors.Is(err, repositories.ErrOAuthClientNotFound) {
+		return nil, ErrAuthorizationRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := s.redis.PTTL(ctx, s.requestKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	scopes := strings.Fields(req.Scope)
+	consentRequired := false
+	if !client.Trusted {
+		consentRequired, err = s.consentRequired(ctx, userID, client.ID, scopes, req.Prompt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &AuthorizationPrompt{
+		Client:          client,
+		Scopes:          scopes,
+		Prompt:          req.Prompt,
+		ConsentRequired: consentRequired,
+		ExpiresIn:       max(ttl, 0),
+	}, nil
+}
+
+// consentRequired reports whether the user has yet to grant some of the scopes
+func (s *OIDCService) consentRequired(ctx context.Context, userID uuid.UUID, clientID string, scopes []string, prompt string) (bool, error) {
+	if slices.Contains(strings.Fields(prompt), "consent") {
+		return true, nil
+	}
+	consent, err := s.repo.GetConsent(ctx, userID.String(), clientID)
+	if errors.Is(err, repositories.ErrConsentNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	granted := strings.Fields(consent.Scope)
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Approve answers a pending request for the user: the consent is
+// remembered and the browser is to be sent back to the client with an
+// authorization code
+func (s *OIDCService) Approve(ctx context.Context, id string, userID uuid.UUID) (string, error) {
+	req, err := s.loadRequest(ctx, id, true)
+	if err != nil {
+		return "", err
+	}
+	client, err := s.repo.GetClient(ctx, req.ClientID)
+	if errors.Is(err, repositories.ErrOAuthClientNotFound) {
+		return "", ErrAuthorizationRequestNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !client.Trusted {
+		if err := s.remember(ctx, userID, client.ID, strings.Fields(req.Scope)); err != nil {
+			return "", err
+		}
+	}
+
+	raw, err := json.Marshal(authorizationCode{
+		ClientID:      client.ID,
+		UserID:        userID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         req.Scope,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+	})
+	if err != nil {
+		return "", err
+	}
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	if err := s.redis.Set(ctx, s.codeKey(code), raw, s.codeTTL).Err(); err != nil {
+		return "", err
+	}
+	params := url.Values{"code": {code}, "iss": {s.issuer}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	return withQuery(req.RedirectURI, params), nil
+}
+
+// remember adds scopes to the consent of the user to the client
+func (s *OIDCService) remember(ctx context.Context, userID uuid.UUID, clientID string, scopes []string) error {
+	consent, err := s.repo.GetConsent(ctx, userID.String(), clientID)
+	if errors.Is(err, repositories.ErrConsentNotFound) {
+		consent = &models.OAuthConsent{UserID: userID, ClientID: clientID}
+	} else if err != nil {
+		return err
+	}
+	granted := strings.Fields(consent.Scope)
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	consent.Scope = strings.Join(granted, " ")
+	return s.repo.SaveConsent(ctx, consent)
+}
+
+// Deny answers a pending request for the user, the browser is to be sent
+// back to the client with an access_denied error
+func (s *OIDCService) Deny(ctx context.Context, id string) (string, error) {
+	req, err := s.loadRequest(ctx, id, true)
+	if err != nil {
+		return "", err
+	}
+	return s.errorRedirect(req.RedirectURI, req.State, oauthError("access_denied", "the user denied the request")), nil
+}
+
+// Exchange redeems an authorization code for an ID token and an access
+// token. Errors to report to the client are *OAuthError.
+func (s *OIDCService) Exchange(ctx context.Context, req TokenRequest) (*TokenResponse, error) {
+	client, err := s.authenticateClient(ctx, req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	invalidGrant := oauthError("invalid_grant", "the code is invalid, expired or already used")
+	if req.Code == "" {
+		return nil, oauthError("invalid_request", "code is required")
+	}
+	raw, err := s.redis.GetDel(ctx, s.codeKey(req.Code)).Bytes()
+	if errors.Is(err, redisv9.Nil) {
+		return nil, invalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	var code authorizationCode
+	if err := json.Unmarshal(raw, &code); err != nil {
+		return nil, invalidGrant
+	}
+	if code.ClientID != client.ID || code.RedirectURI != req.RedirectURI {
+		return nil, invalidGrant
+	}
+	if !codeVerifierPattern.MatchString(req.CodeVerifier) || !verifyCodeChallenge(req.CodeVerifier, code.CodeChallenge) {
+		return nil, oauthError("invalid_grant", "code_verifier does not match the code_challenge")
+	}
+
+	// the user may have been deleted or blocked since approving
+	u, err := s.users.GetByID(ctx, code.UserID.String())
+	if errors.Is(err, repositories.ErrUserNotFound) {
+		return nil, invalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.BlockedAt != nil {
+		return nil, oauthError("invalid_grant", "the account is blocked")
+	}
+
+	accessToken, err := s.jwt.GenerateClientToken(s.issuer, u.ID, client.ID, code.Scope)
+	if err != nil {
+		return nil, err
+	}
+	idToken, err := s.jwt.GenerateIDToken(&IDTokenClaims{
+		Nonce:           code.Nonce,
+		AuthorizedParty: client.ID,
+		UserProfile:     Profile(u, code.Scope),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   s.issuer,
+			Subject:  u.ID.String(),
+			Audience: jwt.ClaimStrings{client.ID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(s.jwt.TTL().Seconds()),
+		IDToken:     idToken,
+		Scope:       code.Scope,
+	}, nil
+}
+
+// authenticateClient checks the secret of confidential clients. Public
+// clients only name themselves, PKCE proves they started the flow.
+func (s *OIDCService) authenticateClient(ctx context.Context, clientID, secret string) (*models.OAuthClient, error) {
+	invalidClient := oauthError("invalid_client", "client authentication failed")
+	if clientID == "" {
+		return nil, invalidClient
+	}
+	client, err := s.repo.GetClient(ctx, clientID)
+	if errors.Is(err, repositories.ErrOAuthClientNotFound) {
+		return nil, invalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+	if client.Public {
+		return client, nil
+	}
+	if secret == "" || subtle.ConstantTimeCompare([]byte(hashClientSecret(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, invalidClient
+	}
+	return client, nil
+}
+
+// UserInfo returns the claims the scope releases about the user
+func (s *OIDCService) UserInfo(ctx context.Context, userID uuid.UUID, scope string) (UserProfile, error) {
+	u, err := s.users.GetByID(ctx, userID.String())
+	if err != nil {
+		return UserProfile{}, err
+	}
+	return Profile(u, scope), nil
+}
+
+// Profile returns the claims about u released by the space separated scopes
+func Profile(u *models.User, scope string) UserProfile {
+	var p UserProfile
+	scopes := strings.Fields(scope)
+	if slices.Contains(scopes, ScopeProfile) {
+		p.Name = u.DisplayName
+		p.Picture = u.AvatarURL
+		p.Locale = u.Locale
+		p.UpdatedAt = u.UpdatedAt.Unix()
+	}
+	if slices.Contains(scopes, ScopeEmail) && u.Email != "" {
+		verified := u.EmailVerifiedAt != nil
+		p.Email = u.Email
+		p.EmailVerified = &verified
+	}
+	if slices.Contains(scopes, ScopePhone) {
+		// the phone is the login identifier, every user proved it with a code
+		verified := true
+		p.PhoneNumber = u.Phone
+		p.PhoneNumberVerified = &verified
+	}
+	return p
+}
+
+// CreateClient registers a client and returns its secret, which is not
+// stored and can't be shown again. Public clients get no secret.
+func (s *OIDCService) CreateClient(ctx context.Context, client *models.OAuthClient) (string, error) {
+	client.ID = uuid.NewString()
+	var secret string
+	if !client.Public {
+		var err error
+		if secret, err = randomToken(); err != nil {
+			return "", err
+		}
+		client.SecretHash = hashClientSecret(secret)
+	}
+	if err := s.repo.CreateClient(ctx, client); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// RotateClientSecret replaces the secret of a confidential client and returns the new one
+func (s *OIDCService) RotateClientSecret(ctx context.Context, id string) (string, error) {
+	client, err := s.repo.GetClient(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if client.Public {
+		return "", ErrPublicClient
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	client.SecretHash = hashClientSecret(secret)
+	if err := s.repo.UpdateClient(ctx, client); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// errorRedirect returns redirectURI with an OAuth error and the client's state
+func (s *OIDCService) errorRedirect(redirectURI, state string, e *OAuthError) string {
+	params := url.Values{"error": {e.Code}, "error_description": {e.Description}, "iss": {s.issuer}}
+	if state != "" {
+		params.Set("state", state)
+	}
+	return withQuery(redirectURI, params)
+}
+
+// parseScope splits a scope parameter, dropping duplicates and scopes the
+// provider doesn't know as OpenID Connect Core section 3.1.2.1 asks
+func parseScope(scope string) []string {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if slices.Contains(SupportedScopes, s) && !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// verifyCodeChallenge checks a PKCE verifier against its S256 challenge
+func verifyCodeChallenge(verifier, challenge string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// hashClientSecret hashes a client secret for storage, the secrets are
+// random so a plain SHA-256 can't be reversed
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// withQuery adds params to the query of raw, keeping the parameters it has
+func withQuery(raw string, params url.Values) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	q := u.Query()
+	for k, vs := range params {
+		q[k] = vs
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// randomToken returns 32 random bytes, base64url encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
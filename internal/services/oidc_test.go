@@ -0,0 +1,436 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/repositories"
+)
+
+const (
+	testIssuer      = "https://id.example.com"
+	testRedirectURI = "https://app.example.com/callback"
+	testVerifier    = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// memoryOAuthRepo is an in-memory repositories.OAuthRepository
+type memoryOAuthRepo struct {
+	mu       sync.Mutex
+	clients  map[string]models.OAuthClient
+	consents map[string]models.OAuthConsent
+}
+
+func newMemoryOAuthRepo() *memoryOAuthRepo {
+	return &memoryOAuthRepo{clients: map[string]models.OAuthClient{}, consents: map[string]models.OAuthConsent{}}
+}
+
+func (r *memoryOAuthRepo) ListClients(_ context.Context) ([]models.OAuthClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []models.OAuthClient
+	for _, c := range r.clients {
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func (r *memoryOAuthRepo) GetClient(_ context.Context, id string) (*models.OAuthClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.clients[id]
+	if !ok {
+		return nil, repositories.ErrOAuthClientNotFound
+	}
+	return &c, nil
+}
+
+func (r *memoryOAuthRepo) CreateClient(_ context.Context, client *models.OAuthClient) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clients[client.ID] = *client
+	return nil
+}
+
+func (r *memoryOAuthRepo) UpdateClient(_ context.Context, client *models.OAuthClient) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.clients[client.ID]; !ok {
+		return repositories.ErrOAuthClientNotFound
+	}
+	r.clients[client.ID] = *client
+	return nil
+}
+
+func (r *memoryOAuthRepo) DeleteClient(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.clients[id]; !ok {
+		return repositories.ErrOAuthClientNotFound
+	}
+	delete(r.clients, id)
+	return nil
+}
+
+func (r *memoryOAuthRepo) GetConsent(_ context.Context, userID, clientID string) (*models.OAuthConsent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.consents[userID+"/"+clientID]
+	if !ok {
+		return nil, repositories.ErrConsentNotFound
+	}
+	return &c, nil
+}
+
+func (r *memoryOAuthRepo) SaveConsent(_ context.Context, consent *models.OAuthConsent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.consents[consent.UserID.String()+"/"+consent.ClientID] = *consent
+	return nil
+}
+
+// memoryUsers serves GetByID from a map, the rest of the repository is not needed
+type memoryUsers struct {
+	repositories.UserRepository
+	users map[string]*models.User
+}
+
+func (r *memoryUsers) GetByID(_ context.Context, id string) (*models.User, error) {
+	u, ok := r.users[id]
+	if !ok {
+		return nil, repositories.ErrUserNotFound
+	}
+	return u, nil
+}
+
+type oidcFixture struct {
+	svc    *OIDCService
+	jwt    *JWTService
+	mr     *miniredis.Miniredis
+	repo   *memoryOAuthRepo
+	user   *models.User
+	client *models.OAuthClient
+	secret string
+}
+
+func newOIDCFixture(t *testing.T) *oidcFixture {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+
+	verified := time.Now()
+	user := &models.User{ID: uuid.New(), Phone: "+12025550100", Email: "ada@example.com", EmailVerifiedAt: &verified, DisplayName: "Ada"}
+	repo := newMemoryOAuthRepo()
+	jwtSvc := NewJWTService("secret", 15)
+	svc, err := NewOIDCService(repo, &memoryUsers{users: map[string]*models.User{user.ID.String(): user}}, rdb, jwtSvc, OIDCOptions{
+		Issuer:   testIssuer + "/",
+		LoginURL: "https://id.example.com/login?theme=dark",
+	})
+	if err != nil {
+		t.Fatalf("new service: %v", err)
+	}
+	client := &models.OAuthClient{Name: "App", RedirectURIs: []string{testRedirectURI}}
+	secret, err := svc.CreateClient(context.Background(), client)
+	if err != nil || secret == "" {
+		t.Fatalf("create client: %v, secret=%q", err, secret)
+	}
+	return &oidcFixture{svc: svc, jwt: jwtSvc, mr: mr, repo: repo, user: user, client: client, secret: secret}
+}
+
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (f *oidcFixture) params() AuthorizeParams {
+	return AuthorizeParams{
+		ResponseType:        "code",
+		ClientID:            f.client.ID,
+		RedirectURI:         testRedirectURI,
+		Scope:               "openid email phone unknown",
+		State:               "xyz",
+		Nonce:               "n-0S6",
+		CodeChallenge:       challenge(testVerifier),
+		CodeChallengeMethod: "S256",
+	}
+}
+
+// authorize starts a request and returns its id from the login page URL
+func (f *oidcFixture) authorize(t *testing.T, p AuthorizeParams) string {
+	t.Helper()
+	location, err := f.svc.Authorize(context.Background(), p)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	u, _ := url.Parse(location)
+	if !strings.HasPrefix(location, "https://id.example.com/login?") || u.Query().Get("theme") != "dark" {
+		t.Fatalf("expected the login page, got %s", location)
+	}
+	return u.Query().Get("request_id")
+}
+
+// approve answers the request and returns the code sent to the client
+func (f *oidcFixture) approve(t *testing.T, id string) string {
+	t.Helper()
+	location, err := f.svc.Approve(context.Background(), id, f.user.ID)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	u, _ := url.Parse(location)
+	q := u.Query()
+	if !strings.HasPrefix(location, testRedirectURI+"?") || q.Get("state") != "xyz" || q.Get("iss") != testIssuer || q.Get("code") == "" {
+		t.Fatalf("unexpected redirect %s", location)
+	}
+	return q.Get("code")
+}
+
+func (f *oidcFixture) exchange(code string) (*TokenResponse, error) {
+	return f.svc.Exchange(context.Background(), TokenRequest{
+		ClientID:     f.client.ID,
+		ClientSecret: f.secret,
+		Code:         code,
+		RedirectURI:  testRedirectURI,
+		CodeVerifier: testVerifier,
+	})
+}
+
+func oauthErrorCode(err error) string {
+	var e *OAuthError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+func TestOIDCService_CodeFlow(t *testing.T) {
+	f := newOIDCFixture(t)
+	ctx := context.Background()
+
+	id := f.authorize(t, f.params())
+	prompt, err := f.svc.Describe(ctx, id, f.user.ID)
+	if err != nil {
+		t.Fatalf("describe: %v", err)
+	}
+	if !prompt.ConsentRequired || strings.Join(prompt.Scopes, " ") != "openid email phone" || prompt.ExpiresIn <= 0 {
+		t.Fatalf("unexpected prompt %+v", prompt)
+	}
+
+	code := f.approve(t, id)
+	resp, err := f.exchange(code)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if resp.TokenType != "Bearer" || resp.Scope != "openid email phone" || resp.ExpiresIn != 15*60 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	var idClaims IDTokenClaims
+	if _, err := jwt.ParseWithClaims(resp.IDToken, &idClaims, func(*jwt.Token) (any, error) { return []byte("secret"), nil }); err != nil {
+		t.Fatalf("parse id token: %v", err)
+	}
+	if idClaims.Issuer != testIssuer || idClaims.Subject != f.user.ID.String() || idClaims.Nonce != "n-0S6" || idClaims.AuthorizedParty != f.client.ID {
+		t.Fatalf("unexpected id token claims %+v", idClaims)
+	}
+	if len(idClaims.Audience) != 1 || idClaims.Audience[0] != f.client.ID {
+		t.Fatalf("expected audience %s, got %v", f.client.ID, idClaims.Audience)
+	}
+	if idClaims.Email != "ada@example.com" || idClaims.EmailVerified == nil || !*idClaims.EmailVerified || idClaims.PhoneNumber != "+12025550100" || idClaims.Name != "" {
+		t.Fatalf("expected email and phone claims only, got %+v", idClaims.UserProfile)
+	}
+
+	access, err := f.jwt.Parse(resp.AccessToken)
+	if err != nil {
+		t.Fatalf("parse access token: %v", err)
+	}
+	if access.ClientID != f.client.ID || access.Scope != "openid email phone" || len(access.Roles) != 0 {
+		t.Fatalf("unexpected access token claims %+v", access)
+	}
+
+	// codes are single use
+	if _, err := f.exchange(code); oauthErrorCode(err) != "invalid_grant" {
+		t.Fatalf("expected invalid_grant on reuse, got %v", err)
+	}
+	// the consent is remembered
+	prompt, err = f.svc.Describe(ctx, f.authorize(t, f.params()), f.user.ID)
+	if err != nil || prompt.ConsentRequired {
+		t.Fatalf("expected no consent for granted scopes, got %+v, %v", prompt, err)
+	}
+	p := f.params()
+	p.Scope = "openid profile"
+	prompt, err = f.svc.Describe(ctx, f.authorize(t, p), f.user.ID)
+	if err != nil || !prompt.ConsentRequired {
+		t.Fatalf("expected consent for a new scope, got %+v, %v", prompt, err)
+	}
+}
+
+func TestOIDCService_Authorize(t *testing.T) {
+	f := newOIDCFixture(t)
+	ctx := context.Background()
+
+	p := f.params()
+	for _, id := range []string{"unknown", ""} {
+		p.ClientID = id
+		if _, err := f.svc.Authorize(ctx, p); !errors.Is(err, ErrUnknownClient) {
+			t.Fatalf("expected ErrUnknownClient for %q, got %v", id, err)
+		}
+	}
+	p = f.params()
+	p.RedirectURI = "https://evil.example.com/callback"
+	if _, err := f.svc.Authorize(ctx, p); !errors.Is(err, ErrInvalidRedirectURI) {
+		t.Fatalf("expected ErrInvalidRedirectURI, got %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		modify func(*AuthorizeParams)
+		code   string
+	}{
+		{"implicit flow", func(p *AuthorizeParams) { p.ResponseType = "token" }, "unsupported_response_type"},
+		{"no openid", func(p *AuthorizeParams) { p.Scope = "email" }, "invalid_scope"},
+		{"no pkce", func(p *AuthorizeParams) { p.CodeChallenge, p.CodeChallengeMethod = "", "" }, "invalid_request"},
+		{"plain pkce", func(p *AuthorizeParams) { p.CodeChallenge, p.CodeChallengeMethod = testVerifier, "plain" }, "invalid_request"},
+		{"prompt none", func(p *AuthorizeParams) { p.Prompt = "none" }, "login_required"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := f.params()
+			p.RedirectURI = ""
+			tc.modify(&p)
+			location, err := f.svc.Authorize(ctx, p)
+			if err != nil {
+				t.Fatalf("authorize: %v", err)
+			}
+			u, _ := url.Parse(location)
+			if !strings.HasPrefix(location, testRedirectURI+"?") || u.Query().Get("error") != tc.code || u.Query().Get("state") != "xyz" {
+				t.Fatalf("expected %s at the redirect uri, got %s", tc.code, location)
+			}
+		})
+	}
+
+	id := f.authorize(t, f.params())
+	location, err := f.svc.Deny(ctx, id)
+	if err != nil || !strings.Contains(location, "error=access_denied") {
+		t.Fatalf("expected access_denied, got %s, %v", location, err)
+	}
+	if _, err := f.svc.Approve(ctx, id, f.user.ID); !errors.Is(err, ErrAuthorizationRequestNotFound) {
+		t.Fatalf("expected an answered request to be gone, got %v", err)
+	}
+
+	id = f.authorize(t, f.params())
+	f.mr.FastForward(11 * time.Minute)
+	if _, err := f.svc.Describe(ctx, id, f.user.ID); !errors.Is(err, ErrAuthorizationRequestNotFound) {
+		t.Fatalf("expected an expired request to be gone, got %v", err)
+	}
+}
+
+func TestOIDCService_Exchange(t *testing.T) {
+	f := newOIDCFixture(t)
+
+	cases := []struct {
+		name   string
+		modify func(*TokenRequest)
+		code   string
+	}{
+		{"wrong secret", func(r *TokenRequest) { r.ClientSecret = "wrong" }, "invalid_client"},
+		{"no secret", func(r *TokenRequest) { r.ClientSecret = "" }, "invalid_client"},
+		{"unknown client", func(r *TokenRequest) { r.ClientID = "unknown" }, "invalid_client"},
+		{"redirect mismatch", func(r *TokenRequest) { r.RedirectURI = "https://app.example.com/other" }, "invalid_grant"},
+		{"wrong verifier", func(r *TokenRequest) { r.CodeVerifier = strings.Repeat("a", 43) }, "invalid_grant"},
+		{"unknown code", func(r *TokenRequest) { r.Code = "unknown" }, "invalid_grant"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := TokenRequest{
+				ClientID:     f.client.ID,
+				ClientSecret: f.secret,
+				Code:         f.approve(t, f.authorize(t, f.params())),
+				RedirectURI:  testRedirectURI,
+				CodeVerifier: testVerifier,
+			}
+			tc.modify(&req)
+			if _, err := f.svc.Exchange(context.Background(), req); oauthErrorCode(err) != tc.code {
+				t.Fatalf("expected %s, got %v", tc.code, err)
+			}
+		})
+	}
+
+	t.Run("expired code", func(t *testing.T) {
+		code := f.approve(t, f.authorize(t, f.params()))
+		f.mr.FastForward(2 * time.Minute)
+		if _, err := f.exchange(code); oauthErrorCode(err) != "invalid_grant" {
+			t.Fatalf("expected invalid_grant, got %v", err)
+		}
+	})
+
+	t.Run("blocked user", func(t *testing.T) {
+		code := f.approve(t, f.authorize(t, f.params()))
+		now := time.Now()
+		f.user.BlockedAt = &now
+		defer func() { f.user.BlockedAt = nil }()
+		if _, err := f.exchange(code); oauthErrorCode(err) != "invalid_grant" {
+			t.Fatalf("expected invalid_grant, got %v", err)
+		}
+	})
+
+	t.Run("public client", func(t *testing.T) {
+		public := &models.OAuthClient{Name: "SPA", RedirectURIs: []string{testRedirectURI}, Public: true}
+		secret, err := f.svc.CreateClient(context.Background(), public)
+		if err != nil || secret != "" {
+			t.Fatalf("expected no secret for a public client, got %q, %v", secret, err)
+		}
+		p := f.params()
+		p.ClientID = public.ID
+		req := TokenRequest{
+			ClientID:     public.ID,
+			Code:         f.approve(t, f.authorize(t, p)),
+			RedirectURI:  testRedirectURI,
+			CodeVerifier: testVerifier,
+		}
+		if _, err := f.svc.Exchange(context.Background(), req); err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		if _, err := f.svc.RotateClientSecret(context.Background(), public.ID); !errors.Is(err, ErrPublicClient) {
+			t.Fatalf("expected ErrPublicClient, got %v", err)
+		}
+	})
+
+	t.Run("rotated secret", func(t *testing.T) {
+		code := f.approve(t, f.authorize(t, f.params()))
+		secret, err := f.svc.RotateClientSecret(context.Background(), f.client.ID)
+		if err != nil {
+			t.Fatalf("rotate: %v", err)
+		}
+		if _, err := f.exchange(code); oauthErrorCode(err) != "invalid_client" {
+			t.Fatalf("expected the old secret to be rejected, got %v", err)
+		}
+		f.secret = secret
+		code = f.approve(t, f.authorize(t, f.params()))
+		if _, err := f.exchange(code); err != nil {
+			t.Fatalf("exchange with the new secret: %v", err)
+		}
+	})
+}
+
+func TestOIDCService_Discovery(t *testing.T) {
+	f := newOIDCFixture(t)
+	d := f.svc.Discovery()
+	if d.Issuer != testIssuer || d.TokenEndpoint != testIssuer+"/oauth/token" || d.JWKSURI != testIssuer+"/.well-known/jwks.json" {
+		t.Fatalf("unexpected endpoints %+v", d)
+	}
+	if len(d.IDTokenSigningAlgValuesSupported) != 1 || d.IDTokenSigningAlgValuesSupported[0] != "HS256" {
+		t.Fatalf("expected HS256, got %v", d.IDTokenSigningAlgValuesSupported)
+	}
+}
@@ -2,98 +2,542 @@ package services
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math/big"
 	"strings"
 	"time"
 
 	redisv9 "github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/metrics"
 )
 
 type OTPService struct {
 	redis            *redisv9.Client
+	sender           Sender
+	phones           Identifiers
 	prefix           string
+	format           func(purpose OTPPurpose, to, code string) string
+	length           int
+	alphabet         string
+	secret           []byte
 	ttl              time.Duration
 	rateLimitPerMin  int
 	rateLimitTimeout time.Duration
+	resendCooldown   time.Duration
+	maxAttempts      int
+	lockout          time.Duration
+	lockoutMax       time.Duration
+	logger           *slog.Logger
+}
+
+// Identifiers canonicalizes what codes are sent to, e.g. *phone.Parser or
+// email.Addresses, so every spelling maps to the same Redis keys
+type Identifiers interface {
+	Canonical(raw string) string
+}
+
+// OTPOptions configures the code format, lifetime, rate limiting and brute-force protection
+type OTPOptions struct {
+	// KeyPrefix separates the keys of services sending to different kinds of
+	// identifiers, empty means "otp:"
+	KeyPrefix string
+	// Format builds the message delivered with a code, nil means the default texts
+	Format func(purpose OTPPurpose, to, code string) string
+	// Length is the number of characters in a code, zero means 6
+	Length int
+	// Alphabet lists the characters codes are drawn from, empty means digits.
+	// Verify upper-cases input when the alphabet has no lower-case letters.
+	Alphabet string
+	// Secret keys the HMAC under which codes are stored. Empty means a random
+	// secret, so codes don't survive a restart or work across replicas.
+	Secret                  []byte
+	TTLSeconds              int
+	RateLimitPerMin         int
+	RateLimitTimeoutSeconds int
+	// ResendCooldownSeconds is the minimum time between two codes for the same phone
+	ResendCooldownSeconds int
+	// MaxAttempts is the number of wrong codes after which the current code is
+	// invalidated and the phone is locked. Zero disables the limit.
+	MaxAttempts int
+	// LockoutSeconds is the first lockout duration; it doubles on every
+	// consecutive lockout up to LockoutMaxSeconds. Zero only burns the code.
+	LockoutSeconds    int
+	LockoutMaxSeconds int
+	// Logger receives lockout events, nil means slog.Default()
+	Logger *slog.Logger
+}
+
+// OTPPurpose names the flow a code is issued for. A code only verifies for
+// the purpose it was issued for.
+type OTPPurpose string
+
+const (
+	PurposeLogin           OTPPurpose = "login"
+	PurposePhoneChange     OTPPurpose = "phone_change"
+	PurposeAccountDeletion OTPPurpose = "account_deletion"
+	// PurposeEmailVerification proves the user receives mail at their profile email
+	PurposeEmailVerification OTPPurpose = "email_verification"
+	// PurposePasskeyRegistration confirms a new passkey, which signs in without SMS or MFA
+	PurposePasskeyRegistration OTPPurpose = "passkey_registration"
+)
+
+var purposes = []OTPPurpose{PurposeLogin, PurposePhoneChange, PurposeAccountDeletion, PurposeEmailVerification, PurposePasskeyRegistration}
+
+// otpMessageFormats are the texts delivered to the user; %s is replaced with
+// the code. Naming the action helps users notice codes they didn't ask for.
+var otpMessageFormats = map[OTPPurpose]string{
+	PurposeLogin:               "Your Zeus verification code is %s",
+	PurposePhoneChange:         "Your Zeus code to change your phone number is %s",
+	PurposeAccountDeletion:     "Your Zeus code to delete your account is %s",
+	PurposeEmailVerification:   "Your Zeus code to confirm your email address is %s",
+	PurposePasskeyRegistration: "Your Zeus code to add a passkey is %s",
+}
+
+// OTPMessage is the default text delivered with a code
+func OTPMessage(purpose OTPPurpose, code string) string {
+	return fmt.Sprintf(otpMessageFormats[purpose], code)
 }
 
-func NewOTPService(client *redisv9.Client, ttlSeconds int, rateLimitPerMin int, rateLimitTimeoutSeconds int) *OTPService {
+const (
+	defaultOTPLength   = 6
+	defaultOTPAlphabet = "0123456789"
+)
+
+var tracer = otel.Tracer("github.com/rznas/zeus/internal/services")
+
+// lockoutHistoryTTL is how long past lockouts count towards escalation
+const lockoutHistoryTTL = 24 * time.Hour
+
+// NewOTPService creates an OTP service. sender may be nil, in which case codes
+// are only stored and returned to the caller. phones canonicalizes the numbers,
+// or other identifiers, used in Redis keys so formatting differences map to
+// the same code.
+func NewOTPService(client *redisv9.Client, sender Sender, phones Identifiers, opts OTPOptions) *OTPService {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	length := opts.Length
+	if length <= 0 {
+		length = defaultOTPLength
+	}
+	alphabet := opts.Alphabet
+	if alphabet == "" {
+		alphabet = defaultOTPAlphabet
+	}
+	secret := opts.Secret
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(fmt.Sprintf("otp secret: %v", err))
+		}
+	}
+	prefix := opts.KeyPrefix
+	if prefix == "" {
+		prefix = "otp:"
+	}
+	format := opts.Format
+	if format == nil {
+		format = func(purpose OTPPurpose, _, code string) string { return OTPMessage(purpose, code) }
+	}
 	return &OTPService{
 		redis:            client,
-		prefix:           "otp:",
-		ttl:              time.Duration(ttlSeconds) * time.Second,
-		rateLimitPerMin:  rateLimitPerMin,
-		rateLimitTimeout: time.Duration(rateLimitTimeoutSeconds) * time.Second,
+		sender:           sender,
+		phones:           phones,
+		prefix:           prefix,
+		format:           format,
+		length:           length,
+		alphabet:         alphabet,
+		secret:           secret,
+		ttl:              time.Duration(opts.TTLSeconds) * time.Second,
+		rateLimitPerMin:  opts.RateLimitPerMin,
+		rateLimitTimeout: time.Duration(opts.RateLimitTimeoutSeconds) * time.Second,
+		resendCooldown:   time.Duration(opts.ResendCooldownSeconds) * time.Second,
+		maxAttempts:      opts.MaxAttempts,
+		lockout:          time.Duration(opts.LockoutSeconds) * time.Second,
+		lockoutMax:       time.Duration(opts.LockoutMaxSeconds) * time.Second,
+		logger:           logger,
 	}
 }
 
-func (s *OTPService) key(phone string) string {
-	return s.prefix + strings.TrimSpace(phone)
+func (s *OTPService) key(purpose OTPPurpose, phone string) string {
+	return s.prefix + string(purpose) + ":" + s.phones.Canonical(phone)
 }
 
 func (s *OTPService) rateLimitKey(phone string) string {
-	return s.prefix + "rate:" + strings.TrimSpace(phone)
+	return s.prefix + "rate:" + s.phones.Canonical(phone)
+}
+
+func (s *OTPService) sentKey(phone string) string {
+	return s.prefix + "sent:" + s.phones.Canonical(phone)
 }
 
-// ErrRateLimitExceeded is returned when rate limit is exceeded
-var ErrRateLimitExceeded = errors.New("rate limit exceeded")
+func (s *OTPService) attemptsKey(phone string) string {
+	return s.prefix + "attempts:" + s.phones.Canonical(phone)
+}
 
-func (s *OTPService) Generate(ctx context.Context, phone string) (string, error) {
-	// Check rate limiting
-	rateLimitKey := s.rateLimitKey(phone)
+func (s *OTPService) lockKey(phone string) string {
+	return s.prefix + "lock:" + s.phones.Canonical(phone)
+}
 
-	// Get current count for this phone number
-	currentCount, err := s.redis.Get(ctx, rateLimitKey).Int()
-	if err != nil && err != redisv9.Nil {
-		return "", err
+func (s *OTPService) lockoutsKey(phone string) string {
+	return s.prefix + "lockouts:" + s.phones.Canonical(phone)
+}
+
+var (
+	// ErrRateLimitExceeded is returned when rate limit is exceeded
+	ErrRateLimitExceeded = apperr.RateLimited("otp_rate_limited", "rate limit exceeded, please try again later")
+	// ErrResendTooSoon is returned when a code is requested during the resend cooldown
+	ErrResendTooSoon = apperr.RateLimited("otp_resend_too_soon", "a code was just sent, please wait before requesting another")
+	// ErrOTPLocked is returned while a phone is locked out after too many wrong codes
+	ErrOTPLocked = apperr.Locked("otp_locked", "too many failed attempts, phone temporarily locked")
+	// ErrOTPExpired is returned when no code is pending for the phone, because
+	// it expired, was already used or was never requested
+	ErrOTPExpired = apperr.Unauthorized("otp_expired", "code expired, request a new one")
+	// ErrOTPInvalid is returned for a wrong code
+	ErrOTPInvalid = apperr.Unauthorized("otp_invalid", "invalid code")
+	// ErrUnknownPurpose is returned for a purpose other than the declared ones
+	ErrUnknownPurpose = errors.New("unknown otp purpose")
+)
+
+// LockoutError carries how long the phone stays locked. It matches ErrOTPLocked.
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("otp locked, retry after %s", e.RetryAfter)
+}
+
+// Unwrap exposes the lockout as an ErrOTPLocked carrying the retry delay
+func (e *LockoutError) Unwrap() error {
+	return ErrOTPLocked.WithRetryAfter(e.RetryAfter)
+}
+
+// checkLock returns a LockoutError if the phone is currently locked
+func (s *OTPService) checkLock(ctx context.Context, phone string) error {
+	ttl, err := s.redis.PTTL(ctx, s.lockKey(phone)).Result()
+	if err != nil {
+		return err
+	}
+	// PTTL is negative when the key does not exist
+	if ttl > 0 {
+		return &LockoutError{RetryAfter: ttl}
 	}
+	return nil
+}
+
+// storeOTPScript counts a code request in a fixed window and stores the code
+// if the window still has room and the resend cooldown has passed. The window
+// starts with its first request and is not extended by later ones.
+//
+// KEYS[1] rate counter, KEYS[2] code digest, KEYS[3] last send marker
+// ARGV[1] requests per window, ARGV[2] window in ms, ARGV[3] code digest, ARGV[4] code ttl in ms, ARGV[5] cooldown in ms
+// returns {1, 0} once stored, {0, ms until the window ends} when limited and
+// {2, ms until the cooldown ends} during the cooldown
+var storeOTPScript = redisv9.NewScript(`
+local cooldown = redis.call("PTTL", KEYS[3])
+if cooldown > 0 then
+  return {2, cooldown}
+end
+local count = tonumber(redis.call("GET", KEYS[1]) or "0")
+if count >= tonumber(ARGV[1]) then
+  return {0, math.max(redis.call("PTTL", KEYS[1]), 0)}
+end
+count = redis.call("INCR", KEYS[1])
+if count == 1 or redis.call("PTTL", KEYS[1]) < 0 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+redis.call("SET", KEYS[2], ARGV[3], "PX", ARGV[4])
+if tonumber(ARGV[5]) > 0 then
+  redis.call("SET", KEYS[3], "1", "PX", ARGV[5])
+end
+return {1, 0}
+`)
 
-	// Check if rate limit is exceeded
-	if currentCount >= s.rateLimitPerMin {
-		return "", ErrRateLimitExceeded
+// Generate issues a code for purpose and delivers it to phone. Only an HMAC of
+// the code is stored.
+func (s *OTPService) Generate(ctx context.Context, purpose OTPPurpose, phone string) (string, error) {
+	code, err := s.generate(ctx, purpose, phone)
+	result := "sent"
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrRateLimitExceeded):
+		result = "rate_limited"
+	case errors.Is(err, ErrResendTooSoon):
+		result = "cooldown"
+	case errors.Is(err, ErrOTPLocked):
+		result = "locked"
+	case errors.Is(err, ErrDeliveryFailed):
+		result = "delivery_failed"
+	default:
+		result = "error"
 	}
+	metrics.OTPGenerated.WithLabelValues(result).Inc()
+	return code, err
+}
 
-	// 6-digit numeric OTP
-	n := int64(100000)
-	m := int64(900000)
-	r, err := rand.Int(rand.Reader, big.NewInt(m))
-	if err != nil {
+func (s *OTPService) generate(ctx context.Context, purpose OTPPurpose, phone string) (string, error) {
+	if _, ok := otpMessageFormats[purpose]; !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownPurpose, purpose)
+	}
+	if err := s.checkLock(ctx, phone); err != nil {
 		return "", err
 	}
-	code := fmt.Sprintf("%06d", r.Int64()+n)
 
-	// Store OTP
-	if err := s.redis.Set(ctx, s.key(phone), code, s.ttl).Err(); err != nil {
+	code, err := s.newCode()
+	if err != nil {
 		return "", err
 	}
 
-	// Update rate limiting counter
-	pipe := s.redis.Pipeline()
-	pipe.Incr(ctx, rateLimitKey)
-	pipe.Expire(ctx, rateLimitKey, s.rateLimitTimeout)
-	_, err = pipe.Exec(ctx)
+	// Count the request and store the code in one step, so concurrent requests can't all slip under the limit
+	res, err := storeOTPScript.Run(ctx, s.redis,
+		[]string{s.rateLimitKey(phone), s.key(purpose, phone), s.sentKey(phone)},
+		s.rateLimitPerMin, s.rateLimitTimeout.Milliseconds(), s.digest(purpose, phone, code), s.ttl.Milliseconds(), s.resendCooldown.Milliseconds(),
+	).Int64Slice()
 	if err != nil {
 		return "", err
 	}
+	switch res[0] {
+	case 0:
+		return "", ErrRateLimitExceeded.WithRetryAfter(time.Duration(res[1]) * time.Millisecond)
+	case 2:
+		return "", ErrResendTooSoon.WithRetryAfter(time.Duration(res[1]) * time.Millisecond)
+	}
+
+	// Deliver OTP
+	if s.sender != nil {
+		if err := s.send(ctx, phone, s.format(purpose, phone, code)); err != nil {
+			// an undelivered code is useless, don't leave it around or make the user wait for another
+			_ = s.redis.Del(ctx, s.key(purpose, phone), s.sentKey(phone)).Err()
+			return "", ErrDeliveryFailed.Wrap(err)
+		}
+	}
 
 	return code, nil
 }
 
-func (s *OTPService) Verify(ctx context.Context, phone, code string) (bool, error) {
-	stored, err := s.redis.Get(ctx, s.key(phone)).Result()
-	if err == redisv9.Nil {
-		return false, nil
+// newCode draws a code uniformly from the alphabet
+func (s *OTPService) newCode() (string, error) {
+	n := big.NewInt(int64(len(s.alphabet)))
+	code := make([]byte, s.length)
+	for i := range code {
+		r, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return "", err
+		}
+		code[i] = s.alphabet[r.Int64()]
+	}
+	return string(code), nil
+}
+
+// digest is what is stored instead of the code. Binding it to the purpose and
+// phone keeps a stored digest from being useful under any other key.
+func (s *OTPService) digest(purpose OTPPurpose, phone, code string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(string(purpose) + "\x00" + s.phones.Canonical(phone) + "\x00" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// normalizeCode undoes what users commonly do to a code they type
+func (s *OTPService) normalizeCode(code string) string {
+	code = strings.TrimSpace(code)
+	if s.alphabet == strings.ToUpper(s.alphabet) {
+		code = strings.ToUpper(code)
+	}
+	return code
+}
+
+// OTPStatus tells a client what it may do next for a phone
+type OTPStatus struct {
+	// ExpiresIn is how long the pending code stays valid, zero if there is none
+	ExpiresIn time.Duration
+	// ResendAfter is how long until another code may be requested
+	ResendAfter time.Duration
+	// SendsRemaining is the number of codes that may still be requested in the current window
+	SendsRemaining int
+	// AttemptsRemaining is the number of wrong codes left before the phone is
+	// locked, negative if wrong codes are not limited
+	AttemptsRemaining int
+}
+
+// Status reports the pending code for purpose, and the cooldown and remaining
+// sends and attempts for phone, which all purposes share
+func (s *OTPService) Status(ctx context.Context, purpose OTPPurpose, phone string) (OTPStatus, error) {
+	pipe := s.redis.Pipeline()
+	code := pipe.PTTL(ctx, s.key(purpose, phone))
+	cooldown := pipe.PTTL(ctx, s.sentKey(phone))
+	sends := pipe.Get(ctx, s.rateLimitKey(phone))
+	window := pipe.PTTL(ctx, s.rateLimitKey(phone))
+	attempts := pipe.Get(ctx, s.attemptsKey(phone))
+	lock := pipe.PTTL(ctx, s.lockKey(phone))
+	// a missing counter is fine, it reads as zero below
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redisv9.Nil) {
+		return OTPStatus{}, err
+	}
+
+	// PTTL is negative for missing keys
+	st := OTPStatus{
+		ExpiresIn:         max(code.Val(), 0),
+		ResendAfter:       max(cooldown.Val(), 0),
+		SendsRemaining:    max(s.rateLimitPerMin-counter(sends), 0),
+		AttemptsRemaining: -1,
+	}
+	if st.SendsRemaining == 0 {
+		st.ResendAfter = max(st.ResendAfter, window.Val())
+	}
+	if s.maxAttempts > 0 {
+		st.AttemptsRemaining = max(s.maxAttempts-counter(attempts), 0)
+	}
+	if lock.Val() > 0 {
+		st.ExpiresIn = 0
+		st.ResendAfter = max(st.ResendAfter, lock.Val())
+		st.AttemptsRemaining = 0
+	}
+	return st, nil
+}
+
+// counter reads an INCR counter, missing or unreadable counters are zero
+func counter(cmd *redisv9.StringCmd) int {
+	n, _ := cmd.Int()
+	return n
+}
+
+// send delivers the message in its own span, provider latency is often the slow part of a login
+func (s *OTPService) send(ctx context.Context, phone, message string) error {
+	ctx, span := tracer.Start(ctx, "otp.send", trace.WithAttributes(attribute.String("sms.sender", fmt.Sprintf("%T", s.sender))))
+	defer span.End()
+	if err := s.sender.Send(ctx, phone, message); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "delivery failed")
+		return err
+	}
+	return nil
+}
+
+// Verify checks the code issued to the phone for purpose and returns nil if it
+// matches. It returns ErrOTPExpired if no code is pending for purpose and
+// ErrOTPInvalid for a wrong code. Attempts count towards MaxAttempts until one
+// matches; a wrong code reaching it discards the phone's codes and returns a
+// LockoutError.
+func (s *OTPService) Verify(ctx context.Context, purpose OTPPurpose, phone, code string) error {
+	err := s.verify(ctx, purpose, phone, code)
+	result := "success"
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrOTPLocked):
+		result = "locked"
+	case errors.Is(err, ErrOTPExpired):
+		result = "expired"
+	case errors.Is(err, ErrOTPInvalid):
+		result = "invalid"
+	default:
+		result = "error"
+	}
+	metrics.OTPVerified.WithLabelValues(result).Inc()
+	return err
+}
+
+// verifyOTPScript checks a code in one step, so parallel guesses can't all
+// pass the lock check before any of them is counted and two correct
+// submissions can't both consume the same code. The attempt is counted before
+// the comparison; the one reaching the limit without a match discards the
+// phone's codes and locks it, the lockout doubling with every consecutive one.
+//
+// KEYS[1] lock, KEYS[2] code digest, KEYS[3] attempts, KEYS[4] lockout history,
+// KEYS[5...] the codes of every purpose
+// ARGV[1] digest of the submitted code, ARGV[2] max attempts (0 for no limit),
+// ARGV[3] attempts window in ms, ARGV[4] first lockout in ms, ARGV[5] longest
+// lockout in ms (0 for no cap), ARGV[6] lockout history ttl in ms
+// returns {1, 0} on a match, {0, 0} for a wrong code, {2, 0} without a pending
+// code, {3, ms left} while locked and {4, lockout in ms, consecutive lockouts}
+// when this attempt locked
+var verifyOTPScript = redisv9.NewScript(`
+local lock = redis.call("PTTL", KEYS[1])
+if lock > 0 then
+  return {3, lock}
+end
+local stored = redis.call("GET", KEYS[2])
+if not stored then
+  return {2, 0}
+end
+local maxAttempts = tonumber(ARGV[2])
+local attempts = 0
+if maxAttempts > 0 then
+  attempts = redis.call("INCR", KEYS[3])
+  -- the window starts at the first attempt, later ones must not extend it
+  if attempts == 1 or redis.call("PTTL", KEYS[3]) < 0 then
+    redis.call("PEXPIRE", KEYS[3], ARGV[3])
+  end
+end
+-- digests are compared, so timing tells nothing about the code
+if stored == ARGV[1] then
+  redis.call("DEL", KEYS[2], KEYS[3], KEYS[4])
+  return {1, 0}
+end
+if maxAttempts == 0 or attempts < maxAttempts then
+  return {0, 0}
+end
+redis.call("DEL", KEYS[3], unpack(KEYS, 5))
+local lockouts = redis.call("INCR", KEYS[4])
+redis.call("PEXPIRE", KEYS[4], ARGV[6])
+local duration, cap = tonumber(ARGV[4]), tonumber(ARGV[5])
+for _ = 2, lockouts do
+  if cap > 0 and duration >= cap then
+    break
+  end
+  duration = duration * 2
+end
+if cap > 0 and duration > cap then
+  duration = cap
+end
+-- a lock set without expiry would never lift
+if duration <= 0 then
+  return {0, 0}
+end
+redis.call("SET", KEYS[1], lockouts, "PX", duration)
+return {4, duration, lockouts}
+`)
+
+func (s *OTPService) verify(ctx context.Context, purpose OTPPurpose, phone, code string) error {
+	if _, ok := otpMessageFormats[purpose]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownPurpose, purpose)
+	}
+	keys := []string{s.lockKey(phone), s.key(purpose, phone), s.attemptsKey(phone), s.lockoutsKey(phone)}
+	for _, p := range purposes {
+		keys = append(keys, s.key(p, phone))
 	}
+	res, err := verifyOTPScript.Run(ctx, s.redis, keys,
+		s.digest(purpose, phone, s.normalizeCode(code)), s.maxAttempts, s.ttl.Milliseconds(),
+		s.lockout.Milliseconds(), s.lockoutMax.Milliseconds(), lockoutHistoryTTL.Milliseconds(),
+	).Int64Slice()
 	if err != nil {
-		return false, err
+		return err
 	}
-	if stored == strings.TrimSpace(code) {
-		// consume OTP
-		_ = s.redis.Del(ctx, s.key(phone)).Err()
-		return true, nil
+	switch res[0] {
+	case 1:
+		return nil
+	case 2:
+		return ErrOTPExpired
+	case 3:
+		return &LockoutError{RetryAfter: time.Duration(res[1]) * time.Millisecond}
+	case 4:
+		duration := time.Duration(res[1]) * time.Millisecond
+		metrics.OTPLockouts.Inc()
+		s.logger.WarnContext(ctx, "otp lockout", "phone", phone, "lockouts", res[2], "duration", duration)
+		return &LockoutError{RetryAfter: duration}
 	}
-	return false, nil
+	return ErrOTPInvalid
 }
@@ -2,11 +2,23 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/metrics"
+	"github.com/rznas/zeus/internal/phone"
 )
 
 func TestOTPService_GenerateAndVerify(t *testing.T) {
@@ -17,10 +29,10 @@ func TestOTPService_GenerateAndVerify(t *testing.T) {
 	defer mr.Close()
 
 	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
-	svc := NewOTPService(rdb, 1, 3, 60) // for line 53
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{TTLSeconds: 1, RateLimitPerMin: 3, RateLimitTimeoutSeconds: 60})
 	ctx := context.Background()
 
-	code, err := svc.Generate(ctx, "+15551234567")
+	code, err := svc.Generate(ctx, PurposeLogin, "+15551234567")
 	if err != nil {
 		t.Fatalf("generate: %v", err)
 	}
@@ -28,17 +40,12 @@ func TestOTPService_GenerateAndVerify(t *testing.T) {
 		t.Fatalf("expected 6-digit code, got %q", code)
 	}
 
-	ok, err := svc.Verify(ctx, "+15551234567", code)
-	if err != nil || !ok {
-		t.Fatalf("verify expected true, got %v, err=%v", ok, err)
+	if err := svc.Verify(ctx, PurposeLogin, "+15551234567", code); err != nil {
+		t.Fatalf("verify: %v", err)
 	}
 	// second verify should fail (consumed)
-	ok, err = svc.Verify(ctx, "+15551234567", code)
-	if err != nil {
-		t.Fatalf("verify second err: %v", err)
-	}
-	if ok {
-		t.Fatalf("expected false after consume")
+	if err := svc.Verify(ctx, PurposeLogin, "+15551234567", code); !errors.Is(err, ErrOTPExpired) {
+		t.Fatalf("expected consumed code to be gone, got %v", err)
 	}
 }
 
@@ -50,20 +57,560 @@ func TestOTPService_TTL(t *testing.T) {
 	defer mr.Close()
 
 	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
-	svc := NewOTPService(rdb, 1, 3, 60) // for line 53
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{TTLSeconds: 1, RateLimitPerMin: 3, RateLimitTimeoutSeconds: 60})
 	ctx := context.Background()
 
-	code, err := svc.Generate(ctx, "+15557654321")
+	code, err := svc.Generate(ctx, PurposeLogin, "+15557654321")
 	if err != nil {
 		t.Fatalf("generate: %v", err)
 	}
 	// advance miniredis time to trigger TTL expiry
 	mr.FastForward(2 * time.Second)
-	ok, err := svc.Verify(ctx, "+15557654321", code)
+	if err := svc.Verify(ctx, PurposeLogin, "+15557654321", code); !errors.Is(err, ErrOTPExpired) {
+		t.Fatalf("expected expired code, got %v", err)
+	}
+}
+
+type failingSender struct{}
+
+func (failingSender) Send(ctx context.Context, to, message string) error {
+	return errors.New("provider down")
+}
+
+func TestOTPService_DeliversThroughSender(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	spool := filepath.Join(t.TempDir(), "sms.jsonl")
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewOTPService(rdb, NewFileSender(spool), phone.NewParser("US"), OTPOptions{TTLSeconds: 60, RateLimitPerMin: 3, RateLimitTimeoutSeconds: 60})
+	ctx := context.Background()
+
+	code, err := svc.Generate(ctx, PurposeLogin, "+15551234567")
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	raw, err := os.ReadFile(spool)
+	if err != nil {
+		t.Fatalf("read spool: %v", err)
+	}
+	var msg Message
+	if err := json.Unmarshal([]byte(strings.TrimSpace(string(raw))), &msg); err != nil {
+		t.Fatalf("decode spool: %v", err)
+	}
+	if msg.To != "+15551234567" {
+		t.Fatalf("expected recipient +15551234567, got %q", msg.To)
+	}
+	if !strings.Contains(msg.Message, code) {
+		t.Fatalf("expected message to contain code %q, got %q", code, msg.Message)
+	}
+}
+
+func TestOTPService_DeliveryFailure(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewOTPService(rdb, failingSender{}, phone.NewParser("US"), OTPOptions{TTLSeconds: 60, RateLimitPerMin: 3, RateLimitTimeoutSeconds: 60})
+	ctx := context.Background()
+
+	_, err = svc.Generate(ctx, PurposeLogin, "+15551234567")
+	if !errors.Is(err, ErrDeliveryFailed) {
+		t.Fatalf("expected ErrDeliveryFailed, got %v", err)
+	}
+	if mr.Exists("otp:login:+15551234567") {
+		t.Fatalf("expected undelivered code to be removed")
+	}
+}
+
+func TestOTPService_LockoutAfterMaxAttempts(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{
+		TTLSeconds:              60,
+		RateLimitPerMin:         10,
+		RateLimitTimeoutSeconds: 60,
+		MaxAttempts:             3,
+		LockoutSeconds:          60,
+		LockoutMaxSeconds:       150,
+	})
+	ctx := context.Background()
+	phone := "+15551234567"
+
+	// each round burns a code and the lockout doubles up to the cap
+	for _, want := range []time.Duration{60 * time.Second, 120 * time.Second, 150 * time.Second} {
+		code, err := svc.Generate(ctx, PurposeLogin, phone)
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+		wrong := "000000"
+		if code == wrong {
+			wrong = "111111"
+		}
+		for i := 1; i < 3; i++ {
+			if err := svc.Verify(ctx, PurposeLogin, phone, wrong); !errors.Is(err, ErrOTPInvalid) {
+				t.Fatalf("attempt %d: expected plain rejection, got %v", i, err)
+			}
+		}
+		err = svc.Verify(ctx, PurposeLogin, phone, wrong)
+		var lockErr *LockoutError
+		if !errors.As(err, &lockErr) || !errors.Is(err, ErrOTPLocked) {
+			t.Fatalf("expected lockout error, got %v", err)
+		}
+		if lockErr.RetryAfter != want {
+			t.Fatalf("expected lockout of %s, got %s", want, lockErr.RetryAfter)
+		}
+		var appErr *apperr.Error
+		if !errors.As(err, &appErr) || appErr.RetryAfter != want {
+			t.Fatalf("expected lockout to render with Retry-After %s, got %v", want, appErr)
+		}
+
+		// the correct code no longer works and no new code can be requested
+		if err := svc.Verify(ctx, PurposeLogin, phone, code); !errors.Is(err, ErrOTPLocked) {
+			t.Fatalf("expected locked verify, got %v", err)
+		}
+		if _, err := svc.Generate(ctx, PurposeLogin, phone); !errors.Is(err, ErrOTPLocked) {
+			t.Fatalf("expected locked generate, got %v", err)
+		}
+		mr.FastForward(want)
+		if err := svc.Verify(ctx, PurposeLogin, phone, code); !errors.Is(err, ErrOTPExpired) {
+			t.Fatalf("expected burned code to stay invalid, got %v", err)
+		}
+	}
+}
+
+func TestOTPService_AttemptsWindowDoesNotSlide(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{
+		TTLSeconds:              60,
+		RateLimitPerMin:         10,
+		RateLimitTimeoutSeconds: 60,
+		MaxAttempts:             3,
+		LockoutSeconds:          60,
+	})
+	ctx := context.Background()
+	phone := "+15551234567"
+
+	code, err := svc.Generate(ctx, PurposeLogin, phone)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	for i := 0; i < 2; i++ {
+		if err := svc.Verify(ctx, PurposeLogin, phone, wrong); !errors.Is(err, ErrOTPInvalid) {
+			t.Fatalf("attempt %d: expected plain rejection, got %v", i, err)
+		}
+		mr.FastForward(25 * time.Second)
+	}
+	// the counter expires 60s after the first wrong code, not after the last
+	if ttl := mr.TTL(svc.attemptsKey(phone)); ttl != 10*time.Second {
+		t.Fatalf("expected the attempts window to keep its start, %s left", ttl)
+	}
+	err = svc.Verify(ctx, PurposeLogin, phone, wrong)
+	if !errors.Is(err, ErrOTPLocked) {
+		t.Fatalf("expected lockout on the third wrong code, got %v", err)
+	}
+}
+
+func TestOTPService_NoLockoutWithoutDuration(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{
+		TTLSeconds:              60,
+		RateLimitPerMin:         10,
+		RateLimitTimeoutSeconds: 60,
+		MaxAttempts:             2,
+	})
+	ctx := context.Background()
+	phone := "+15551234567"
+
+	code, err := svc.Generate(ctx, PurposeLogin, phone)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	for i := 0; i < 2; i++ {
+		if err := svc.Verify(ctx, PurposeLogin, phone, wrong); !errors.Is(err, ErrOTPInvalid) {
+			t.Fatalf("attempt %d: expected plain rejection, got %v", i, err)
+		}
+	}
+	// the code is burned but the phone is not locked
+	if err := svc.Verify(ctx, PurposeLogin, phone, code); !errors.Is(err, ErrOTPExpired) {
+		t.Fatalf("expected burned code, got %v", err)
+	}
+	if mr.Exists(svc.lockKey(phone)) {
+		t.Fatalf("expected no lock without a lockout duration")
+	}
+	if _, err := svc.Generate(ctx, PurposeLogin, phone); err != nil {
+		t.Fatalf("expected a new code to be issued, got %v", err)
+	}
+}
+
+func TestOTPService_CanonicalPhoneKeys(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{TTLSeconds: 60, RateLimitPerMin: 3, RateLimitTimeoutSeconds: 60})
+	ctx := context.Background()
+
+	code, err := svc.Generate(ctx, PurposeLogin, "+1 415 555 2671")
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if !mr.Exists("otp:login:+14155552671") {
+		t.Fatalf("expected code stored under the E.164 key")
+	}
+	if err := svc.Verify(ctx, PurposeLogin, "14155552671", code); err != nil {
+		t.Fatalf("expected differently formatted number to verify, got %v", err)
+	}
+}
+
+func TestOTPService_Metrics(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{TTLSeconds: 60, RateLimitPerMin: 1, RateLimitTimeoutSeconds: 60})
+	ctx := context.Background()
+	phone := "+15551234567"
+
+	count := func(c *prometheus.CounterVec, label string) float64 {
+		return testutil.ToFloat64(c.WithLabelValues(label))
+	}
+	sent, limited := count(metrics.OTPGenerated, "sent"), count(metrics.OTPGenerated, "rate_limited")
+	success, invalid, expired := count(metrics.OTPVerified, "success"), count(metrics.OTPVerified, "invalid"), count(metrics.OTPVerified, "expired")
+
+	code, err := svc.Generate(ctx, PurposeLogin, phone)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if _, err := svc.Generate(ctx, PurposeLogin, phone); !errors.Is(err, ErrRateLimitExceeded) {
+		t.Fatalf("expected rate limit, got %v", err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	svc.Verify(ctx, PurposeLogin, phone, wrong)
+	svc.Verify(ctx, PurposeLogin, phone, code)
+	svc.Verify(ctx, PurposeLogin, phone, code)
+
+	if count(metrics.OTPGenerated, "sent")-sent != 1 || count(metrics.OTPGenerated, "rate_limited")-limited != 1 {
+		t.Fatalf("unexpected generate counters")
+	}
+	if count(metrics.OTPVerified, "invalid")-invalid != 1 || count(metrics.OTPVerified, "success")-success != 1 || count(metrics.OTPVerified, "expired")-expired != 1 {
+		t.Fatalf("unexpected verify counters")
+	}
+}
+
+func TestOTPService_RateLimitConcurrent(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr(), PoolSize: 50})
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{TTLSeconds: 60, RateLimitPerMin: 3, RateLimitTimeoutSeconds: 60})
+	ctx := context.Background()
+	const phone = "+15551234567"
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		sent    []string
+		limited int
+	)
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, err := svc.Generate(ctx, PurposeLogin, phone)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				sent = append(sent, code)
+			case errors.Is(err, ErrRateLimitExceeded):
+				limited++
+			default:
+				t.Errorf("generate: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(sent) != 3 || limited != 47 {
+		t.Fatalf("expected 3 sent and 47 limited, got %d and %d", len(sent), limited)
+	}
+	// exactly one of the delivered codes is stored
+	verified := 0
+	for _, code := range sent {
+		if svc.Verify(ctx, PurposeLogin, phone, code) == nil {
+			verified++
+		}
+	}
+	if verified != 1 {
+		t.Fatalf("expected one of %v to verify, %d did", sent, verified)
+	}
+}
+
+func TestOTPService_VerifyConcurrent(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr(), PoolSize: 50})
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{
+		TTLSeconds:              60,
+		RateLimitPerMin:         10,
+		RateLimitTimeoutSeconds: 60,
+		MaxAttempts:             3,
+		LockoutSeconds:          60,
+	})
+	ctx := context.Background()
+	const phone = "+15551234567"
+
+	// run submits code from 50 goroutines at once and counts the results
+	run := func(code string) map[string]int {
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			results = map[string]int{}
+		)
+		for range 50 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := svc.Verify(ctx, PurposeLogin, phone, code)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					results["ok"]++
+				case errors.Is(err, ErrOTPLocked):
+					results["locked"]++
+				case errors.Is(err, ErrOTPInvalid):
+					results["invalid"]++
+				case errors.Is(err, ErrOTPExpired):
+					results["expired"]++
+				default:
+					t.Errorf("verify: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		return results
+	}
+
+	// a code is consumed once, however many submit it at the same time
+	code, err := svc.Generate(ctx, PurposeLogin, phone)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if results := run(code); results["ok"] != 1 || results["expired"] != 49 {
+		t.Fatalf("expected one success and 49 expired, got %v", results)
+	}
+
+	// parallel guesses get no more than MaxAttempts tries
+	code, err = svc.Generate(ctx, PurposeLogin, phone)
 	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	if results := run(wrong); results["invalid"] != 2 || results["locked"] != 48 {
+		t.Fatalf("expected 2 invalid and 48 locked, got %v", results)
+	}
+}
+
+func TestOTPService_RateLimitFixedWindow(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{TTLSeconds: 60, RateLimitPerMin: 2, RateLimitTimeoutSeconds: 60})
+	ctx := context.Background()
+	const phone = "+15551234567"
+
+	if _, err := svc.Generate(ctx, PurposeLogin, phone); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	mr.FastForward(40 * time.Second)
+	if _, err := svc.Generate(ctx, PurposeLogin, phone); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	// a rejected request reports the rest of the window and doesn't extend it
+	_, err = svc.Generate(ctx, PurposeLogin, phone)
+	var appErr *apperr.Error
+	if !errors.As(err, &appErr) || appErr.Code != "otp_rate_limited" || appErr.RetryAfter != 20*time.Second {
+		t.Fatalf("expected rate limit with 20s retry, got %v", err)
+	}
+	mr.FastForward(20 * time.Second)
+	if _, err := svc.Generate(ctx, PurposeLogin, phone); err != nil {
+		t.Fatalf("expected a new window, got %v", err)
+	}
+}
+
+func TestOTPService_ResendCooldownAndStatus(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{
+		TTLSeconds:              300,
+		RateLimitPerMin:         2,
+		RateLimitTimeoutSeconds: 600,
+		ResendCooldownSeconds:   30,
+		MaxAttempts:             3,
+		LockoutSeconds:          900,
+	})
+	ctx := context.Background()
+	const phone = "+15551234567"
+
+	st, err := svc.Status(ctx, PurposeLogin, phone)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if st != (OTPStatus{SendsRemaining: 2, AttemptsRemaining: 3}) {
+		t.Fatalf("unexpected initial status %+v", st)
+	}
+
+	if _, err := svc.Generate(ctx, PurposeLogin, phone); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	_, err = svc.Generate(ctx, PurposeLogin, phone)
+	var appErr *apperr.Error
+	if !errors.As(err, &appErr) || appErr.Code != "otp_resend_too_soon" || appErr.RetryAfter != 30*time.Second {
+		t.Fatalf("expected cooldown with 30s retry, got %v", err)
+	}
+	if err := svc.Verify(ctx, PurposeLogin, phone, "000000"); !errors.Is(err, ErrOTPInvalid) {
+		t.Fatalf("expected invalid code, got %v", err)
+	}
+	st, _ = svc.Status(ctx, PurposeLogin, phone)
+	if st != (OTPStatus{ExpiresIn: 300 * time.Second, ResendAfter: 30 * time.Second, SendsRemaining: 1, AttemptsRemaining: 2}) {
+		t.Fatalf("unexpected status after send %+v", st)
+	}
+
+	// the last send of the window waits for the window, not the cooldown
+	mr.FastForward(30 * time.Second)
+	if _, err := svc.Generate(ctx, PurposeLogin, phone); err != nil {
+		t.Fatalf("generate after cooldown: %v", err)
+	}
+	st, _ = svc.Status(ctx, PurposeLogin, phone)
+	if st.SendsRemaining != 0 || st.ResendAfter != 570*time.Second {
+		t.Fatalf("expected to wait for the window, got %+v", st)
+	}
+
+	// a lockout outlasts the window
+	for range 2 {
+		_ = svc.Verify(ctx, PurposeLogin, phone, "000000")
+	}
+	st, _ = svc.Status(ctx, PurposeLogin, phone)
+	if st != (OTPStatus{ResendAfter: 900 * time.Second}) {
+		t.Fatalf("unexpected status while locked %+v", st)
+	}
+}
+
+func TestOTPService_FormatAndHashedStorage(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	phones := phone.NewParser("US")
+	opts := OTPOptions{Length: 8, Alphabet: "ABCDEFGHJKMNPQRSTVWXYZ23456789", Secret: []byte("test-secret"), TTLSeconds: 60, RateLimitPerMin: 5, RateLimitTimeoutSeconds: 60}
+	svc := NewOTPService(rdb, nil, phones, opts)
+	ctx := context.Background()
+	const phone = "+14155552671"
+
+	code, err := svc.Generate(ctx, PurposeLogin, phone)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if len(code) != 8 || strings.Trim(code, opts.Alphabet) != "" {
+		t.Fatalf("expected 8 characters from the alphabet, got %q", code)
+	}
+	stored, err := mr.Get("otp:login:" + phone)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if strings.Contains(stored, code) || len(stored) != 64 {
+		t.Fatalf("expected a hex digest to be stored, got %q", stored)
+	}
+	// another secret can't verify the stored digest
+	other := NewOTPService(rdb, nil, phones, OTPOptions{Secret: []byte("other"), TTLSeconds: 60, RateLimitPerMin: 5, RateLimitTimeoutSeconds: 60})
+	if err := other.Verify(ctx, PurposeLogin, phone, code); !errors.Is(err, ErrOTPInvalid) {
+		t.Fatalf("expected a different secret to fail, got %v", err)
+	}
+	// typed in lower case with stray spaces
+	if err := svc.Verify(ctx, PurposeLogin, phone, " "+strings.ToLower(code)+" "); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
+
+func TestOTPService_PurposeBinding(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewOTPService(rdb, nil, phone.NewParser("US"), OTPOptions{TTLSeconds: 60, RateLimitPerMin: 5, RateLimitTimeoutSeconds: 60, MaxAttempts: 5})
+	ctx := context.Background()
+	const phone = "+14155552671"
+
+	code, err := svc.Generate(ctx, PurposeAccountDeletion, phone)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if err := svc.Verify(ctx, PurposeLogin, phone, code); !errors.Is(err, ErrOTPExpired) {
+		t.Fatalf("expected no login code to be pending, got %v", err)
+	}
+	// copying the stored digest to another purpose doesn't help either
+	stored, _ := mr.Get("otp:account_deletion:" + phone)
+	mr.Set("otp:phone_change:"+phone, stored)
+	if err := svc.Verify(ctx, PurposePhoneChange, phone, code); !errors.Is(err, ErrOTPInvalid) {
+		t.Fatalf("expected code to be bound to its purpose, got %v", err)
+	}
+	if err := svc.Verify(ctx, PurposeAccountDeletion, phone, code); err != nil {
 		t.Fatalf("verify: %v", err)
 	}
-	if ok {
-		t.Fatalf("expected false after expiry")
+	if _, err := svc.Generate(ctx, OTPPurpose("admin"), phone); !errors.Is(err, ErrUnknownPurpose) {
+		t.Fatalf("expected unknown purpose, got %v", err)
 	}
 }
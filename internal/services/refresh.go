@@ -0,0 +1,164 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/apperr"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired or revoked refresh tokens
+	ErrInvalidRefreshToken = apperr.Unauthorized("invalid_refresh_token", "invalid refresh token")
+	// ErrRefreshTokenReused is returned when an already rotated refresh token is presented again.
+	// The whole token family is revoked when this happens.
+	ErrRefreshTokenReused = apperr.Unauthorized("refresh_token_reused", "refresh token reuse detected")
+)
+
+// RefreshToken is a freshly issued refresh token together with the session it belongs to
+type RefreshToken struct {
+	Token    string
+	UserID   uuid.UUID
+	FamilyID string
+}
+
+// RefreshTokenService issues opaque, one-time refresh tokens stored hashed in Redis.
+//
+// Every login starts a token family. Rotating a token marks it as used and
+// issues a new token in the same family; presenting a used token again revokes
+// the family so neither the attacker nor the victim can keep refreshing.
+type RefreshTokenService struct {
+	redis  *redisv9.Client
+	prefix string
+	ttl    time.Duration
+}
+
+func NewRefreshTokenService(client *redisv9.Client, ttlHours int) *RefreshTokenService {
+	return &RefreshTokenService{
+		redis:  client,
+		prefix: "refresh:",
+		ttl:    time.Duration(ttlHours) * time.Hour,
+	}
+}
+
+// TTL returns the lifetime of a refresh token
+func (s *RefreshTokenService) TTL() time.Duration {
+	return s.ttl
+}
+
+func (s *RefreshTokenService) tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return s.prefix + "token:" + hex.EncodeToString(sum[:])
+}
+
+func (s *RefreshTokenService) familyKey(familyID string) string {
+	return s.prefix + "family:" + familyID
+}
+
+func (s *RefreshTokenService) userKey(userID uuid.UUID) string {
+	return s.prefix + "user:" + userID.String()
+}
+
+// Issue starts a new token family for the user and returns its first refresh token
+func (s *RefreshTokenService) Issue(ctx context.Context, userID uuid.UUID) (*RefreshToken, error) {
+	familyID := uuid.NewString()
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, s.familyKey(familyID), userID.String(), s.ttl)
+	pipe.SAdd(ctx, s.userKey(userID), familyID)
+	pipe.Expire(ctx, s.userKey(userID), s.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return s.store(ctx, userID, familyID)
+}
+
+// Rotate consumes the given refresh token and returns a new one for the same session
+func (s *RefreshTokenService) Rotate(ctx context.Context, token string) (*RefreshToken, error) {
+	key := s.tokenKey(token)
+	fields, err := s.redis.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrInvalidRefreshToken
+	}
+	userID, err := uuid.Parse(fields["uid"])
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	familyID := fields["family"]
+
+	// family is gone when it was revoked or expired
+	exists, err := s.redis.Exists(ctx, s.familyKey(familyID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// HINCRBY is atomic, so only the first caller sees 1
+	used, err := s.redis.HIncrBy(ctx, key, "used", 1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if used > 1 {
+		if err := s.RevokeFamily(ctx, familyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	// the user's set of families has to outlive every family in it, or
+	// RevokeUser would no longer find the sessions that keep rotating
+	pipe := s.redis.TxPipeline()
+	pipe.Expire(ctx, s.familyKey(familyID), s.ttl)
+	pipe.SAdd(ctx, s.userKey(userID), familyID)
+	pipe.Expire(ctx, s.userKey(userID), s.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return s.store(ctx, userID, familyID)
+}
+
+// RevokeFamily invalidates every refresh token descending from the same login
+func (s *RefreshTokenService) RevokeFamily(ctx context.Context, familyID string) error {
+	return s.redis.Del(ctx, s.familyKey(familyID)).Err()
+}
+
+// RevokeUser invalidates the refresh tokens of every session the user has
+func (s *RefreshTokenService) RevokeUser(ctx context.Context, userID uuid.UUID) error {
+	families, err := s.redis.SMembers(ctx, s.userKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{s.userKey(userID)}
+	for _, familyID := range families {
+		keys = append(keys, s.familyKey(familyID))
+	}
+	return s.redis.Del(ctx, keys...).Err()
+}
+
+func (s *RefreshTokenService) store(ctx context.Context, userID uuid.UUID, familyID string) (*RefreshToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	key := s.tokenKey(token)
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, key, "uid", userID.String(), "family", familyID, "used", 0)
+	pipe.Expire(ctx, key, s.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return &RefreshToken{Token: token, UserID: userID, FamilyID: familyID}, nil
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+)
+
+func TestRefreshTokenService_Rotate(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewRefreshTokenService(rdb, 1)
+	ctx := context.Background()
+	uid := uuid.New()
+
+	first, err := svc.Issue(ctx, uid)
+	if err != nil || first.Token == "" {
+		t.Fatalf("issue: %v, tok=%+v", err, first)
+	}
+	second, err := svc.Rotate(ctx, first.Token)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if second.UserID != uid {
+		t.Fatalf("expected uid %s, got %s", uid, second.UserID)
+	}
+	if second.Token == first.Token {
+		t.Fatalf("expected a new token after rotation")
+	}
+	if second.FamilyID != first.FamilyID {
+		t.Fatalf("expected rotation to stay in family %s, got %s", first.FamilyID, second.FamilyID)
+	}
+	if _, err := svc.Rotate(ctx, second.Token); err != nil {
+		t.Fatalf("rotate second: %v", err)
+	}
+}
+
+func TestRefreshTokenService_ReuseRevokesFamily(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewRefreshTokenService(rdb, 1)
+	ctx := context.Background()
+
+	first, err := svc.Issue(ctx, uuid.New())
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	second, err := svc.Rotate(ctx, first.Token)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	// replaying the consumed token must be detected
+	if _, err := svc.Rotate(ctx, first.Token); err != ErrRefreshTokenReused {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	// and the legitimate successor is revoked along with the family
+	if _, err := svc.Rotate(ctx, second.Token); err != ErrInvalidRefreshToken {
+		t.Fatalf("expected ErrInvalidRefreshToken after family revocation, got %v", err)
+	}
+}
+
+func TestRefreshTokenService_Unknown(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewRefreshTokenService(rdb, 1)
+
+	if _, err := svc.Rotate(context.Background(), "not-a-token"); err != ErrInvalidRefreshToken {
+		t.Fatalf("expected ErrInvalidRefreshToken, got %v", err)
+	}
+}
+
+func TestRefreshTokenService_RevokeUser(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewRefreshTokenService(rdb, 1)
+	ctx := context.Background()
+	uid := uuid.New()
+
+	phone, err := svc.Issue(ctx, uid)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	laptop, err := svc.Issue(ctx, uid)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	if err := svc.RevokeUser(ctx, uid); err != nil {
+		t.Fatalf("revoke user: %v", err)
+	}
+	for _, tok := range []*RefreshToken{phone, laptop} {
+		if _, err := svc.Rotate(ctx, tok.Token); err != ErrInvalidRefreshToken {
+			t.Fatalf("expected ErrInvalidRefreshToken, got %v", err)
+		}
+	}
+}
+
+func TestRefreshTokenService_RevokeUserAfterRotations(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewRefreshTokenService(rdb, 1)
+	ctx := context.Background()
+	uid := uuid.New()
+
+	tok, err := svc.Issue(ctx, uid)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	// the session keeps rotating for longer than the TTL given at login
+	for i := 0; i < 3; i++ {
+		mr.FastForward(40 * time.Minute)
+		if tok, err = svc.Rotate(ctx, tok.Token); err != nil {
+			t.Fatalf("rotate %d: %v", i, err)
+		}
+	}
+	if err := svc.RevokeUser(ctx, uid); err != nil {
+		t.Fatalf("revoke user: %v", err)
+	}
+	if _, err := svc.Rotate(ctx, tok.Token); err != ErrInvalidRefreshToken {
+		t.Fatalf("expected ErrInvalidRefreshToken, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+)
+
+// RevocationService keeps a Redis denylist of access tokens that must be
+// rejected before they expire on their own.
+type RevocationService struct {
+	redis  *redisv9.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRevocationService creates a revocation store. accessExpiresMinutes must
+// match the access token lifetime so entries outlive every token they cover.
+func NewRevocationService(client *redisv9.Client, accessExpiresMinutes int) *RevocationService {
+	return &RevocationService{
+		redis:  client,
+		prefix: "revoked:",
+		ttl:    time.Duration(accessExpiresMinutes) * time.Minute,
+	}
+}
+
+func (s *RevocationService) tokenKey(jti string) string {
+	return s.prefix + "jti:" + jti
+}
+
+func (s *RevocationService) userKey(userID uuid.UUID) string {
+	return s.prefix + "user:" + userID.String()
+}
+
+// RevokeToken denies a single access token until it expires
+func (s *RevocationService) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return s.redis.Set(ctx, s.tokenKey(jti), 1, ttl).Err()
+}
+
+// RevokeUser denies every access token issued to the user up to now
+func (s *RevocationService) RevokeUser(ctx context.Context, userID uuid.UUID) error {
+	return s.redis.Set(ctx, s.userKey(userID), time.Now().Unix(), s.ttl).Err()
+}
+
+// IsRevoked reports whether the token was revoked individually or by a
+// per-user "tokens valid after" cutoff
+func (s *RevocationService) IsRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	if claims.ID != "" {
+		n, err := s.redis.Exists(ctx, s.tokenKey(claims.ID)).Result()
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+
+	userID, err := uuid.Parse(claims.UserID)
+	if err != nil {
+		return false, nil
+	}
+	v, err := s.redis.Get(ctx, s.userKey(userID)).Result()
+	if err == redisv9.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	cutoff, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	// iat has second precision, so anything issued in the cutoff second is revoked too
+	return claims.IssuedAt == nil || claims.IssuedAt.Unix() <= cutoff, nil
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+)
+
+func TestRevocationService_RevokeToken(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewRevocationService(rdb, 1)
+	jwtSvc := NewJWTService("secret", 1)
+	ctx := context.Background()
+
+	tok, err := jwtSvc.Generate(uuid.New(), "", nil)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	claims, err := jwtSvc.Parse(tok)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if revoked, err := svc.IsRevoked(ctx, claims); err != nil || revoked {
+		t.Fatalf("expected fresh token to be valid, revoked=%v err=%v", revoked, err)
+	}
+	if err := svc.RevokeToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if revoked, err := svc.IsRevoked(ctx, claims); err != nil || !revoked {
+		t.Fatalf("expected token to be revoked, revoked=%v err=%v", revoked, err)
+	}
+}
+
+func TestRevocationService_RevokeUser(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	svc := NewRevocationService(rdb, 1)
+	jwtSvc := NewJWTService("secret", 1)
+	ctx := context.Background()
+	uid := uuid.New()
+
+	old, err := jwtSvc.Generate(uid, "", nil)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	oldClaims, _ := jwtSvc.Parse(old)
+	if err := svc.RevokeUser(ctx, uid); err != nil {
+		t.Fatalf("revoke user: %v", err)
+	}
+	if revoked, err := svc.IsRevoked(ctx, oldClaims); err != nil || !revoked {
+		t.Fatalf("expected token issued before logout to be revoked, revoked=%v err=%v", revoked, err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	fresh, err := jwtSvc.Generate(uid, "", nil)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	freshClaims, _ := jwtSvc.Parse(fresh)
+	if revoked, err := svc.IsRevoked(ctx, freshClaims); err != nil || revoked {
+		t.Fatalf("expected token issued after logout to be valid, revoked=%v err=%v", revoked, err)
+	}
+}
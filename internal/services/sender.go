@@ -0,0 +1,128 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/rznas/zeus/internal/apperr"
+)
+
+// ErrDeliveryFailed is returned when an OTP could not be handed to the delivery provider
+var ErrDeliveryFailed = apperr.Upstream("otp_delivery_failed", "failed to deliver otp")
+
+// Sender delivers a text message to a phone number or email address
+type Sender interface {
+	Send(ctx context.Context, to, message string) error
+}
+
+// Message is the payload written by the webhook and file senders
+type Message struct {
+	To      string    `json:"to"`
+	Message string    `json:"message"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// ConsoleSender writes messages to the log. Codes, numbers and addresses are
+// masked there like everywhere else; use the FileSender to read codes in development.
+type ConsoleSender struct {
+	logger *slog.Logger
+	event  string
+}
+
+func NewConsoleSender(logger *slog.Logger) *ConsoleSender {
+	return &ConsoleSender{logger: logger, event: "sms sent"}
+}
+
+// NewConsoleMailer is a ConsoleSender for email
+func NewConsoleMailer(logger *slog.Logger) *ConsoleSender {
+	return &ConsoleSender{logger: logger, event: "email sent"}
+}
+
+func (s *ConsoleSender) Send(ctx context.Context, to, message string) error {
+	s.logger.InfoContext(ctx, s.event, "to", to, "message", message)
+	return nil
+}
+
+// WebhookSender posts messages as JSON to an HTTP endpoint
+type WebhookSender struct {
+	url       string
+	authToken string
+	client    *http.Client
+}
+
+func NewWebhookSender(url, authToken string, timeoutSeconds int) *WebhookSender {
+	return &WebhookSender{
+		url:       url,
+		authToken: authToken,
+		client:    &http.Client{Timeout: time.Duration(timeoutSeconds) * time.Second},
+	}
+}
+
+func (s *WebhookSender) Send(ctx context.Context, to, message string) error {
+	body, err := json.Marshal(Message{To: to, Message: message, SentAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// continue the trace in the gateway if it understands traceparent
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if s.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.authToken)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// FileSender appends messages as JSON lines to a spool file. Useful in tests
+// and local setups where another process picks up the codes.
+type FileSender struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileSender(path string) *FileSender {
+	return &FileSender{path: path}
+}
+
+func (s *FileSender) Send(ctx context.Context, to, message string) error {
+	line, err := json.Marshal(Message{To: to, Message: message, SentAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
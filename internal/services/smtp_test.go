@@ -0,0 +1,86 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts a single message and sends its DATA to the returned channel
+func fakeSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	data := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				var b strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					b.WriteString(l)
+				}
+				data <- b.String()
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), data
+}
+
+func TestSMTPSender(t *testing.T) {
+	addr, data := fakeSMTP(t)
+	s := NewSMTPSender(SMTPOptions{Addr: addr, From: "Zeus <no-reply@example.com>", Subject: "Your Zeus code", Timeout: 5 * time.Second})
+	if err := s.Send(context.Background(), "ada@example.com", "Your code is 123456\nBye"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	got := <-data
+	for _, want := range []string{"To: ada@example.com\r\n", "Subject: Your Zeus code\r\n", "\r\n\r\nYour code is 123456\r\nBye\r\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in message %q", want, got)
+		}
+	}
+}
+
+func TestSMTPSenderUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	s := NewSMTPSender(SMTPOptions{Addr: addr, From: "no-reply@example.com", Timeout: time.Second})
+	if err := s.Send(context.Background(), "ada@example.com", "hi"); err == nil {
+		t.Fatal("expected an error for a closed port")
+	}
+}
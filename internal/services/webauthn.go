@@ -0,0 +1,330 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/apperr"
+	"github.com/rznas/zeus/internal/metrics"
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/repositories"
+)
+
+var (
+	// ErrInvalidWebAuthnSession is returned for unknown, expired or already finished ceremonies
+	ErrInvalidWebAuthnSession = apperr.Unauthorized("invalid_webauthn_session", "passkey session is invalid or expired")
+	// ErrPasskeyInvalid is returned when a passkey login can't be verified
+	ErrPasskeyInvalid = apperr.Unauthorized("passkey_invalid", "passkey could not be verified")
+	// ErrPasskeyRejected is returned when the response to a registration can't be verified
+	ErrPasskeyRejected = apperr.Invalid("passkey_rejected", "passkey registration could not be verified")
+	// ErrPasskeyExists is returned when registering an authenticator that is already registered
+	ErrPasskeyExists = apperr.Conflict("passkey_already_registered", "passkey already registered")
+)
+
+const (
+	defaultWebAuthnRPName  = "Zeus"
+	defaultWebAuthnTimeout = 5 * time.Minute
+)
+
+// WebAuthnOptions configures the relying party passkeys are bound to
+type WebAuthnOptions struct {
+	// RPID is the domain passkeys are scoped to, without scheme and port.
+	// Changing it makes every registered passkey unusable.
+	RPID string
+	// RPName is shown by the browser while creating a passkey, empty means "Zeus"
+	RPName string
+	// RPOrigins are the origins of the pages allowed to run the ceremonies
+	RPOrigins []string
+	// TimeoutSeconds is how long a ceremony may take, zero means 300
+	TimeoutSeconds int
+}
+
+// WebAuthnService registers passkeys and signs users in with them, without
+// any code sent by SMS or email.
+//
+// Both ceremonies take two requests: Begin* hands out the options for
+// navigator.credentials and a session id, Finish* verifies the authenticator's
+// response against the session. Sessions live in Redis and can be finished
+// once; credentials are stored in Postgres.
+type WebAuthnService struct {
+	webauthn *webauthn.WebAuthn
+	repo     repositories.WebAuthnRepository
+	redis    *redisv9.Client
+	timeout  time.Duration
+}
+
+func NewWebAuthnService(repo repositories.WebAuthnRepository, client *redisv9.Client, opts WebAuthnOptions) (*WebAuthnService, error) {
+	if opts.RPID == "" {
+		return nil, errors.New("webauthn relying party id cannot be empty")
+	}
+	if opts.RPName == "" {
+		opts.RPName = defaultWebAuthnRPName
+	}
+	timeout := time.Duration(opts.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultWebAuthnTimeout
+	}
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          opts.RPID,
+		RPDisplayName: opts.RPName,
+		RPOrigins:     opts.RPOrigins,
+		// passkeys replace the login code, so the authenticator has to
+		// verify the user itself with a PIN or biometrics
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationRequired,
+		},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: timeout, TimeoutUVD: timeout},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: timeout, TimeoutUVD: timeout},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnService{webauthn: w, repo: repo, redis: client, timeout: timeout}, nil
+}
+
+// SessionTTL returns how long a ceremony may take
+func (s *WebAuthnService) SessionTTL() time.Duration {
+	return s.timeout
+}
+
+// sessionKey keeps registration and login sessions apart, so one can't be
+// finished as the other
+func (s *WebAuthnService) sessionKey(ceremony, id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "webauthn:" + ceremony + ":" + hex.EncodeToString(sum[:])
+}
+
+func (s *WebAuthnService) saveSession(ctx context.Context, ceremony string, session *webauthn.SessionData) (string, error) {
+	raw, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+	if err := s.redis.Set(ctx, s.sessionKey(ceremony, id), raw, s.timeout).Err(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// takeSession returns and deletes a session, so every session is finished at most once
+func (s *WebAuthnService) takeSession(ctx context.Context, ceremony, id string) (*webauthn.SessionData, error) {
+	raw, err := s.redis.GetDel(ctx, s.sessionKey(ceremony, id)).Bytes()
+	if errors.Is(err, redisv9.Nil) {
+		return nil, ErrInvalidWebAuthnSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session webauthn.SessionData
+	if err := json.Unmarshal(raw, &session); err != nil {
+		return nil, ErrInvalidWebAuthnSession
+	}
+	return &session, nil
+}
+
+// BeginRegistration returns the options for navigator.credentials.create and
+// the id of the session to finish the registration with
+func (s *WebAuthnService) BeginRegistration(ctx context.Context, user *models.User) (*protocol.CredentialCreation, string, error) {
+	creds, err := s.repo.ListByUser(ctx, user.ID.String())
+	if err != nil {
+		return nil, "", err
+	}
+	wu := &webAuthnUser{user: user, creds: creds}
+	// the authenticator refuses to register a second passkey for the same account
+	creation, session, err := s.webauthn.BeginRegistration(wu,
+		webauthn.WithExclusions(webauthn.Credentials(wu.WebAuthnCredentials()).CredentialDescriptors()))
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := s.saveSession(ctx, "registration", session)
+	if err != nil {
+		return nil, "", err
+	}
+	return creation, id, nil
+}
+
+// FinishRegistration verifies the response of navigator.credentials.create
+// and stores the new passkey under name
+func (s *WebAuthnService) FinishRegistration(ctx context.Context, user *models.User, sessionID, name string, response []byte) (*models.WebAuthnCredential, error) {
+	session, err := s.takeSession(ctx, "registration", sessionID)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return nil, ErrPasskeyRejected.Wrap(err)
+	}
+	wu := &webAuthnUser{user: user}
+	// a session of another user fails here too
+	cred, err := s.webauthn.CreateCredential(wu, *session, parsed)
+	if err != nil {
+		return nil, ErrPasskeyRejected.Wrap(err)
+	}
+	if _, err := s.repo.GetByCredentialID(ctx, cred.ID); err == nil {
+		return nil, ErrPasskeyExists
+	} else if !errors.Is(err, repositories.ErrWebAuthnCredentialNotFound) {
+		return nil, err
+	}
+
+	transports := make([]string, len(cred.Transport))
+	for i, t := range cred.Transport {
+		transports[i] = string(t)
+	}
+	rec := &models.WebAuthnCredential{
+		UserID:          user.ID,
+		CredentialID:    cred.ID,
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		AAGUID:          cred.Authenticator.AAGUID,
+		SignCount:       cred.Authenticator.SignCount,
+		BackupEligible:  cred.Flags.BackupEligible,
+		BackupState:     cred.Flags.BackupState,
+		Transports:      strings.Join(transports, ","),
+		Name:            name,
+	}
+	if err := s.repo.Create(ctx, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// BeginLogin returns the options for navigator.credentials.get and the id of
+// the session to finish the login with. No account is named up front, the
+// user picks one of the passkeys their authenticator holds for this site.
+func (s *WebAuthnService) BeginLogin(ctx context.Context) (*protocol.CredentialAssertion, string, error) {
+	assertion, session, err := s.webauthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := s.saveSession(ctx, "login", session)
+	if err != nil {
+		return nil, "", err
+	}
+	return assertion, id, nil
+}
+
+// FinishLogin verifies the response of navigator.credentials.get and returns
+// the user the passkey belongs to
+func (s *WebAuthnService) FinishLogin(ctx context.Context, sessionID string, response []byte) (uuid.UUID, error) {
+	session, err := s.takeSession(ctx, "login", sessionID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		metrics.PasskeyLogins.WithLabelValues("invalid").Inc()
+		return uuid.Nil, ErrPasskeyInvalid.Wrap(err)
+	}
+
+	var rec *models.WebAuthnCredential
+	lookup := func(rawID, userHandle []byte) (webauthn.User, error) {
+		found, err := s.repo.GetByCredentialID(ctx, rawID)
+		if err != nil {
+			return nil, err
+		}
+		// the user handle is the user id given to the authenticator at registration
+		if !bytes.Equal(found.UserID[:], userHandle) {
+			return nil, errors.New("user handle does not match the credential")
+		}
+		rec = found
+		return &webAuthnUser{user: &models.User{ID: found.UserID}, creds: []models.WebAuthnCredential{*found}}, nil
+	}
+	_, cred, err := s.webauthn.ValidatePasskeyLogin(lookup, *session, parsed)
+	if err != nil {
+		metrics.PasskeyLogins.WithLabelValues("invalid").Inc()
+		return uuid.Nil, ErrPasskeyInvalid.Wrap(err)
+	}
+	// a counter that went backwards means two authenticators share the key
+	if cred.Authenticator.CloneWarning {
+		metrics.PasskeyLogins.WithLabelValues("cloned").Inc()
+		return uuid.Nil, ErrPasskeyInvalid.Wrap(errors.New("signature counter did not increase, the authenticator may be cloned"))
+	}
+
+	rec.SignCount = cred.Authenticator.SignCount
+	rec.BackupState = cred.Flags.BackupState
+	if err := s.repo.UpdateUsage(ctx, rec); err != nil {
+		return uuid.Nil, err
+	}
+	metrics.PasskeyLogins.WithLabelValues("success").Inc()
+	return rec.UserID, nil
+}
+
+// Credentials lists the passkeys of a user, oldest first
+func (s *WebAuthnService) Credentials(ctx context.Context, userID uuid.UUID) ([]models.WebAuthnCredential, error) {
+	return s.repo.ListByUser(ctx, userID.String())
+}
+
+// DeleteCredential removes a passkey of the user
+func (s *WebAuthnService) DeleteCredential(ctx context.Context, userID, id uuid.UUID) error {
+	return s.repo.Delete(ctx, userID.String(), id.String())
+}
+
+// webAuthnUser adapts a user and their passkeys to webauthn.User
+type webAuthnUser struct {
+	user  *models.User
+	creds []models.WebAuthnCredential
+}
+
+// WebAuthnID is the user id, which is not personal data the authenticator would leak
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return u.user.ID[:]
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Phone
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	if u.user.DisplayName != "" {
+		return u.user.DisplayName
+	}
+	return u.user.Phone
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, len(u.creds))
+	for i, c := range u.creds {
+		var transports []protocol.AuthenticatorTransport
+		if c.Transports != "" {
+			for _, t := range strings.Split(c.Transports, ",") {
+				transports = append(transports, protocol.AuthenticatorTransport(t))
+			}
+		}
+		creds[i] = webauthn.Credential{
+			ID:              c.CredentialID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		}
+	}
+	return creds
+}
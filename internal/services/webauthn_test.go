@@ -0,0 +1,354 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/google/uuid"
+	redisv9 "github.com/redis/go-redis/v9"
+
+	"github.com/rznas/zeus/internal/models"
+	"github.com/rznas/zeus/internal/repositories"
+)
+
+const testOrigin = "http://localhost:3000"
+
+// memoryWebAuthnRepo is an in-memory repositories.WebAuthnRepository
+type memoryWebAuthnRepo struct {
+	mu    sync.Mutex
+	creds []models.WebAuthnCredential
+}
+
+func (r *memoryWebAuthnRepo) ListByUser(_ context.Context, userID string) ([]models.WebAuthnCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []models.WebAuthnCredential
+	for _, c := range r.creds {
+		if c.UserID.String() == userID {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (r *memoryWebAuthnRepo) GetByCredentialID(_ context.Context, credentialID []byte) (*models.WebAuthnCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.creds {
+		if bytes.Equal(c.CredentialID, credentialID) {
+			return &c, nil
+		}
+	}
+	return nil, repositories.ErrWebAuthnCredentialNotFound
+}
+
+func (r *memoryWebAuthnRepo) Create(_ context.Context, cred *models.WebAuthnCredential) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cred.ID = uuid.New()
+	cred.CreatedAt = time.Now()
+	r.creds = append(r.creds, *cred)
+	return nil
+}
+
+func (r *memoryWebAuthnRepo) UpdateUsage(_ context.Context, cred *models.WebAuthnCredential) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, c := range r.creds {
+		if c.ID == cred.ID {
+			now := time.Now()
+			r.creds[i].SignCount = cred.SignCount
+			r.creds[i].BackupState = cred.BackupState
+			r.creds[i].LastUsedAt = &now
+		}
+	}
+	return nil
+}
+
+func (r *memoryWebAuthnRepo) Delete(_ context.Context, userID, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, c := range r.creds {
+		if c.UserID.String() == userID && c.ID.String() == id {
+			r.creds = append(r.creds[:i], r.creds[i+1:]...)
+			return nil
+		}
+	}
+	return repositories.ErrWebAuthnCredentialNotFound
+}
+
+// softAuthenticator is a platform authenticator holding one ES256 passkey,
+// answering the ceremonies the way a browser would serialize them
+type softAuthenticator struct {
+	t       *testing.T
+	rpID    string
+	origin  string
+	key     *ecdsa.PrivateKey
+	id      []byte
+	user    []byte
+	counter uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatalf("credential id: %v", err)
+	}
+	return &softAuthenticator{t: t, rpID: "localhost", origin: testOrigin, key: key, id: id}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// authData builds the authenticator data with UP, UV and BE set, followed by
+// attested when it is not nil
+func (a *softAuthenticator) authData(attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	flags := byte(0x01 | 0x04 | 0x08) // user present, user verified, backup eligible
+	if attested != nil {
+		flags |= 0x40
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) clientData(typ, challenge string) []byte {
+	raw, _ := json.Marshal(map[string]any{"type": typ, "challenge": challenge, "origin": a.origin, "crossOrigin": false})
+	return raw
+}
+
+// create answers navigator.credentials.create with a "none" attestation
+func (a *softAuthenticator) create(challenge string, userHandle []byte) []byte {
+	a.t.Helper()
+	a.user = userHandle
+	pub, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{KeyType: int64(webauthncose.EllipticKey), Algorithm: int64(webauthncose.AlgES256)},
+		Curve:         int64(webauthncose.P256),
+		XCoord:        a.key.X.FillBytes(make([]byte, 32)),
+		YCoord:        a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatalf("marshal public key: %v", err)
+	}
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, pub...)
+	object, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(attested),
+	})
+	if err != nil {
+		a.t.Fatalf("marshal attestation: %v", err)
+	}
+	raw, _ := json.Marshal(map[string]any{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64(a.clientData("webauthn.create", challenge)),
+			"attestationObject": b64(object),
+			"transports":        []string{"internal", "hybrid"},
+		},
+	})
+	return raw
+}
+
+// get answers navigator.credentials.get, counting the signature
+func (a *softAuthenticator) get(challenge string) []byte {
+	a.t.Helper()
+	a.counter++
+	authData := a.authData(nil)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatalf("sign: %v", err)
+	}
+	raw, _ := json.Marshal(map[string]any{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(sig),
+			"userHandle":        b64(a.user),
+		},
+	})
+	return raw
+}
+
+func newTestWebAuthnService(t *testing.T) (*WebAuthnService, *miniredis.Miniredis, *memoryWebAuthnRepo) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redisv9.NewClient(&redisv9.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	repo := &memoryWebAuthnRepo{}
+	svc, err := NewWebAuthnService(repo, rdb, WebAuthnOptions{RPID: "localhost", RPOrigins: []string{testOrigin}})
+	if err != nil {
+		t.Fatalf("new webauthn service: %v", err)
+	}
+	return svc, mr, repo
+}
+
+// register runs a registration ceremony of a for user
+func register(t *testing.T, svc *WebAuthnService, user *models.User, a *softAuthenticator) (*models.WebAuthnCredential, error) {
+	t.Helper()
+	ctx := context.Background()
+	creation, sessionID, err := svc.BeginRegistration(ctx, user)
+	if err != nil {
+		t.Fatalf("begin registration: %v", err)
+	}
+	return svc.FinishRegistration(ctx, user, sessionID, "Laptop", a.create(creation.Response.Challenge.String(), user.ID[:]))
+}
+
+// login runs a login ceremony of a
+func login(t *testing.T, svc *WebAuthnService, a *softAuthenticator) (uuid.UUID, error) {
+	t.Helper()
+	ctx := context.Background()
+	assertion, sessionID, err := svc.BeginLogin(ctx)
+	if err != nil {
+		t.Fatalf("begin login: %v", err)
+	}
+	return svc.FinishLogin(ctx, sessionID, a.get(assertion.Response.Challenge.String()))
+}
+
+func TestWebAuthnService_RegisterAndLogin(t *testing.T) {
+	svc, _, repo := newTestWebAuthnService(t)
+	ctx := context.Background()
+	user := &models.User{ID: uuid.New(), Phone: "+12025550100"}
+	a := newSoftAuthenticator(t)
+
+	cred, err := register(t, svc, user, a)
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if cred.UserID != user.ID || !bytes.Equal(cred.CredentialID, a.id) || cred.Name != "Laptop" || cred.Transports != "internal,hybrid" || !cred.BackupEligible {
+		t.Fatalf("unexpected credential %+v", cred)
+	}
+
+	// the new passkey is excluded from further registrations and can't be added twice
+	creation, _, err := svc.BeginRegistration(ctx, user)
+	if err != nil {
+		t.Fatalf("begin registration: %v", err)
+	}
+	if ex := creation.Response.CredentialExcludeList; len(ex) != 1 || !bytes.Equal(ex[0].CredentialID, a.id) {
+		t.Fatalf("expected the passkey in the exclude list, got %+v", ex)
+	}
+	a.counter = 0
+	if _, err := register(t, svc, user, a); !errors.Is(err, ErrPasskeyExists) {
+		t.Fatalf("expected a second registration to fail, got %v", err)
+	}
+
+	uid, err := login(t, svc, a)
+	if err != nil || uid != user.ID {
+		t.Fatalf("expected login as %s, got %s %v", user.ID, uid, err)
+	}
+	stored, _ := repo.GetByCredentialID(ctx, a.id)
+	if stored.SignCount != 1 || stored.LastUsedAt == nil {
+		t.Fatalf("expected the usage to be stored, got %+v", stored)
+	}
+	if _, err := login(t, svc, a); err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+
+	// a counter that doesn't move forward points at a cloned key
+	a.counter = 0
+	if _, err := login(t, svc, a); !errors.Is(err, ErrPasskeyInvalid) {
+		t.Fatalf("expected a cloned authenticator to be rejected, got %v", err)
+	}
+
+	creds, _ := svc.Credentials(ctx, user.ID)
+	if len(creds) != 1 {
+		t.Fatalf("expected one passkey, got %d", len(creds))
+	}
+	if err := svc.DeleteCredential(ctx, uuid.New(), creds[0].ID); !errors.Is(err, repositories.ErrWebAuthnCredentialNotFound) {
+		t.Fatalf("expected another user's passkey not to be deleted, got %v", err)
+	}
+	if err := svc.DeleteCredential(ctx, user.ID, creds[0].ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	a.counter = 10
+	if _, err := login(t, svc, a); !errors.Is(err, ErrPasskeyInvalid) {
+		t.Fatalf("expected a deleted passkey to be rejected, got %v", err)
+	}
+}
+
+func TestWebAuthnService_Sessions(t *testing.T) {
+	svc, mr, _ := newTestWebAuthnService(t)
+	ctx := context.Background()
+	user := &models.User{ID: uuid.New(), Phone: "+12025550100"}
+	a := newSoftAuthenticator(t)
+	if _, err := register(t, svc, user, a); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// a session is finished once, even by a valid response
+	assertion, sessionID, _ := svc.BeginLogin(ctx)
+	challenge := assertion.Response.Challenge.String()
+	if _, err := svc.FinishLogin(ctx, sessionID, a.get(challenge)); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if _, err := svc.FinishLogin(ctx, sessionID, a.get(challenge)); !errors.Is(err, ErrInvalidWebAuthnSession) {
+		t.Fatalf("expected a finished session to be gone, got %v", err)
+	}
+
+	// the response must answer the challenge of its own session
+	_, sessionID, _ = svc.BeginLogin(ctx)
+	if _, err := svc.FinishLogin(ctx, sessionID, a.get(challenge)); !errors.Is(err, ErrPasskeyInvalid) {
+		t.Fatalf("expected another challenge to be rejected, got %v", err)
+	}
+
+	// and come from an allowed origin
+	assertion, sessionID, _ = svc.BeginLogin(ctx)
+	a.origin = "https://evil.example"
+	if _, err := svc.FinishLogin(ctx, sessionID, a.get(assertion.Response.Challenge.String())); !errors.Is(err, ErrPasskeyInvalid) {
+		t.Fatalf("expected a foreign origin to be rejected, got %v", err)
+	}
+	a.origin = testOrigin
+
+	// registration sessions don't finish logins
+	creation, sessionID, _ := svc.BeginRegistration(ctx, user)
+	if _, err := svc.FinishLogin(ctx, sessionID, a.get(creation.Response.Challenge.String())); !errors.Is(err, ErrInvalidWebAuthnSession) {
+		t.Fatalf("expected a registration session to be refused, got %v", err)
+	}
+
+	// nor do they outlive the timeout
+	assertion, sessionID, _ = svc.BeginLogin(ctx)
+	mr.FastForward(svc.SessionTTL() + time.Second)
+	if _, err := svc.FinishLogin(ctx, sessionID, a.get(assertion.Response.Challenge.String())); !errors.Is(err, ErrInvalidWebAuthnSession) {
+		t.Fatalf("expected an expired session to fail, got %v", err)
+	}
+
+	// nor does a registration session of one user register for another
+	creation, sessionID, _ = svc.BeginRegistration(ctx, user)
+	other := &models.User{ID: uuid.New(), Phone: "+14155552671"}
+	b := newSoftAuthenticator(t)
+	if _, err := svc.FinishRegistration(ctx, other, sessionID, "", b.create(creation.Response.Challenge.String(), other.ID[:])); !errors.Is(err, ErrPasskeyRejected) {
+		t.Fatalf("expected a session of another user to be rejected, got %v", err)
+	}
+}
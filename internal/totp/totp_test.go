@@ -0,0 +1,80 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, SHA1
+	key := []byte("12345678901234567890")
+	cases := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for unix, want := range cases {
+		if got := hotp(key, uint64(Step(time.Unix(unix, 0))), 8); got != want {
+			t.Errorf("T=%d: expected %s, got %s", unix, want, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	code, err := Code(secret, Step(now))
+	if err != nil {
+		t.Fatalf("code: %v", err)
+	}
+	if code != "050471" {
+		t.Fatalf("expected the last 6 digits of the RFC vector, got %s", code)
+	}
+
+	if step, ok := Validate(secret, code, now, 1); !ok || step != Step(now) {
+		t.Fatalf("expected the current code to validate, got %d %v", step, ok)
+	}
+	// one step of drift is tolerated, two are not
+	if _, ok := Validate(secret, code, now.Add(Period), 1); !ok {
+		t.Error("expected a code from the previous step to validate")
+	}
+	if _, ok := Validate(secret, code, now.Add(2*Period), 1); ok {
+		t.Error("expected a code from two steps ago to be rejected")
+	}
+	if _, ok := Validate(secret, "000000", now, 1); ok {
+		t.Error("expected a wrong code to be rejected")
+	}
+	if _, ok := Validate("not base32!", code, now, 1); ok {
+		t.Error("expected an invalid secret to be rejected")
+	}
+}
+
+func TestGenerateSecretAndURI(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if len(secret) != 32 {
+		t.Fatalf("expected 32 base32 characters, got %q", secret)
+	}
+	if _, err := Code(secret, 1); err != nil {
+		t.Fatalf("generated secret doesn't decode: %v", err)
+	}
+
+	u, err := url.Parse(URI("Zeus", "+12025550100", secret))
+	if err != nil {
+		t.Fatalf("parse uri: %v", err)
+	}
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Zeus:+12025550100" {
+		t.Errorf("unexpected uri %s", u)
+	}
+	if q.Get("secret") != secret || q.Get("issuer") != "Zeus" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("unexpected parameters %v", q)
+	}
+}
@@ -0,0 +1,141 @@
+// Package tracing wires OpenTelemetry into the HTTP server, GORM and Redis.
+// Without an OTLP endpoint the global no-op tracer provider stays in place, so
+// spans cost next to nothing and nothing leaves the process.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	redisv9 "github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	gormtracing "gorm.io/plugin/opentelemetry/tracing"
+
+	"github.com/rznas/zeus/internal/apperr"
+)
+
+const instrumentationName = "github.com/rznas/zeus"
+
+// Options configures the OTLP/HTTP exporter
+type Options struct {
+	Endpoint    string  // host:port of the collector, empty disables export
+	Insecure    bool    // plain HTTP instead of TLS
+	ServiceName string  // service.name resource attribute
+	SampleRatio float64 // fraction of new traces to sample, parent decisions are honoured
+}
+
+// Setup installs the W3C trace-context propagator and, when an endpoint is
+// configured, a batching OTLP tracer provider. The returned function flushes
+// pending spans and must be called on shutdown.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporterOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("create otlp exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(opts.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Tracer returns the tracer used for spans created by this service
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Middleware starts a server span per request, continuing the trace from a
+// traceparent header, and stores it in the user context so handlers passing
+// c.UserContext() downstream get child spans. Only the path is recorded, the
+// query string may carry phone numbers.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		header := make(http.Header)
+		c.Request().Header.VisitAll(func(k, v []byte) {
+			header.Add(string(k), string(v))
+		})
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), propagation.HeaderCarrier(header))
+
+		ctx, span := Tracer().Start(ctx, c.Method(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Method()),
+				semconv.URLPath(c.Path()),
+			),
+		)
+		defer span.End()
+
+		parent := c.UserContext()
+		c.SetUserContext(ctx)
+		defer c.SetUserContext(parent)
+
+		err := c.Next()
+
+		status, matched := c.Response().StatusCode(), true
+		if err != nil {
+			span.RecordError(err)
+			status = apperr.Status(err)
+			if fe, ok := err.(*fiber.Error); ok {
+				// no route matched, Route() is whatever middleware ran last
+				matched = fe.Code != fiber.StatusNotFound
+			}
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if matched {
+			// the route template is only known once routing is done
+			span.SetName(c.Method() + " " + c.Route().Path)
+			span.SetAttributes(semconv.HTTPRoute(c.Route().Path))
+		} else {
+			span.SetName(c.Method())
+		}
+		if status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
+
+// InstrumentGORM adds a child span per query. Bind values are left out of
+// the recorded statements.
+func InstrumentGORM(db *gorm.DB) error {
+	return db.Use(gormtracing.NewPlugin(
+		gormtracing.WithoutQueryVariables(),
+		gormtracing.WithoutMetrics(),
+	))
+}
+
+// InstrumentRedis adds a child span per command. Statements are not recorded
+// because keys and values hold phone numbers and codes.
+func InstrumentRedis(rdb *redisv9.Client) error {
+	return redisotel.InstrumentTracing(rdb, redisotel.WithDBStatement(false))
+}
@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMiddlewareContinuesTrace(t *testing.T) {
+	if _, err := Setup(context.Background(), Options{}); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	app := fiber.New()
+	app.Use(Middleware())
+	app.Get("/users/:id", func(c *fiber.Ctx) error {
+		_, span := Tracer().Start(c.UserContext(), "child")
+		span.End()
+		return c.SendString("ok")
+	})
+
+	req := httptest.NewRequest("GET", "/users/42?phone=%2B14155552671", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if _, err := app.Test(req); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	child, server := spans[0], spans[1]
+	if server.Name() != "GET /users/:id" {
+		t.Errorf("unexpected server span name %q", server.Name())
+	}
+	if server.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("server span did not continue the incoming trace")
+	}
+	if child.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("handler span is not a child of the server span")
+	}
+	for _, kv := range server.Attributes() {
+		if v := kv.Value.Emit(); strings.Contains(v, "phone") {
+			t.Errorf("query string recorded in %s", kv.Key)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Package validation binds request bodies and query strings to structs and
+// checks them against their `validate` tags (github.com/go-playground/validator).
+// Every problem is reported per field, keyed by the field's json or query
+// name, as an apperr validation error.
+//
+// Request types may implement Normalizer to trim or canonicalize their fields
+// before the tags are checked.
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/rznas/zeus/internal/apperr"
+)
+
+// ErrInvalidBody is returned for bodies that can't be decoded at all
+var ErrInvalidBody = apperr.Invalid("invalid_body", "request body is not valid JSON")
+
+// Normalizer is implemented by requests that clean up their fields before validation
+type Normalizer interface {
+	Normalize()
+}
+
+var (
+	validate = newValidator()
+	// messages of the tags added with Register
+	custom = map[string]string{}
+)
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	// report fields under the names clients use
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		return paramName(f)
+	})
+	return v
+}
+
+// Register adds a validation tag for string fields, message is reported when fn returns false.
+// It must be called before the first request is validated, typically from init.
+func Register(tag, message string, fn func(string) bool) {
+	err := validate.RegisterValidation(tag, func(fl validator.FieldLevel) bool {
+		return fn(fl.Field().String())
+	})
+	if err != nil {
+		panic(fmt.Sprintf("validation: register %q: %v", tag, err))
+	}
+	custom[tag] = message
+}
+
+// ParseBody decodes the request body into dst and validates it
+func ParseBody(c *fiber.Ctx, dst any) error {
+	if err := c.BodyParser(dst); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return apperr.Validation(map[string]string{typeErr.Field: typeMessage(typeErr.Type)})
+		}
+		return ErrInvalidBody
+	}
+	return Struct(dst)
+}
+
+// ParseQuery decodes the query string into dst and validates it. Fields
+// missing from the query keep the values dst already has, so set defaults
+// before calling it.
+func ParseQuery(c *fiber.Ctx, dst any) error {
+	fields := map[string]string{}
+	if err := c.QueryParser(dst); err != nil {
+		keys := decodeErrorKeys(err)
+		if len(keys) == 0 {
+			return apperr.Invalid("invalid_query", "malformed query string")
+		}
+		for _, key := range keys {
+			fields[key] = typeMessage(fieldType(reflect.TypeOf(dst), key))
+		}
+	}
+	// still check the other parameters so every problem is reported at once
+	for name, msg := range Fields(dst) {
+		if _, ok := fields[name]; !ok {
+			fields[name] = msg
+		}
+	}
+	if len(fields) > 0 {
+		return apperr.Validation(fields)
+	}
+	return nil
+}
+
+// Struct validates v, a pointer to a struct, and returns a validation error listing every invalid field
+func Struct(v any) error {
+	if fields := Fields(v); len(fields) > 0 {
+		return apperr.Validation(fields)
+	}
+	return nil
+}
+
+// Fields normalizes and validates v and returns a message per invalid field.
+// Handlers use it to merge checks that can't be expressed as tags.
+func Fields(v any) map[string]string {
+	if n, ok := v.(Normalizer); ok {
+		n.Normalize()
+	}
+	fields := map[string]string{}
+	err := validate.Struct(v)
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		if err != nil {
+			// only happens for a programming error such as passing a non-struct
+			panic(fmt.Sprintf("validation: %v", err))
+		}
+		return fields
+	}
+	for _, fe := range verrs {
+		if _, ok := fields[fe.Field()]; !ok {
+			fields[fe.Field()] = message(fe)
+		}
+	}
+	return fields
+}
+
+// message describes a failed tag to clients
+func message(fe validator.FieldError) string {
+	unit := ""
+	if fe.Kind() == reflect.String {
+		unit = " characters"
+	}
+	switch fe.Tag() {
+	case "required", "required_with", "required_without":
+		return "required"
+	case "min":
+		return "must be at least " + fe.Param() + unit
+	case "max":
+		return "must be at most " + fe.Param() + unit
+	case "len":
+		return "must be exactly " + fe.Param() + unit
+	case "oneof":
+		return "must be one of " + strings.Join(strings.Fields(fe.Param()), ", ")
+	case "email":
+		return "must be a valid email address"
+	case "http_url":
+		return "must be an absolute http(s) URL"
+	case "bcp47_language_tag":
+		return "must be a BCP 47 language tag"
+	case "alphanum":
+		return "must only contain letters and digits"
+	case "numeric":
+		return "must only contain digits"
+	}
+	if msg, ok := custom[fe.Tag()]; ok {
+		return msg
+	}
+	return "is invalid"
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// typeMessage describes the value expected for a Go type
+func typeMessage(t reflect.Type) string {
+	if t == nil {
+		return "is invalid"
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return "must be an RFC 3339 timestamp"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "must be true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "must be an integer"
+	case reflect.Float32, reflect.Float64:
+		return "must be a number"
+	case reflect.String:
+		return "must be a string"
+	}
+	return "is invalid"
+}
+
+// paramName is the json or query name of a field, "" for skipped fields
+func paramName(f reflect.StructField) string {
+	for _, tag := range []string{"json", "query"} {
+		name, _, _ := strings.Cut(f.Tag.Get(tag), ",")
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+// fieldType finds the type of the field named name in the struct t points to,
+// looking into embedded structs
+func fieldType(t reflect.Type, name string) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Tag.Get("query") == "" && f.Tag.Get("json") == "" {
+			if ft := fieldType(f.Type, name); ft != nil {
+				return ft
+			}
+			continue
+		}
+		if paramName(f) == name {
+			return f.Type
+		}
+	}
+	return nil
+}
+
+// decodeErrorKeys returns the parameters Fiber's form decoder failed to
+// convert. Its error type is internal to Fiber, but it is a map keyed by
+// parameter name.
+func decodeErrorKeys(err error) []string {
+	for ; err != nil; err = errors.Unwrap(err) {
+		v := reflect.ValueOf(err)
+		if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+			continue
+		}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		return keys
+	}
+	return nil
+}
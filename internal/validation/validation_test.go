@@ -0,0 +1,117 @@
+package validation
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/rznas/zeus/internal/apperr"
+)
+
+type testBody struct {
+	Name  string  `json:"name" validate:"required,max=5"`
+	Kind  string  `json:"kind" validate:"omitempty,oneof=a b"`
+	Count int     `json:"count"`
+	Note  *string `json:"note" validate:"omitzero,lowercase_only"`
+}
+
+func (b *testBody) Normalize() {
+	b.Name = strings.TrimSpace(b.Name)
+}
+
+type testQuery struct {
+	Limit int        `query:"limit" validate:"min=1"`
+	Since *time.Time `query:"since"`
+	Exact bool       `query:"exact"`
+	Kind  string     `query:"kind" validate:"omitempty,oneof=a b"`
+}
+
+func init() {
+	Register("lowercase_only", "must be lowercase", func(s string) bool { return s == strings.ToLower(s) })
+}
+
+// run sends a request through handler and returns what it returned, with the field errors of a validation error
+func run(t *testing.T, handler fiber.Handler, method, target, body string) (map[string]string, error) {
+	t.Helper()
+	var got error
+	app := fiber.New()
+	app.Add(method, "/", func(c *fiber.Ctx) error {
+		got = handler(c)
+		return nil
+	})
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if _, err := app.Test(req); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	var appErr *apperr.Error
+	if errors.As(got, &appErr) {
+		return appErr.Fields, got
+	}
+	return nil, got
+}
+
+func TestParseBody(t *testing.T) {
+	var b testBody
+	parse := func(c *fiber.Ctx) error {
+		b = testBody{}
+		return ParseBody(c, &b)
+	}
+
+	if _, err := run(t, parse, "POST", "/", `{"name": "  ada  ", "kind": "a"}`); err != nil {
+		t.Fatalf("expected valid body, got %v", err)
+	}
+	if b.Name != "ada" {
+		t.Fatalf("expected normalized name, got %q", b.Name)
+	}
+
+	fields, _ := run(t, parse, "POST", "/", `{"name": "toolong", "kind": "c", "note": "Loud"}`)
+	want := map[string]string{"name": "must be at most 5 characters", "kind": "must be one of a, b", "note": "must be lowercase"}
+	for name, msg := range want {
+		if fields[name] != msg {
+			t.Errorf("%s: expected %q, got %q", name, msg, fields[name])
+		}
+	}
+
+	if fields, _ := run(t, parse, "POST", "/", `{"name": "ada", "count": "three"}`); fields["count"] != "must be an integer" {
+		t.Errorf("expected type error on count, got %v", fields)
+	}
+	if fields, _ := run(t, parse, "POST", "/", `{}`); fields["name"] != "required" {
+		t.Errorf("expected name to be required, got %v", fields)
+	}
+	if _, err := run(t, parse, "POST", "/", `{"name": `); !errors.Is(err, ErrInvalidBody) {
+		t.Errorf("expected invalid body, got %v", err)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	var q testQuery
+	parse := func(c *fiber.Ctx) error {
+		q = testQuery{Limit: 10}
+		return ParseQuery(c, &q)
+	}
+
+	if _, err := run(t, parse, "GET", "/?since=2026-01-02T03:04:05Z&exact=true", ""); err != nil {
+		t.Fatalf("expected valid query, got %v", err)
+	}
+	if q.Limit != 10 || q.Since == nil || !q.Exact {
+		t.Fatalf("unexpected query %+v", q)
+	}
+
+	fields, _ := run(t, parse, "GET", "/?limit=x&since=yesterday&exact=maybe&kind=c", "")
+	want := map[string]string{
+		"limit": "must be an integer",
+		"since": "must be an RFC 3339 timestamp",
+		"exact": "must be true or false",
+		"kind":  "must be one of a, b",
+	}
+	for name, msg := range want {
+		if fields[name] != msg {
+			t.Errorf("%s: expected %q, got %q", name, msg, fields[name])
+		}
+	}
+}